@@ -5,10 +5,12 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -296,3 +298,107 @@ func (r *eventReporter) ChunkResize(id int, _ int64) {
 }
 
 func (r *eventReporter) ChunkProgress(int, int, time.Duration) {}
+
+// TestDoPerRequestOverrides: one Downloader serves a many-part download and
+// a single-stream one side by side, each with its own parts, floor, and
+// headers, and a request may lift the Options' overwrite and content-type
+// rules.
+func TestDoPerRequestOverrides(t *testing.T) {
+	t.Parallel()
+	big, small := testData(256<<10), testData(64<<10)
+	var mu sync.Mutex
+	seen := make(map[string][]string) // path → X-Job values
+	var stBig, stSmall stats
+	mux := http.NewServeMux()
+	record := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			seen[r.URL.Path] = append(seen[r.URL.Path], r.Header.Get("X-Team")+"/"+r.Header.Get("X-Job"))
+			mu.Unlock()
+			h.ServeHTTP(w, r)
+		})
+	}
+	mux.Handle("/big.bin", record(rangeHandler(big, `"big"`, &stBig)))
+	mux.Handle("/small.bin", record(withContentType("text/html", rangeHandler(small, `"small"`, &stSmall))))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	d := newDL(t, &Options{
+		Parts: 4, MinPartSize: 16 << 10,
+		Headers:            http.Header{"X-Team": {"infra"}, "X-Job": {"default"}},
+		RejectContentTypes: []string{"text/html"},
+	})
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "small.bin"), []byte("stale"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	var wg sync.WaitGroup
+	var errBig, errSmall error
+	wg.Go(func() {
+		_, errBig = d.Do(t.Context(), &Request{
+			URL: srv.URL + "/big.bin", Dest: filepath.Join(dir, "big.bin"),
+			MinParts: 4, Headers: http.Header{"x-job": {"images"}},
+			Timeout: time.Minute, MaxRetries: 3,
+		})
+	})
+	wg.Go(func() {
+		_, errSmall = d.Do(t.Context(), &Request{
+			URL: srv.URL + "/small.bin", Dest: filepath.Join(dir, "small.bin"),
+			Parts: 1, Overwrite: true, RejectContentTypes: []string{},
+			Logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		})
+	})
+	wg.Wait()
+	if errBig != nil || errSmall != nil {
+		t.Fatalf("Do errors: %v / %v", errBig, errSmall)
+	}
+	for name, want := range map[string][]byte{"big.bin": big, "small.bin": small} {
+		if got, _ := os.ReadFile(filepath.Join(dir, name)); !bytes.Equal(got, want) {
+			t.Errorf("%s differs from source", name)
+		}
+	}
+	if n := len(stBig.rangeHeaders()); n < 4 {
+		t.Errorf("big download made %d requests, want its 4 parts", n)
+	}
+	if n := len(stSmall.rangeHeaders()); n != 1 {
+		t.Errorf("small download made %d requests, want its single stream", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for path, want := range map[string]string{"/big.bin": "infra/images", "/small.bin": "infra/default"} {
+		for _, got := range seen[path] {
+			if got != want {
+				t.Errorf("%s request headers %q, want %q", path, got, want)
+			}
+		}
+	}
+	if !strings.Contains(logs.String(), "election") {
+		t.Error("per-request Logger received nothing")
+	}
+}
+
+func TestDoInvalidOverrides(t *testing.T) {
+	t.Parallel()
+	d := newDL(t, &Options{Parts: 4, MinParts: 2})
+	for name, req := range map[string]*Request{
+		"min above parts":  {Parts: 2, MinParts: 3},
+		"negative parts":   {Parts: -1},
+		"negative timeout": {Timeout: -time.Second},
+		"negative retries": {MaxRetries: -1},
+	} {
+		req.URL = "http://x/"
+		if _, err := d.Do(t.Context(), req); err == nil || !strings.Contains(err.Error(), "invalid Request.") {
+			t.Errorf("%s: err = %v, want a validation error", name, err)
+		}
+	}
+	// Parts below the Options floor lowers the floor with it.
+	var rq resolvedRequest
+	if err := d.resolveOverrides(&Request{Parts: 1}, &rq); err != nil || rq.minParts != 1 {
+		t.Errorf("Parts 1 under MinParts 2: minParts %d, err %v", rq.minParts, err)
+	}
+	// Parts above Options.Parts is capped at it.
+	if err := d.resolveOverrides(&Request{Parts: 16}, &rq); err != nil || rq.parts != 4 {
+		t.Errorf("Parts 16 over Options.Parts 4: parts %d, err %v", rq.parts, err)
+	}
+}
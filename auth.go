@@ -0,0 +1,505 @@
+package download
+
+import (
+	"cmp"
+	"context"
+	"crypto/md5" // #nosec G501 -- Digest auth's default algorithm, not used for integrity
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator answers HTTP authentication challenges for
+// Options.Authenticator. One Authenticator serves every request of a
+// Downloader concurrently, so credentials it acquires (a token, a Digest
+// nonce) are shared by all workers.
+//
+// Credentials only ever reach the download's own host or its subdomains,
+// the same rule Options.Headers follows: neither method is consulted for a
+// redirect to an unrelated host, and a 401 from such a host is returned as
+// is.
+type Authenticator interface {
+	// Authorize returns the headers to send with req from credentials an
+	// earlier challenge established, sparing each request a 401 round
+	// trip; nil when there are none (yet) for req.
+	Authorize(req *http.Request) http.Header
+	// Authenticate answers a 401 with the headers to retry the request
+	// with. It is called once per refused request; a second 401 is final.
+	Authenticate(ctx context.Context, c *Challenge) (http.Header, error)
+}
+
+// Challenge is a 401 response an Authenticator is asked to answer.
+type Challenge struct {
+	// Request is the refused request, with the credentials it carried.
+	Request *http.Request
+	// WWWAuthenticate holds the response's WWW-Authenticate values.
+	WWWAuthenticate []string
+	// Client reaches a token service through the Downloader's transport
+	// (TLS settings, proxy, pins).
+	Client *http.Client
+}
+
+// AuthError is returned when an Authenticator could not answer a
+// challenge. It is not retried.
+type AuthError struct {
+	Host string
+	Err  error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authenticate to %s: %v", e.Host, e.Err)
+}
+
+func (e *AuthError) Unwrap() error { return e.Err }
+
+// authTransport applies Options.Authenticator to the requests of one
+// download: credentials up front where the Authenticator has them, and one
+// retry with fresh ones after a 401. source is the download's URL, which
+// decides the hosts credentials may reach.
+type authTransport struct {
+	auth   Authenticator
+	source *url.URL
+	client *http.Client // for Challenge.Client
+	next   http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !shouldCopySensitiveHeaders(t.source, req.URL) {
+		return t.next.RoundTrip(req)
+	}
+	if h := t.auth.Authorize(req); h != nil {
+		req = withHeaders(req, h)
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized ||
+		len(resp.Header.Values("WWW-Authenticate")) == 0 ||
+		(req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		return resp, err
+	}
+	h, err := t.auth.Authenticate(req.Context(), &Challenge{
+		Request:         req,
+		WWWAuthenticate: resp.Header.Values("WWW-Authenticate"),
+		Client:          t.client,
+	})
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, &AuthError{Host: req.URL.Hostname(), Err: err}
+	}
+	retry := withHeaders(req, h)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.next.RoundTrip(retry)
+}
+
+// withHeaders returns a copy of req with h's fields replacing its own; a
+// RoundTripper must not modify the request it was given.
+func withHeaders(req *http.Request, h http.Header) *http.Request {
+	out := req.Clone(req.Context())
+	for k, vs := range h {
+		out.Header[http.CanonicalHeaderKey(k)] = slices.Clone(vs)
+	}
+	return out
+}
+
+// authChallenge is one parsed WWW-Authenticate challenge; scheme and
+// parameter names are lower-case.
+type authChallenge struct {
+	scheme string
+	params map[string]string
+}
+
+// parseChallenges parses WWW-Authenticate values (RFC 9110 §11.6.1), each
+// of which may hold several comma-separated challenges.
+func parseChallenges(values []string) []authChallenge {
+	var out []authChallenge
+	for _, v := range values {
+		p := authParser{s: v}
+		for {
+			p.skip(" \t,")
+			scheme := p.token()
+			if scheme == "" {
+				break
+			}
+			c := authChallenge{scheme: strings.ToLower(scheme), params: make(map[string]string)}
+			for {
+				p.skip(" \t")
+				save := p.i
+				name := p.token()
+				p.skip(" \t")
+				if name == "" || !p.consume('=') {
+					// The next challenge's scheme (or a token68, which no
+					// supported scheme uses).
+					p.i = save
+					break
+				}
+				p.skip(" \t")
+				c.params[strings.ToLower(name)] = p.value()
+				p.skip(" \t")
+				if !p.consume(',') {
+					break
+				}
+			}
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+type authParser struct {
+	s string
+	i int
+}
+
+func (p *authParser) skip(chars string) {
+	for p.i < len(p.s) && strings.IndexByte(chars, p.s[p.i]) >= 0 {
+		p.i++
+	}
+}
+
+func (p *authParser) consume(c byte) bool {
+	if p.i < len(p.s) && p.s[p.i] == c {
+		p.i++
+		return true
+	}
+	return false
+}
+
+// token reads an RFC 9110 token (and token68 characters other than '=').
+func (p *authParser) token() string {
+	start := p.i
+	for p.i < len(p.s) && !strings.ContainsRune(" \t,=\"", rune(p.s[p.i])) {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+// value reads a token or a quoted-string, unescaping the latter.
+func (p *authParser) value() string {
+	if !p.consume('"') {
+		return p.token()
+	}
+	var b strings.Builder
+	for p.i < len(p.s) && p.s[p.i] != '"' {
+		if p.s[p.i] == '\\' && p.i+1 < len(p.s) {
+			p.i++
+		}
+		b.WriteByte(p.s[p.i])
+		p.i++
+	}
+	p.consume('"')
+	return b.String()
+}
+
+// findChallenge returns the first challenge of the given scheme.
+func findChallenge(values []string, scheme string) (authChallenge, bool) {
+	for _, c := range parseChallenges(values) {
+		if c.scheme == scheme {
+			return c, true
+		}
+	}
+	return authChallenge{}, false
+}
+
+// NewBearerAuth returns an Authenticator for the Docker/OCI registry token
+// flow: a Bearer challenge names a token service (realm, service, scope),
+// which is asked for a token with username and password as Basic
+// credentials, or anonymously when username is empty. Tokens are cached per
+// challenge and reused for later requests under the same path until they
+// expire; workers refused at once share a single fetch.
+func NewBearerAuth(username, password string) Authenticator {
+	return &bearerAuth{
+		username: username,
+		password: password,
+		tokens:   make(map[string]*bearerToken),
+		scopes:   make(map[string]string),
+	}
+}
+
+type bearerAuth struct {
+	username, password string
+	fetch              sync.Mutex // serializes token fetches
+	mu                 sync.Mutex
+	tokens             map[string]*bearerToken // by challenge
+	scopes             map[string]string       // request scope → challenge
+}
+
+type bearerToken struct {
+	value   string
+	expires time.Time
+}
+
+// bearerExpirySlack retires a token this long before the service says it
+// expires, so a request does not race its expiry.
+const bearerExpirySlack = 5 * time.Second
+
+func (t *bearerToken) valid(now time.Time) bool {
+	return t != nil && now.Before(t.expires.Add(-bearerExpirySlack))
+}
+
+// requestScope keys the requests a token is presumed to cover: the same
+// host and directory.
+func requestScope(u *url.URL) string {
+	dir := path.Dir(u.EscapedPath())
+	// A registry repository's manifests and blobs share a token.
+	if b := path.Base(dir); b == "manifests" || b == "blobs" {
+		dir = path.Dir(dir)
+	}
+	return strings.ToLower(u.Host) + dir
+}
+
+func (b *bearerAuth) Authorize(req *http.Request) http.Header {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tok := b.tokens[b.scopes[requestScope(req.URL)]]
+	if !tok.valid(time.Now()) {
+		return nil
+	}
+	return http.Header{"Authorization": {"Bearer " + tok.value}}
+}
+
+func (b *bearerAuth) Authenticate(ctx context.Context, c *Challenge) (http.Header, error) {
+	ch, ok := findChallenge(c.WWWAuthenticate, "bearer")
+	if !ok {
+		return nil, errors.New("no Bearer challenge")
+	}
+	realm := ch.params["realm"]
+	if realm == "" {
+		return nil, errors.New("Bearer challenge without realm")
+	}
+	key := realm + "\x00" + ch.params["service"] + "\x00" + ch.params["scope"]
+	b.fetch.Lock()
+	defer b.fetch.Unlock()
+	b.mu.Lock()
+	tok := b.tokens[key]
+	b.mu.Unlock()
+	// A sibling may have refreshed the token while this request was being
+	// refused with the old one.
+	if !tok.valid(time.Now()) || c.Request.Header.Get("Authorization") == "Bearer "+tok.value {
+		var err error
+		if tok, err = b.fetchToken(ctx, c.Client, realm, ch.params["service"], ch.params["scope"]); err != nil {
+			return nil, err
+		}
+	}
+	b.mu.Lock()
+	b.tokens[key] = tok
+	b.scopes[requestScope(c.Request.URL)] = key
+	b.mu.Unlock()
+	return http.Header{"Authorization": {"Bearer " + tok.value}}, nil
+}
+
+func (b *bearerAuth) fetchToken(
+	ctx context.Context, client *http.Client, realm, service, scope string,
+) (*bearerToken, error) {
+	u, err := url.Parse(realm)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, fmt.Errorf("invalid token realm %q", redactURL(realm))
+	}
+	q := u.Query()
+	if service != "" {
+		q.Set("service", service)
+	}
+	for s := range strings.FieldsSeq(scope) {
+		q.Add("scope", s)
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if b.username != "" {
+		req.SetBasicAuth(b.username, b.password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, redactErr(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token service %s: %w", u.Host, StatusError(resp.StatusCode))
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("token service %s: %w", u.Host, err)
+	}
+	tok := &bearerToken{value: cmp.Or(body.Token, body.AccessToken)}
+	if tok.value == "" {
+		return nil, fmt.Errorf("token service %s: no token in response", u.Host)
+	}
+	// The token specification's default lifetime is 60 seconds.
+	lifetime := 60 * time.Second
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+	tok.expires = time.Now().Add(lifetime)
+	return tok, nil
+}
+
+// NewDigestAuth returns an Authenticator for HTTP Digest authentication
+// (RFC 7616) with the MD5, SHA-256, and SHA-512-256 algorithms and their
+// -sess variants, qop "auth" or none. A server's nonce is shared by all
+// workers, each request taking the next nonce count, until the server
+// issues a new one.
+func NewDigestAuth(username, password string) Authenticator {
+	return &digestAuth{username: username, password: password, spaces: make(map[string]*digestSpace)}
+}
+
+type digestAuth struct {
+	username, password string
+	mu                 sync.Mutex
+	spaces             map[string]*digestSpace // by host:port
+}
+
+// digestSpace is the latest challenge of one host and its nonce count.
+type digestSpace struct {
+	realm, nonce, opaque, algorithm, qop string
+	nc                                   uint32
+}
+
+func (a *digestAuth) Authorize(req *http.Request) http.Header {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sp := a.spaces[canonicalAddr(req.URL)]
+	if sp == nil {
+		return nil
+	}
+	return a.header(req, sp)
+}
+
+func (a *digestAuth) Authenticate(_ context.Context, c *Challenge) (http.Header, error) {
+	var ch authChallenge
+	found := false
+	// Prefer the strongest algorithm offered.
+	for _, cand := range parseChallenges(c.WWWAuthenticate) {
+		if cand.scheme != "digest" {
+			continue
+		}
+		if _, ok := digestHash(cand.params["algorithm"]); !ok {
+			continue
+		}
+		if !found || digestRank(cand.params["algorithm"]) > digestRank(ch.params["algorithm"]) {
+			ch, found = cand, true
+		}
+	}
+	if !found {
+		return nil, errors.New("no Digest challenge with a supported algorithm")
+	}
+	if ch.params["nonce"] == "" {
+		return nil, errors.New("Digest challenge without nonce")
+	}
+	qop := ""
+	if offered := ch.params["qop"]; offered != "" {
+		for q := range strings.SplitSeq(offered, ",") {
+			if strings.TrimSpace(q) == "auth" {
+				qop = "auth"
+			}
+		}
+		if qop == "" {
+			return nil, fmt.Errorf("unsupported Digest qop %q", offered)
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := canonicalAddr(c.Request.URL)
+	sp := a.spaces[key]
+	if sp == nil || sp.nonce != ch.params["nonce"] {
+		sp = &digestSpace{
+			realm:     ch.params["realm"],
+			nonce:     ch.params["nonce"],
+			opaque:    ch.params["opaque"],
+			algorithm: ch.params["algorithm"],
+			qop:       qop,
+		}
+		a.spaces[key] = sp
+	}
+	return a.header(c.Request, sp), nil
+}
+
+// header computes the Authorization header for req; a.mu must be held.
+func (a *digestAuth) header(req *http.Request, sp *digestSpace) http.Header {
+	uri := req.URL.RequestURI()
+	sp.nc++
+	nc := fmt.Sprintf("%08x", sp.nc)
+	cnonce := rand.Text()
+	response := a.response(sp, req.Method, uri, nc, cnonce)
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username=%s, realm=%s, nonce=%s, uri=%s, response="%s"`,
+		quote(a.username), quote(sp.realm), quote(sp.nonce), quote(uri), response)
+	if sp.algorithm != "" {
+		fmt.Fprintf(&b, ", algorithm=%s", sp.algorithm)
+	}
+	if sp.qop != "" {
+		fmt.Fprintf(&b, `, qop=%s, nc=%s, cnonce="%s"`, sp.qop, nc, cnonce)
+	}
+	if sp.opaque != "" {
+		fmt.Fprintf(&b, ", opaque=%s", quote(sp.opaque))
+	}
+	return http.Header{"Authorization": {b.String()}}
+}
+
+// response computes the Digest request-digest (RFC 7616 §3.4.1).
+func (a *digestAuth) response(sp *digestSpace, method, uri, nc, cnonce string) string {
+	newHash, _ := digestHash(sp.algorithm)
+	h := func(s string) string {
+		d := newHash()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	ha1 := h(a.username + ":" + sp.realm + ":" + a.password)
+	if strings.HasSuffix(strings.ToLower(sp.algorithm), "-sess") {
+		ha1 = h(ha1 + ":" + sp.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+	if sp.qop == "" {
+		return h(ha1 + ":" + sp.nonce + ":" + ha2)
+	}
+	return h(ha1 + ":" + sp.nonce + ":" + nc + ":" + cnonce + ":" + sp.qop + ":" + ha2)
+}
+
+// digestHash returns the hash of a Digest algorithm name (empty is MD5).
+func digestHash(algorithm string) (func() hash.Hash, bool) {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		return md5.New, true
+	case "SHA-256":
+		return sha256.New, true
+	case "SHA-512-256":
+		return sha512.New512_256, true
+	}
+	return nil, false
+}
+
+func digestRank(algorithm string) int {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "SHA-512-256":
+		return 2
+	case "SHA-256":
+		return 1
+	}
+	return 0
+}
+
+// quote renders s as an HTTP quoted-string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,286 @@
+package download
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tokenService is a registry token endpoint issuing token to user:pass.
+type tokenService struct {
+	token   string
+	fetches atomic.Int32
+	srv     *httptest.Server
+}
+
+func newTokenService(t *testing.T, user, pass, token string) *tokenService {
+	t.Helper()
+	ts := &tokenService{token: token}
+	ts.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts.fetches.Add(1)
+		u, p, ok := r.BasicAuth()
+		if !ok || u != user || p != pass {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("service") != "registry.test" ||
+			r.URL.Query().Get("scope") != "repository:lib/app:pull" {
+			http.Error(w, "bad scope", http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"token": ts.token, "expires_in": 300})
+	}))
+	t.Cleanup(ts.srv.Close)
+	return ts
+}
+
+// bearerGate refuses requests without ts's token, challenging them to fetch
+// one, and passes the rest to next.
+func bearerGate(ts *tokenService, refused *atomic.Int32, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+ts.token {
+			refused.Add(1)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+				`Bearer realm="%s/token",service="registry.test",scope="repository:lib/app:pull"`, ts.srv.URL))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TestBearerAuthSharesTokenAcrossWorkers: one 401 and one token fetch serve
+// the election and every part.
+func TestBearerAuthSharesTokenAcrossWorkers(t *testing.T) {
+	t.Parallel()
+	data := testData(256 << 10)
+	var st stats
+	var refused atomic.Int32
+	ts := newTokenService(t, "alice", "s3cret", "tok-1")
+	srv := httptest.NewServer(bearerGate(ts, &refused, rangeHandler(data, `"v1"`, &st)))
+	t.Cleanup(srv.Close)
+
+	d := newDL(t, &Options{
+		Parts: 4, MinParts: 4, MinPartSize: 16 << 10,
+		Authenticator: NewBearerAuth("alice", "s3cret"),
+	})
+	_, got := mustGet(t, d, srv.URL+"/v2/lib/app/blobs/sha256:abc", filepath.Join(t.TempDir(), "blob"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	if n := ts.fetches.Load(); n != 1 {
+		t.Errorf("token fetched %d times, want 1", n)
+	}
+	if n := refused.Load(); n != 1 {
+		t.Errorf("registry refused %d requests, want only the first", n)
+	}
+	if n := len(st.rangeHeaders()); n < 4 {
+		t.Errorf("%d authorized requests, want every part", n)
+	}
+}
+
+// TestBearerAuthConcurrentRefresh: workers refused with the same stale
+// token at once share a single fetch.
+func TestBearerAuthConcurrentRefresh(t *testing.T) {
+	t.Parallel()
+	ts := newTokenService(t, "alice", "s3cret", "tok-2")
+	auth := NewBearerAuth("alice", "s3cret")
+	challenge := fmt.Sprintf(
+		`Bearer realm="%s/token", service="registry.test", scope="repository:lib/app:pull", error="invalid_token"`,
+		ts.srv.URL)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			req := httptest.NewRequest(http.MethodGet, "http://registry.test/v2/lib/app/blobs/x", nil)
+			req.Header.Set("Authorization", "Bearer tok-1")
+			h, err := auth.Authenticate(t.Context(), &Challenge{
+				Request:         req,
+				WWWAuthenticate: []string{challenge},
+				Client:          http.DefaultClient,
+			})
+			if err != nil || h.Get("Authorization") != "Bearer tok-2" {
+				t.Errorf("Authenticate = %v, %v", h, err)
+			}
+		})
+	}
+	wg.Wait()
+	if n := ts.fetches.Load(); n != 1 {
+		t.Errorf("token fetched %d times, want 1", n)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://registry.test/v2/lib/app/blobs/y", nil)
+	if h := auth.Authorize(req); h.Get("Authorization") != "Bearer tok-2" {
+		t.Errorf("Authorize = %v, want the cached token for the repository", h)
+	}
+}
+
+// TestAuthenticatorWithheldFromRedirectHost: the blob redirect to an
+// unrelated host (a CDN) carries no registry token.
+func TestAuthenticatorWithheldFromRedirectHost(t *testing.T) {
+	t.Parallel()
+	data := testData(64 << 10)
+	var mu sync.Mutex
+	var leaked []string
+	blobs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("Authorization"); v != "" {
+			mu.Lock()
+			leaked = append(leaked, v)
+			mu.Unlock()
+			w.Header().Set("WWW-Authenticate", `Bearer realm="http://127.0.0.1:1/token"`)
+			http.Error(w, "unexpected credentials", http.StatusUnauthorized)
+			return
+		}
+		writeBareRange(w, r, data, `"v1"`)
+	}))
+	t.Cleanup(blobs.Close)
+	var refused atomic.Int32
+	ts := newTokenService(t, "alice", "s3cret", "tok-1")
+	registry := httptest.NewServer(bearerGate(ts, &refused, http.RedirectHandler(blobs.URL+"/blob", http.StatusTemporaryRedirect)))
+	t.Cleanup(registry.Close)
+	// The registry is "localhost", the blob store 127.0.0.1: unrelated hosts.
+	source := strings.Replace(registry.URL, "127.0.0.1", "localhost", 1) + "/v2/lib/app/blobs/sha256:abc"
+
+	d := newDL(t, &Options{Parts: 2, MinPartSize: 4 << 10, Authenticator: NewBearerAuth("alice", "s3cret")})
+	_, got := mustGet(t, d, source, filepath.Join(t.TempDir(), "blob"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	if refused.Load() == 0 {
+		t.Error("registry never challenged; scenario not exercised")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(leaked) > 0 {
+		t.Errorf("redirect host received credentials: %q", leaked)
+	}
+}
+
+func TestBearerAuthFailureIsPermanent(t *testing.T) {
+	t.Parallel()
+	var st stats
+	var refused atomic.Int32
+	ts := newTokenService(t, "alice", "s3cret", "tok-1")
+	srv := httptest.NewServer(bearerGate(ts, &refused, rangeHandler(testData(1024), `"v1"`, &st)))
+	t.Cleanup(srv.Close)
+
+	d := newDL(t, &Options{Authenticator: NewBearerAuth("alice", "wrong")})
+	dest := filepath.Join(t.TempDir(), "blob")
+	start := time.Now()
+	_, err := d.Get(t.Context(), srv.URL+"/v2/lib/app/blobs/x", dest)
+	ae, ok := errors.AsType[*AuthError](err)
+	if !ok {
+		t.Fatalf("err = %v, want *AuthError", err)
+	}
+	if ae.Host != "127.0.0.1" {
+		t.Errorf("AuthError.Host = %q, want 127.0.0.1", ae.Host)
+	}
+	if !strings.Contains(err.Error(), "401") {
+		t.Errorf("err = %v, want the token service's refusal", err)
+	}
+	if time.Since(start) > time.Second || ts.fetches.Load() != 1 {
+		t.Errorf("authentication failure was retried (%d token fetches)", ts.fetches.Load())
+	}
+	assertClean(t, dest)
+}
+
+// TestDigestAuthRFC7616Example checks the request-digest against RFC 7616
+// §3.9.1.
+func TestDigestAuthRFC7616Example(t *testing.T) {
+	t.Parallel()
+	a := &digestAuth{username: "Mufasa", password: "Circle of Life"}
+	for alg, want := range map[string]string{
+		"MD5":     "8ca523f5e9506fed4657c9700eebdbec",
+		"SHA-256": "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+	} {
+		sp := &digestSpace{
+			realm:     "http-auth@example.org",
+			nonce:     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+			algorithm: alg,
+			qop:       "auth",
+		}
+		got := a.response(sp, http.MethodGet, "/dir/index.html", "00000001",
+			"f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ")
+		if got != want {
+			t.Errorf("%s response = %s, want %s", alg, got, want)
+		}
+	}
+}
+
+// TestDigestAuthDownload: the server verifies every part's digest, each with
+// its own nonce count, after a single challenge.
+func TestDigestAuthDownload(t *testing.T) {
+	t.Parallel()
+	data := testData(256 << 10)
+	var st stats
+	var refused atomic.Int32
+	var mu sync.Mutex
+	seen := make(map[string]bool) // nonce counts
+	server := &digestAuth{username: "bob", password: "hunter2"}
+	inner := rangeHandler(data, `"v1"`, &st)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ch, ok := findChallenge([]string{r.Header.Get("Authorization")}, "digest")
+		sp := &digestSpace{realm: "files", nonce: "n-1", opaque: "op", algorithm: "SHA-256", qop: "auth"}
+		p := ch.params
+		if !ok || p["username"] != "bob" || p["nonce"] != sp.nonce || p["opaque"] != "op" ||
+			p["uri"] != r.URL.RequestURI() ||
+			p["response"] != server.response(sp, r.Method, p["uri"], p["nc"], p["cnonce"]) {
+			refused.Add(1)
+			w.Header().Add("WWW-Authenticate", `Basic realm="files"`)
+			w.Header().Add("WWW-Authenticate",
+				`Digest realm="files", nonce="n-1", opaque="op", qop="auth,auth-int", algorithm=MD5, `+
+					`Digest realm="files", nonce="n-1", opaque="op", qop="auth,auth-int", algorithm=SHA-256`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		replayed := seen[p["nc"]]
+		seen[p["nc"]] = true
+		mu.Unlock()
+		if replayed {
+			t.Errorf("nonce count %s reused", p["nc"])
+		}
+		inner.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	d := newDL(t, &Options{
+		Parts: 4, MinParts: 4, MinPartSize: 16 << 10,
+		Authenticator: NewDigestAuth("bob", "hunter2"),
+	})
+	_, got := mustGet(t, d, srv.URL+"/file.bin?v=1", filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	if n := refused.Load(); n != 1 {
+		t.Errorf("server refused %d requests, want only the first", n)
+	}
+}
+
+func TestParseChallenges(t *testing.T) {
+	t.Parallel()
+	got := parseChallenges([]string{
+		`Bearer realm="https://auth.example/token",service="registry.example",scope="repository:a/b:pull,push"`,
+		`Basic realm="x", Digest realm="say \"hi\"", nonce=abc, qop="auth, auth-int"`,
+		`Negotiate`,
+	})
+	want := []authChallenge{
+		{"bearer", map[string]string{
+			"realm": "https://auth.example/token", "service": "registry.example", "scope": "repository:a/b:pull,push",
+		}},
+		{"basic", map[string]string{"realm": "x"}},
+		{"digest", map[string]string{"realm": `say "hi"`, "nonce": "abc", "qop": "auth, auth-int"}},
+		{"negotiate", map[string]string{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseChallenges =\n%v\nwant\n%v", got, want)
+	}
+}
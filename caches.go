@@ -0,0 +1,52 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// checkCaches validates Options.Caches.
+func checkCaches(caches []string) error {
+	for _, c := range caches {
+		u, err := url.Parse(c)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid Caches entry %q: want an http(s) base URL", c)
+		}
+	}
+	return nil
+}
+
+// getCached tries each of Options.Caches for rq's SHA-256 in turn,
+// returning the first verified download, else the last failure. source is
+// the origin's: it keeps scoping credentials (a cache on an unrelated host
+// gets none) and binds resume state. nameURL names the file.
+//
+// A mismatching copy is discarded so the next source starts clean.
+func (d *Downloader) getCached(ctx context.Context, rq *resolvedRequest, source *url.URL, nameURL string) (*Result, error) {
+	crq := *rq
+	crq.method, crq.body, crq.bodyLen = http.MethodGet, nil, 0
+	var err error
+	for _, base := range d.opt.Caches {
+		cacheURL := strings.TrimSuffix(base, "/") + "/sha256/" + rq.sha256
+		var res *Result
+		res, err = d.fetch(ctx, &crq, source, cacheURL, nameURL)
+		if err == nil {
+			res.Cache = base
+			return res, nil
+		}
+		if ctx.Err() != nil || errors.Is(err, ErrDestExists) {
+			return nil, err
+		}
+		rq.log.Debug("cache miss", "cache", redactURL(base), "err", err)
+		if ce, ok := errors.AsType[*ChecksumError](err); ok {
+			if derr := Discard(ctx, strings.TrimSuffix(ce.Path, ".part")); derr != nil {
+				rq.log.Debug("discarding cache copy failed", "path", ce.Path, "err", derr)
+			}
+		}
+	}
+	return nil, err
+}
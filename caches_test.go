@@ -0,0 +1,103 @@
+package download
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// casServer serves data at /sha256/<sum> only.
+func casServer(t *testing.T, sum string, data []byte, st *stats) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle("/sha256/"+sum, rangeHandler(data, `"cas"`, st))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// TestCachesHit: a cache holding the digest serves every part; the origin
+// is never asked, and the file keeps the origin's name.
+func TestCachesHit(t *testing.T) {
+	t.Parallel()
+	data := testData(256 << 10)
+	sum := strings.TrimPrefix(sha256Digest(data), "sha256:")
+	var st stats
+	cache := casServer(t, sum, data, &st)
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(origin.Close)
+
+	d := newDL(t, &Options{
+		Parts: 4, MinParts: 4, MinPartSize: 16 << 10,
+		Caches: []string{cache.URL + "/"},
+	})
+	dir := t.TempDir()
+	res, err := d.Do(t.Context(), &Request{URL: origin.URL + "/file.bin", Dest: dir, ExpectedSHA256: sum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "file.bin"); res.Path != want {
+		t.Errorf("Path = %q, want %q", res.Path, want)
+	}
+	assertFile(t, res.Path, data)
+	if res.Cache != cache.URL+"/" || res.SHA256 != sum {
+		t.Errorf("Cache, SHA256 = %q, %q; want the cache and a verified digest", res.Cache, res.SHA256)
+	}
+	if n := len(st.rangeHeaders()); n < 4 {
+		t.Errorf("cache served %d requests, want every part", n)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("origin saw %d requests, want none", n)
+	}
+}
+
+// TestCachesFallBack: a miss and a corrupt copy lead to the origin, leaving
+// no staged bytes of the bad copy behind.
+func TestCachesFallBack(t *testing.T) {
+	t.Parallel()
+	data := testData(128 << 10)
+	sum := strings.TrimPrefix(sha256Digest(data), "sha256:")
+	corrupt := bytes.Clone(data)
+	corrupt[len(corrupt)/2] ^= 0xFF
+	var stMiss, stBad, stOrigin stats
+	miss := casServer(t, strings.Repeat("0", 64), data, &stMiss)
+	bad := casServer(t, sum, corrupt, &stBad)
+	origin := httptest.NewServer(rangeHandler(data, `"v1"`, &stOrigin))
+	t.Cleanup(origin.Close)
+
+	d := newDL(t, &Options{Parts: 2, MinPartSize: 16 << 10, Caches: []string{miss.URL, bad.URL}})
+	dest := filepath.Join(t.TempDir(), "file.bin")
+	res, err := d.Do(t.Context(), &Request{URL: origin.URL + "/file.bin", Dest: dest, ExpectedSHA256: sum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, dest, data)
+	assertClean(t, dest)
+	if res.Cache != "" || res.Resumed {
+		t.Errorf("Cache = %q, Resumed = %v; want a fresh origin download", res.Cache, res.Resumed)
+	}
+	if len(stBad.rangeHeaders()) == 0 || len(stOrigin.rangeHeaders()) == 0 {
+		t.Error("want the corrupt cache tried before the origin")
+	}
+
+	// Without a known digest there is nothing to look up.
+	_, got := mustGet(t, d, origin.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	if n := len(stMiss.rangeHeaders()); n != 0 {
+		t.Errorf("cache consulted %d times without a digest", n)
+	}
+
+	if _, err := New(&Options{Caches: []string{"cache.lan"}}); err == nil {
+		t.Error("New accepted a cache without a scheme")
+	}
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"io"
 	"sync"
 	"time"
 
@@ -28,9 +29,10 @@ type mpbReporter struct {
 	sum     int64
 }
 
-func newMpbReporter() *mpbReporter {
+func newMpbReporter(out io.Writer) *mpbReporter {
 	return &mpbReporter{
 		p: mpb.New(
+			mpb.WithOutput(out),
 			mpb.WithWidth(64),
 			mpb.WithRefreshRate(200*time.Millisecond),
 		),
@@ -22,14 +22,17 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -45,28 +48,87 @@ var log = charmlog.NewWithOptions(os.Stderr, charmlog.Options{
 })
 
 var flags struct {
-	output   string
-	parts    int
-	timeout  time.Duration
-	retries  int
-	headers  []string
-	sha256   string
-	force    bool
-	quiet    bool
-	insecure bool
-	verbose  bool
+	output      string
+	parts       int
+	timeout     time.Duration
+	retries     int
+	headers     []string
+	resolve     []string
+	connectTo   []string
+	socket      string
+	http2       bool
+	pins        []string
+	netrc       bool
+	netrcFile   string
+	maxRedirs   int
+	noDowngrade bool
+	rewrite     []string
+	caches      []string
+	cacheDir    string
+	cacheMax    int64
+	sha256      string
+	seed        string
+	extract     string
+	decompress  string
+	remoteTime  bool
+	chmod       string
+	onExists    string
+	skipValid   bool
+	force       bool
+	quiet       bool
+	insecure    bool
+	verbose     bool
 }
 
 func init() {
 	rootCmd.Flags().StringVarP(&flags.output, "output", "o", "",
-		"output file or directory (default: derived from URL)")
+		"output file or directory, or - for stdout (default: derived from URL)")
 	rootCmd.Flags().IntVarP(&flags.parts, "parts", "p", 8, "number of parallel connections")
 	rootCmd.Flags().DurationVar(&flags.timeout, "timeout", 0, "per-read stall timeout (default 15s)")
 	rootCmd.Flags().IntVar(&flags.retries, "retries", 0, "per-chunk retry budget (default 10)")
 	rootCmd.Flags().StringArrayVarP(&flags.headers, "header", "H", nil,
 		"extra header, 'Key: Value' (repeatable)")
+	rootCmd.Flags().StringArrayVar(&flags.resolve, "resolve", nil,
+		"connect to host:port at these addresses, 'host:port:addr[,addr]...' (repeatable)")
+	rootCmd.Flags().StringArrayVar(&flags.connectTo, "connect-to", nil,
+		"connect to host2:port2 instead of host1:port1, 'host1:port1:host2:port2' (repeatable)")
+	rootCmd.Flags().StringVar(&flags.socket, "unix-socket", "",
+		"connect through this Unix domain socket instead of TCP")
+	rootCmd.Flags().BoolVar(&flags.http2, "http2", false,
+		"negotiate HTTP/2 over TLS, one connection per part")
+	rootCmd.Flags().StringArrayVar(&flags.pins, "pinned-pubkey", nil,
+		"require this public key, 'sha256//base64' (repeatable; ';'-separated like curl)")
+	rootCmd.Flags().BoolVarP(&flags.netrc, "netrc", "n", false,
+		"send credentials from ~/.netrc (or $NETRC) to the hosts it lists")
+	rootCmd.Flags().StringVar(&flags.netrcFile, "netrc-file", "",
+		"like --netrc, reading this file")
+	rootCmd.Flags().IntVar(&flags.maxRedirs, "max-redirs", 0,
+		"follow at most this many redirects, -1 for none (default 10)")
+	rootCmd.Flags().BoolVar(&flags.noDowngrade, "no-downgrade", false,
+		"refuse redirects from https to http")
+	rootCmd.Flags().StringArrayVar(&flags.rewrite, "rewrite", nil,
+		"fetch URLs starting with FROM from TO instead, falling back to FROM on failure, 'FROM=TO' (repeatable)")
 	rootCmd.Flags().StringVar(&flags.sha256, "sha256", "",
 		"expected sha256 (hex); verified before rename")
+	rootCmd.Flags().StringArrayVar(&flags.caches, "cache", nil,
+		"with --sha256, try this content-addressed store first, <URL>/sha256/<hex> (repeatable)")
+	rootCmd.Flags().StringVar(&flags.cacheDir, "cache-dir", "",
+		"keep finished downloads in this local store and reuse them without refetching")
+	rootCmd.Flags().Int64Var(&flags.cacheMax, "cache-max-bytes", 0,
+		"evict least recently used --cache-dir entries beyond this size (default no cap)")
+	rootCmd.Flags().StringVar(&flags.seed, "seed", "",
+		"reuse the bytes this file (a partial or complete copy, or the destination itself) shares with the download")
+	rootCmd.Flags().StringVar(&flags.extract, "extract", "",
+		"unpack the downloaded tar, tar.gz, tar.bz2, or zip archive into this new directory instead of keeping it")
+	rootCmd.Flags().StringVar(&flags.decompress, "decompress", "",
+		"save a compressed download decompressed: auto, gzip, bzip2, or none")
+	rootCmd.Flags().BoolVarP(&flags.remoteTime, "remote-time", "R", false,
+		"keep the server's Last-Modified as the file's mtime, and its URL, ETag, and type in xattrs")
+	rootCmd.Flags().StringVar(&flags.chmod, "chmod", "", "permission bits of the saved file, in octal (e.g. 755)")
+	rootCmd.Flags().StringVar(&flags.onExists, "on-exists", "",
+		"when the file named after the download exists: fail, overwrite, skip, or rename (keep both)")
+	rootCmd.Flags().BoolVar(&flags.skipValid, "skip-valid", false,
+		"do nothing when the destination already matches --sha256 (or the server's size and -R's recorded validator)")
 	rootCmd.Flags().BoolVarP(&flags.force, "force", "f", false, "overwrite existing destination")
 	rootCmd.Flags().BoolVarP(&flags.quiet, "quiet", "q", false, "no progress output")
 	rootCmd.Flags().BoolVar(&flags.insecure, "insecure", false, "skip TLS certificate verification")
@@ -88,21 +150,63 @@ var rootCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		resolve, err := parseResolve(flags.resolve)
+		if err != nil {
+			return err
+		}
+		connectTo, err := parseConnectTo(flags.connectTo)
+		if err != nil {
+			return err
+		}
+		pins, err := parsePins(flags.pins)
+		if err != nil {
+			return err
+		}
+		rewrite, err := parseRewrite(flags.rewrite)
+		if err != nil {
+			return err
+		}
+		var mode uint64
+		if flags.chmod != "" {
+			if mode, err = strconv.ParseUint(flags.chmod, 8, 32); err != nil || mode > 0o777 {
+				return fmt.Errorf("invalid --chmod %q: want octal permission bits such as 755", flags.chmod)
+			}
+		}
 
 		opt := &download.Options{
 			Parts:          flags.parts,
 			Timeout:        flags.timeout,
 			MaxRetries:     flags.retries,
 			Headers:        headers,
+			Resolve:        resolve,
+			ConnectTo:      connectTo,
+			UnixSocket:     flags.socket,
+			HTTP2:          flags.http2,
+			PinnedSPKI:     pins,
+			Netrc:          flags.netrc,
+			NetrcFile:      flags.netrcFile,
+			Rewrite:        rewrite,
 			ExpectedSHA256: flags.sha256,
+			Caches:         flags.caches,
+			CacheDir:       flags.cacheDir,
+			CacheMaxBytes:  flags.cacheMax,
 			Overwrite:      flags.force,
 			Logger:         slog.New(log),
 		}
+		opt.Redirects = download.RedirectPolicy{MaxHops: flags.maxRedirs, NoDowngrade: flags.noDowngrade}
+		opt.PreserveMetadata, opt.FileMode = flags.remoteTime, os.FileMode(mode)
+		opt.OnExists, opt.SkipValid = flags.onExists, flags.skipValid
 		if flags.insecure {
 			opt.TLSConfig = &tls.Config{InsecureSkipVerify: true} // #nosec G402 -- user opted in
 		}
+		toStdout := flags.output == "-"
 		if !flags.quiet {
-			opt.Reporter = newMpbReporter()
+			// Progress shares the terminal with the stream's consumer.
+			progress := os.Stdout
+			if toStdout {
+				progress = os.Stderr
+			}
+			opt.Reporter = newMpbReporter(progress)
 		}
 
 		dl, err := download.New(opt)
@@ -113,17 +217,28 @@ var rootCmd = &cobra.Command{
 		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 		defer stop()
 
-		res, err := dl.Get(ctx, args[0], flags.output)
+		req := &download.Request{URL: args[0], Dest: flags.output, Seed: flags.seed, Decompress: flags.decompress}
+		if flags.extract != "" {
+			req.Extract = &download.Extract{Dir: flags.extract}
+		}
+		if toStdout {
+			req.Dest, req.Writer = "", os.Stdout
+		}
+		res, err := dl.Do(ctx, req)
 		if err != nil {
 			if errors.Is(err, context.Canceled) {
 				log.Warn("interrupted — rerun the same command to resume")
 			}
 			return err
 		}
+		if res.Skipped {
+			log.Info("exists, skipped", "path", res.Path)
+			return nil
+		}
 
 		speed := float64(res.Size) / max(res.Elapsed.Seconds(), 0.001) / (1 << 20)
 		summary := []any{
-			"path", res.Path,
+			"path", cmp.Or(res.Extracted, res.Path, "-"),
 			"size", fmt.Sprintf("%.1f MiB", float64(res.Size)/(1<<20)),
 			"elapsed", res.Elapsed.Round(time.Millisecond),
 			"speed", fmt.Sprintf("%.1f MiB/s", speed),
@@ -131,14 +246,41 @@ var rootCmd = &cobra.Command{
 		if res.Resumed {
 			summary = append(summary, "resumed", true)
 		}
+		if res.Seeded > 0 {
+			summary = append(summary, "seeded", fmt.Sprintf("%.1f MiB", float64(res.Seeded)/(1<<20)))
+		}
+		for i, hop := range res.Redirects {
+			log.Debug("redirect", "hop", i+1, "url", hop)
+		}
 		if res.SHA256 != "" {
 			summary = append(summary, "sha256", "verified")
 		}
+		if res.Decompressed != "" {
+			summary = append(summary, "decompressed", res.Decompressed)
+		}
+		if res.Cache != "" {
+			summary = append(summary, "cache", res.Cache)
+		}
+		if res.Materialized != "" {
+			summary = append(summary, "cache-dir", res.Materialized)
+		}
 		log.Info("downloaded", summary...)
 		return nil
 	},
 }
 
+func parseRewrite(raw []string) ([]download.RewriteRule, error) {
+	var rules []download.RewriteRule
+	for _, kv := range raw {
+		from, to, ok := strings.Cut(kv, "=")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid --rewrite %q: want 'FROM=TO'", kv)
+		}
+		rules = append(rules, download.RewriteRule{Prefix: from, Replace: to, Fallback: true})
+	}
+	return rules, nil
+}
+
 func parseHeaders(raw []string) (http.Header, error) {
 	if len(raw) == 0 {
 		return nil, nil
@@ -154,6 +296,70 @@ func parseHeaders(raw []string) (http.Header, error) {
 	return h, nil
 }
 
+// parseResolve converts curl-style --resolve entries into
+// Options.Resolve. IPv6 hosts and addresses are bracketed.
+func parseResolve(raw []string) (map[string][]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	m := make(map[string][]string, len(raw))
+	for _, entry := range raw {
+		host, rest, ok := cutHost(entry)
+		port, addrs, ok2 := strings.Cut(rest, ":")
+		if !ok || !ok2 || addrs == "" {
+			return nil, fmt.Errorf("invalid --resolve %q: want 'host:port:addr[,addr]...'", entry)
+		}
+		key := net.JoinHostPort(host, port)
+		m[key] = append(m[key], strings.Split(addrs, ",")...)
+	}
+	return m, nil
+}
+
+// parseConnectTo converts curl-style --connect-to entries into
+// Options.ConnectTo. Any of the four fields may be empty.
+func parseConnectTo(raw []string) (map[string]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string, len(raw))
+	for _, entry := range raw {
+		host1, rest, ok := cutHost(entry)
+		port1, rest, ok2 := strings.Cut(rest, ":")
+		host2, port2, ok3 := cutHost(rest)
+		if !ok || !ok2 || !ok3 || strings.Contains(port2, ":") {
+			return nil, fmt.Errorf("invalid --connect-to %q: want 'host1:port1:host2:port2'", entry)
+		}
+		m[net.JoinHostPort(host1, port1)] = net.JoinHostPort(host2, port2)
+	}
+	return m, nil
+}
+
+// parsePins converts curl-style --pinned-pubkey hashes into
+// Options.PinnedSPKI. curl also takes a key file; only hashes are accepted.
+func parsePins(raw []string) ([]string, error) {
+	var pins []string
+	for _, entry := range raw {
+		for pin := range strings.SplitSeq(entry, ";") {
+			b64, ok := strings.CutPrefix(strings.TrimSpace(pin), "sha256//")
+			if !ok {
+				return nil, fmt.Errorf("invalid --pinned-pubkey %q: want 'sha256//base64'", pin)
+			}
+			pins = append(pins, b64)
+		}
+	}
+	return pins, nil
+}
+
+// cutHost splits a leading host, bracketed when it is an IPv6 literal, from
+// the ':'-separated rest.
+func cutHost(s string) (host, rest string, ok bool) {
+	if v6, after, found := strings.Cut(s, "]"); found && strings.HasPrefix(v6, "[") {
+		rest, ok = strings.CutPrefix(after, ":")
+		return v6[1:], rest, ok
+	}
+	return strings.Cut(s, ":")
+}
+
 // Execute runs the root command. Called once from main.
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
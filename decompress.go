@@ -0,0 +1,147 @@
+package download
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+var decompressModes = []string{"auto", "gzip", "bzip2", "none"}
+
+// codecFor returns the decoding mode calls for, given the response header
+// and the resource's file name: "gzip", "bzip2", or "".
+func codecFor(mode string, header http.Header, name string) string {
+	switch mode {
+	case "gzip", "bzip2":
+		return mode
+	case "auto":
+		if strings.EqualFold(strings.TrimSpace(header.Get("Content-Encoding")), "gzip") {
+			return "gzip"
+		}
+		switch strings.ToLower(path.Ext(name)) {
+		case ".gz":
+			return "gzip"
+		case ".bz2":
+			return "bzip2"
+		}
+	}
+	return ""
+}
+
+// acceptsGzip reports whether requests for rawURL in mode ask for the gzip
+// encoding. "auto" does only for a URL naming a compressed file: a plain
+// file a server gzips on the fly would otherwise be checked against
+// ExpectedSHA256 as gzip bytes.
+func acceptsGzip(mode, rawURL string) bool {
+	switch mode {
+	case "gzip":
+		return true
+	case "auto":
+		u, err := parseURL(rawURL)
+		return err == nil && codecFor(mode, nil, u.Path) != ""
+	}
+	return false
+}
+
+// decompressedName strips the suffix codec's files carry from name.
+func decompressedName(name, codec string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if (codec == "gzip" && ext == ".gz") || (codec == "bzip2" && ext == ".bz2") {
+		if trimmed := name[:len(name)-len(ext)]; trimmed != "" && !strings.HasSuffix(trimmed, "/") {
+			return trimmed
+		}
+	}
+	return name
+}
+
+// decompression writes the decoded download to out, the file installed in
+// its place.
+type decompression struct {
+	stage // a streaming pass, when started
+
+	codec   string
+	out     string
+	part    string // the staged download, for ChecksumError
+	want256 string
+	sum256  string // set when want256 is
+	buf     []byte
+}
+
+// stream decompresses the multipart download in f as it is written.
+func (z *decompression) stream(f *os.File, avail func() int64, total int64) {
+	z.start(f, avail, total, func(br *bufio.Reader) error { return z.decode(br) })
+}
+
+func (z *decompression) decode(src io.Reader) error {
+	var r io.Reader
+	switch z.codec {
+	case "gzip":
+		zr, err := gzip.NewReader(src)
+		if err != nil {
+			return fmt.Errorf("decompress gzip: %w", err)
+		}
+		r = zr
+	case "bzip2":
+		r = bzip2.NewReader(src)
+	}
+	out, err := os.OpenFile(z.out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	var w io.Writer = out
+	var h hash.Hash
+	if z.want256 != "" {
+		h = sha256.New()
+		w = io.MultiWriter(out, h)
+	}
+	if _, err := io.CopyBuffer(w, r, z.buf); err != nil {
+		return fmt.Errorf("decompress %s: %w", z.codec, err)
+	}
+	if h != nil {
+		z.sum256 = hex.EncodeToString(h.Sum(nil))
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// finish decompresses the verified download f, unless a streaming pass
+// already did, and verifies the result.
+func (z *decompression) finish(f *os.File) error {
+	if z.started() {
+		if err := z.wait(); err != nil {
+			return err
+		}
+	} else {
+		fi, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", f.Name(), err)
+		}
+		if err := z.decode(io.NewSectionReader(f, 0, fi.Size())); err != nil {
+			return err
+		}
+	}
+	if z.want256 != "" && z.sum256 != z.want256 {
+		return fmt.Errorf("decompressed: %w", &ChecksumError{Algo: "sha256",
+			Expected: z.want256, Actual: z.sum256, Path: z.part})
+	}
+	return nil
+}
+
+// abort stops a streaming pass and removes out; after install there is
+// nothing left to remove.
+func (z *decompression) abort() {
+	z.cancel()
+	_ = os.Remove(z.out)
+}
@@ -0,0 +1,172 @@
+package download
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestDecompressGzipFile: a .gz resource is fetched in parts, checked as
+// compressed and as decompressed bytes, and installed decompressed under
+// its name without the suffix.
+func TestDecompressGzipFile(t *testing.T) {
+	t.Parallel()
+	plain := bytes.Repeat(testData(64<<10), 8)
+	gz := gzipBytes(t, plain)
+	var st stats
+	srv := httptest.NewServer(rangeHandler(gz, `"v1"`, &st))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{Parts: 4, MinPartSize: 4 << 10})
+	dir := t.TempDir()
+
+	res, err := d.Do(t.Context(), &Request{URL: srv.URL + "/sym.pdb.gz", Dest: dir, Decompress: "auto",
+		ExpectedSHA256:             strings.TrimPrefix(sha256Digest(gz), "sha256:"),
+		ExpectedDecompressedSHA256: strings.TrimPrefix(sha256Digest(plain), "sha256:"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "sym.pdb"); res.Path != want {
+		t.Errorf("Path = %q, want %q", res.Path, want)
+	}
+	assertFile(t, res.Path, plain)
+	assertOnly(t, dir, "sym.pdb")
+	if res.Decompressed != "gzip" || res.SHA256 == "" || res.DecompressedSHA256 == "" || res.Size != int64(len(gz)) {
+		t.Errorf("Decompressed, SHA256, DecompressedSHA256, Size = %q, %q, %q, %d",
+			res.Decompressed, res.SHA256, res.DecompressedSHA256, res.Size)
+	}
+}
+
+// TestDecompressContentEncoding: "auto" decodes a Content-Encoding: gzip
+// response, in parts or as a single stream.
+func TestDecompressContentEncoding(t *testing.T) {
+	t.Parallel()
+	plain := testData(200 << 10)
+	gz := gzipBytes(t, plain)
+	var st stats
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			writeBareRange(w, r, plain, `"identity"`)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		if r.URL.Path == "/single" {
+			_, _ = w.Write(gz) // no length, no ranges
+			return
+		}
+		rangeHandler(gz, `"gzip"`, &st).ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{Parts: 4, MinPartSize: 4 << 10})
+	dir := t.TempDir()
+
+	for _, path := range []string{"/parts", "/single"} {
+		dest := filepath.Join(dir, path[1:]+".bin")
+		res, err := d.Do(t.Context(), &Request{URL: srv.URL + path, Dest: dest, Decompress: "auto",
+			Headers: http.Header{"Accept-Encoding": {"gzip"}}})
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		assertFile(t, dest, plain)
+		if res.Decompressed != "gzip" {
+			t.Errorf("%s: Decompressed = %q", path, res.Decompressed)
+		}
+	}
+	assertOnly(t, dir, "parts.bin", "single.bin")
+}
+
+// TestDecompressAutoPlainChecksum: "auto" does not ask for gzip for a plain
+// file, so a server compressing on request still serves the bytes the
+// caller's checksum was computed from.
+func TestDecompressAutoPlainChecksum(t *testing.T) {
+	t.Parallel()
+	plain := testData(200 << 10)
+	gz := gzipBytes(t, plain)
+	var st stats
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			rangeHandler(gz, `"gzip"`, &st).ServeHTTP(w, r)
+			return
+		}
+		writeBareRange(w, r, plain, `"identity"`)
+	}))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{Parts: 4, MinPartSize: 4 << 10})
+	dest := filepath.Join(t.TempDir(), "data.bin")
+
+	res, err := d.Do(t.Context(), &Request{URL: srv.URL + "/data.bin", Dest: dest, Decompress: "auto",
+		ExpectedSHA256: strings.TrimPrefix(sha256Digest(plain), "sha256:")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, dest, plain)
+	if res.Decompressed != "" {
+		t.Errorf("Decompressed = %q, want the file as served", res.Decompressed)
+	}
+}
+
+// TestDecompressBzip2Mismatch: a bzip2 file decompressing to other bytes
+// than expected is a ChecksumError and installs nothing.
+func TestDecompressBzip2Mismatch(t *testing.T) {
+	t.Parallel()
+	// bzip2 of "hello, bzip2 world\n" (the standard library cannot write it).
+	bz := []byte("\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\x5a\xdf\x2a\x77\x00\x00\x04\x59\x80\x00\x10\x40\x04" +
+		"\x10\x00\x16\x64\xd0\x90\x20\x00\x31\x4c\x00\x01\x4c\x98\x47\xa2\x7a\x3f\x18\x54\x50\xe9\xfd\xbe\x89" +
+		"\x1e\x38\x2e\xe4\x8a\x70\xa1\x20\xb5\xbe\x54\xee")
+	var st stats
+	srv := httptest.NewServer(rangeHandler(bz, `"v1"`, &st))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{})
+	dir := t.TempDir()
+
+	res, err := d.Do(t.Context(), &Request{URL: srv.URL + "/hello.txt.bz2", Dest: dir, Decompress: "bzip2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(dir, "hello.txt"), []byte("hello, bzip2 world\n"))
+	if res.Decompressed != "bzip2" {
+		t.Errorf("Decompressed = %q", res.Decompressed)
+	}
+
+	dest := filepath.Join(dir, "other.txt")
+	_, err = d.Do(t.Context(), &Request{URL: srv.URL + "/hello.txt.bz2", Dest: dest, Decompress: "auto",
+		ExpectedDecompressedSHA256: strings.Repeat("0", 64)})
+	if _, ok := errors.AsType[*ChecksumError](err); !ok {
+		t.Fatalf("err = %v, want a ChecksumError", err)
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		t.Error("mismatched file installed")
+	}
+	if _, err := os.Lstat(dest + ".decoded"); err == nil {
+		t.Error("decoded staging file left behind")
+	}
+
+	for _, req := range []*Request{
+		{URL: srv.URL, Dest: dest, Decompress: "xz"},
+		{URL: srv.URL, Dest: dest, Decompress: "gzip", Extract: &Extract{Dir: dir}},
+	} {
+		if _, err := d.Do(t.Context(), req); err == nil || !strings.Contains(err.Error(), "Decompress") {
+			t.Errorf("Decompress %q: err = %v", req.Decompress, err)
+		}
+	}
+}
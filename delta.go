@@ -0,0 +1,311 @@
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Delta describes a zsync-style delta download: the blocks of the target
+// that a local seed file already holds (such as the previous build) are
+// copied from it, and only the rest is fetched, as ranged parts. The result
+// is verified and installed like any other download.
+type Delta struct {
+	// Control is the target's zsync control file (as written by
+	// zsyncmake), an http(s) URL or a local path. Its Length must match
+	// the resource; its SHA-1, when present, verifies the result.
+	Control string
+	// Seed is the local file to reuse blocks from. A missing seed means a
+	// full download.
+	Seed string
+}
+
+// maxControlSize bounds a fetched control file: 7 bytes per 2 KiB block
+// describe a 64 GiB target in about 224 MiB.
+const maxControlSize = 256 << 20
+
+// zsyncControl is a parsed zsync control file.
+type zsyncControl struct {
+	blockSize  int
+	length     int64
+	seqMatches int // consecutive blocks that must match (1 or 2)
+	rsumBytes  int // stored bytes of each block's rolling checksum
+	sumBytes   int // stored bytes of each block's MD4
+	sha1       string
+	blocks     []zsyncBlock
+}
+
+type zsyncBlock struct {
+	rsum   uint32 // masked to rsumBytes
+	strong [16]byte
+}
+
+// parseZsyncControl reads a control file: "Key: value" header lines, a
+// blank line, then per block the trailing rsumBytes of its big-endian
+// rolling checksum and the leading sumBytes of its MD4.
+func parseZsyncControl(r io.Reader) (*zsyncControl, error) {
+	br := bufio.NewReader(r)
+	c := &zsyncControl{}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("zsync control: truncated header: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("zsync control: malformed header line %q", line)
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Blocksize":
+			c.blockSize, err = strconv.Atoi(value)
+		case "Length":
+			c.length, err = strconv.ParseInt(value, 10, 64)
+		case "Hash-Lengths":
+			_, err = fmt.Sscanf(value, "%d,%d,%d", &c.seqMatches, &c.rsumBytes, &c.sumBytes)
+		case "SHA-1":
+			c.sha1, err = normalizeChecksum(value, sha1HexLen, "zsync SHA-1")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("zsync control: %s: %w", key, err)
+		}
+	}
+	switch {
+	case c.blockSize < 16 || c.blockSize&(c.blockSize-1) != 0:
+		return nil, fmt.Errorf("zsync control: Blocksize %d is not a power of two >= 16", c.blockSize)
+	case c.length < 0:
+		return nil, fmt.Errorf("zsync control: invalid Length %d", c.length)
+	case c.seqMatches < 1 || c.seqMatches > 2 || c.rsumBytes < 1 || c.rsumBytes > 4 ||
+		c.sumBytes < 3 || c.sumBytes > 16:
+		return nil, fmt.Errorf("zsync control: unsupported Hash-Lengths %d,%d,%d",
+			c.seqMatches, c.rsumBytes, c.sumBytes)
+	}
+	n := (c.length + int64(c.blockSize) - 1) / int64(c.blockSize)
+	if n*int64(c.rsumBytes+c.sumBytes) > maxControlSize {
+		return nil, fmt.Errorf("zsync control: %d blocks exceed the size limit", n)
+	}
+	c.blocks = make([]zsyncBlock, n)
+	rec := make([]byte, c.rsumBytes+c.sumBytes)
+	for i := range c.blocks {
+		if _, err := io.ReadFull(br, rec); err != nil {
+			return nil, fmt.Errorf("zsync control: block %d: %w", i, err)
+		}
+		var rs [4]byte
+		copy(rs[4-c.rsumBytes:], rec[:c.rsumBytes])
+		c.blocks[i].rsum = uint32(rs[0])<<24 | uint32(rs[1])<<16 | uint32(rs[2])<<8 | uint32(rs[3])
+		copy(c.blocks[i].strong[:], rec[c.rsumBytes:])
+	}
+	return c, nil
+}
+
+// rsumMask keeps the stored bytes of a rolling checksum.
+func (c *zsyncControl) rsumMask() uint32 {
+	return uint32(uint64(1)<<(8*c.rsumBytes) - 1)
+}
+
+// zsyncRsum is zsync's rolling checksum of a block: a is the byte sum and b
+// the sum weighted by distance from the block's end, both mod 2^16.
+func zsyncRsum(block []byte) (a, b uint16) {
+	n := len(block)
+	for i, x := range block {
+		a += uint16(x)
+		b += uint16(n-i) * uint16(x)
+	}
+	return a, b
+}
+
+// loadControl reads a Delta's control file from its URL or path.
+func (d *Downloader) loadControl(ctx context.Context, control string, headers http.Header) (*zsyncControl, error) {
+	u, err := url.Parse(control)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		f, err := os.Open(control)
+		if err != nil {
+			return nil, fmt.Errorf("open zsync control: %w", err)
+		}
+		defer f.Close()
+		return parseZsyncControl(f)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, control, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	d.applyHeaders(req, u, headers)
+	if err := d.prepare(req); err != nil {
+		return nil, err
+	}
+	resp, err := d.newClient(d.roundTripper(), u).Do(req)
+	if err != nil {
+		fillPinHost(err)
+		return nil, redactErr(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch zsync control: %w", StatusError(resp.StatusCode))
+	}
+	return parseZsyncControl(io.LimitReader(resp.Body, maxControlSize+64<<10))
+}
+
+// seedDelta fills part (preallocated to r.total) with the blocks r.zsync's
+// seed holds and schedules the rest, returning the bytes copied.
+func (r *run) seedDelta(part *os.File, sched *scheduler) (int64, error) {
+	c := r.zsync
+	if c.length != r.total {
+		return 0, fmt.Errorf("zsync control describes %d bytes, the resource has %d", c.length, r.total)
+	}
+	filled := make([]bool, len(c.blocks))
+	var seeded int64
+	seed, err := os.Open(r.seedPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		r.log.Debug("delta seed missing, fetching everything", "seed", r.seedPath)
+	case err != nil:
+		return 0, fmt.Errorf("open delta seed: %w", err)
+	default:
+		defer seed.Close()
+		if seeded, err = c.copyBlocks(seed, part, filled); err != nil {
+			return 0, err
+		}
+	}
+	bs := int64(c.blockSize)
+	for i := 0; i < len(filled); {
+		if filled[i] {
+			i++
+			continue
+		}
+		j := i
+		for j < len(filled) && !filled[j] {
+			j++
+		}
+		sched.addPending(int64(i)*bs, min(int64(j)*bs, c.length), 0)
+		i = j
+	}
+	r.log.Debug("delta seeded", "seed", r.seedPath, "bytes", seeded, "total", r.total)
+	return seeded, nil
+}
+
+// copyBlocks slides a block-sized window over seed and writes every target
+// block it matches into part, marking it in filled. It returns the bytes
+// written.
+func (c *zsyncControl) copyBlocks(seed, part *os.File, filled []bool) (int64, error) {
+	fi, err := seed.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat delta seed: %w", err)
+	}
+	index := make(map[uint32][]int, len(c.blocks))
+	for i, b := range c.blocks {
+		index[b.rsum] = append(index[b.rsum], i)
+	}
+	bs, mask := c.blockSize, c.rsumMask()
+	shift := bits.TrailingZeros(uint(bs))
+	need := bs*c.seqMatches + 1 // the matched context plus the byte rolled in
+	sr := &seedReader{f: seed, buf: make([]byte, 0, max(4<<20, 4*need))}
+	var copied int64
+	left := len(c.blocks)
+	win, err := sr.window(0, need)
+	if err != nil {
+		return 0, err
+	}
+	a, b := zsyncRsum(win[:bs])
+	for p := int64(0); p < fi.Size() && left > 0; {
+		if cands, ok := index[(uint32(a)<<16|uint32(b))&mask]; ok {
+			n, blocks, err := c.match(win, cands, part, filled)
+			if err != nil {
+				return copied, err
+			}
+			if blocks > 0 {
+				copied += n
+				left -= blocks
+				p += int64(bs)
+				if win, err = sr.window(p, need); err != nil {
+					return copied, err
+				}
+				a, b = zsyncRsum(win[:bs])
+				continue
+			}
+		}
+		out, in := uint16(win[0]), uint16(win[bs])
+		a += in - out
+		b += a - out<<shift
+		p++
+		if win, err = sr.window(p, need); err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// match checks win's leading block against the candidate target blocks by
+// MD4 (and, with seqMatches 2, the block after it too), copying it to every
+// unfilled block it matches. It returns the bytes and blocks written.
+func (c *zsyncControl) match(win []byte, cands []int, part *os.File, filled []bool) (n int64, blocks int, err error) {
+	bs := c.blockSize
+	strong := md4Sum(win[:bs])
+	var next *[16]byte
+	for _, i := range cands {
+		if filled[i] || !bytes.Equal(strong[:c.sumBytes], c.blocks[i].strong[:c.sumBytes]) {
+			continue
+		}
+		if c.seqMatches > 1 && i+1 < len(c.blocks) {
+			if next == nil {
+				sum := md4Sum(win[bs : 2*bs])
+				next = &sum
+			}
+			if !bytes.Equal(next[:c.sumBytes], c.blocks[i+1].strong[:c.sumBytes]) {
+				continue
+			}
+		}
+		off := int64(i) * int64(bs)
+		size := min(int64(bs), c.length-off)
+		if _, err := part.WriteAt(win[:size], off); err != nil {
+			return n, blocks, fmt.Errorf("write seeded block: %w", err)
+		}
+		filled[i] = true
+		n += size
+		blocks++
+	}
+	return n, blocks, nil
+}
+
+// seedReader serves windows of a seed file, zero-padded past its end as
+// zsync pads them.
+type seedReader struct {
+	f    *os.File
+	buf  []byte
+	base int64 // file offset of buf[0]
+	eof  bool
+}
+
+// window returns the n bytes at offset p, valid until the next call.
+// Offsets must not decrease between calls.
+func (s *seedReader) window(p int64, n int) ([]byte, error) {
+	for p+int64(n) > s.base+int64(len(s.buf)) {
+		if s.eof {
+			s.buf = append(s.buf, make([]byte, n)...)
+			continue
+		}
+		m := copy(s.buf[:cap(s.buf)], s.buf[p-s.base:])
+		s.base = p
+		k, err := io.ReadFull(s.f, s.buf[m:cap(s.buf)])
+		s.buf = s.buf[:m+k]
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			s.eof = true
+		} else if err != nil {
+			return nil, fmt.Errorf("read delta seed: %w", err)
+		}
+	}
+	off := p - s.base
+	return s.buf[off : off+int64(n)], nil
+}
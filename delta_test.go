@@ -0,0 +1,177 @@
+package download
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// zsyncMake writes a control file for data like zsyncmake does.
+func zsyncMake(data []byte, blockSize, seqMatches, rsumBytes, sumBytes int) []byte {
+	var buf bytes.Buffer
+	sum := sha1.Sum(data)
+	fmt.Fprintf(&buf, "zsync: 0.6.2\nFilename: file.bin\nBlocksize: %d\nLength: %d\nHash-Lengths: %d,%d,%d\nURL: file.bin\nSHA-1: %s\n\n",
+		blockSize, len(data), seqMatches, rsumBytes, sumBytes, hex.EncodeToString(sum[:]))
+	for off := 0; off < len(data); off += blockSize {
+		block := make([]byte, blockSize)
+		copy(block, data[off:])
+		a, b := zsyncRsum(block)
+		var rs [4]byte
+		binary.BigEndian.PutUint16(rs[:], a)
+		binary.BigEndian.PutUint16(rs[2:], b)
+		buf.Write(rs[4-rsumBytes:])
+		strong := md4Sum(block)
+		buf.Write(strong[:sumBytes])
+	}
+	return buf.Bytes()
+}
+
+// countingRanges serves data by range, adding the bytes of every part
+// response to served (not the initial open-ended one, which the download
+// abandons once it has its headers).
+func countingRanges(data []byte, served *atomic.Int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rng := r.Header.Get("Range")
+		if start, end, ok := parseFullRange(rng, int64(len(data))); ok && !strings.HasSuffix(rng, "-") {
+			served.Add(end - start + 1)
+		}
+		writeBareRange(w, r, data, `"v2"`)
+	})
+}
+
+// TestDeltaDownload: only the blocks an edit touched are fetched; shifted
+// content is still found in the seed.
+func TestDeltaDownload(t *testing.T) {
+	t.Parallel()
+	const bs = 1024
+	old := testData(512 << 10)
+	target := bytes.Clone(old[:100<<10])
+	target = append(target, "an insertion shifting everything after it"...)
+	target = append(target, old[100<<10:300<<10]...)
+	target = append(target, bytes.Repeat([]byte{0xEE}, 8<<10)...) // replaced bytes
+	target = append(target, old[308<<10:]...)
+
+	dir := t.TempDir()
+	seed := filepath.Join(dir, "old.bin")
+	control := filepath.Join(dir, "file.bin.zsync")
+	if err := os.WriteFile(seed, old, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(control, zsyncMake(target, bs, 2, 3, 5), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var served atomic.Int64
+	srv := httptest.NewServer(countingRanges(target, &served))
+	t.Cleanup(srv.Close)
+
+	d := newDL(t, &Options{Parts: 4, MinPartSize: 4 << 10})
+	dest := filepath.Join(dir, "file.bin")
+	res, err := d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: dest,
+		Delta: &Delta{Control: control, Seed: seed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, dest, target)
+	if res.SHA1 == "" {
+		t.Error("the control file's SHA-1 was not verified")
+	}
+	if n := served.Load(); n > int64(len(target))/8 {
+		t.Errorf("served %d of %d bytes, want only the changed blocks", n, len(target))
+	}
+	if res.Seeded < int64(len(target))*9/10 {
+		t.Errorf("Seeded = %d of %d bytes", res.Seeded, len(target))
+	}
+}
+
+// TestDeltaSeedCases: an identical seed needs no parts, a missing one
+// fetches everything, and a stale control file is refused.
+func TestDeltaSeedCases(t *testing.T) {
+	t.Parallel()
+	data := testData(96<<10 + 123) // a partial last block
+	dir := t.TempDir()
+	seed := filepath.Join(dir, "seed.bin")
+	control := filepath.Join(dir, "file.bin.zsync")
+	if err := os.WriteFile(seed, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(control, zsyncMake(data, 2048, 1, 4, 16), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var served atomic.Int64
+	srv := httptest.NewServer(countingRanges(data, &served))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{Parts: 2, MinPartSize: 4 << 10})
+
+	res, err := d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: filepath.Join(dir, "same.bin"),
+		Delta: &Delta{Control: control, Seed: seed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, res.Path, data)
+	if res.Seeded != int64(len(data)) {
+		t.Errorf("identical seed: Seeded = %d, want %d", res.Seeded, len(data))
+	}
+
+	res, err = d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: filepath.Join(dir, "fresh.bin"),
+		Delta: &Delta{Control: control, Seed: filepath.Join(dir, "missing.bin")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, res.Path, data)
+	if res.Seeded != 0 {
+		t.Errorf("missing seed: Seeded = %d, want 0", res.Seeded)
+	}
+
+	stale := filepath.Join(dir, "stale.zsync")
+	if err := os.WriteFile(stale, zsyncMake(data[:4096], 2048, 1, 4, 16), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: filepath.Join(dir, "stale.bin"),
+		Delta: &Delta{Control: stale, Seed: seed}})
+	if err == nil || !strings.Contains(err.Error(), "zsync control describes") {
+		t.Errorf("stale control: err = %v, want a length mismatch", err)
+	}
+}
+
+func TestParseZsyncControlRejects(t *testing.T) {
+	t.Parallel()
+	good := zsyncMake(testData(4096), 1024, 1, 4, 8)
+	for name, in := range map[string][]byte{
+		"truncated blocks": good[:len(good)-3],
+		"block size":       bytes.Replace(good, []byte("Blocksize: 1024"), []byte("Blocksize: 1000"), 1),
+		"hash lengths":     bytes.Replace(good, []byte("Hash-Lengths: 1,4,8"), []byte("Hash-Lengths: 3,4,8"), 1),
+		"no blank line":    []byte("zsync: 0.6.2\nBlocksize: 1024\n"),
+	} {
+		if _, err := parseZsyncControl(bytes.NewReader(in)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	c, err := parseZsyncControl(bytes.NewReader(good))
+	if err != nil || len(c.blocks) != 4 || c.sha1 == "" {
+		t.Fatalf("parse = %+v, %v", c, err)
+	}
+}
+
+func TestMD4(t *testing.T) {
+	t.Parallel()
+	// RFC 1320, appendix A.5.
+	for in, want := range map[string]string{
+		"":               "31d6cfe0d16ae931b73c59d7e0c089c0",
+		"abc":            "a448017aaf21d8525fc10ae87aa6729d",
+		"message digest": "d9130a8164549fe818874806e1c7014b",
+		"12345678901234567890123456789012345678901234567890123456789012345678901234567890": "e33b4ddc9c38f2199c3e7b164fcc0536",
+	} {
+		if sum := md4Sum([]byte(in)); hex.EncodeToString(sum[:]) != want {
+			t.Errorf("md4(%q) = %x, want %s", in, sum, want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package download
 
 import (
+	"cmp"
 	"context"
 	"crypto/sha1"
 	"crypto/sha256"
@@ -15,9 +16,11 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptrace"
+	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -71,11 +74,48 @@ type Options struct {
 	// Jar supplies cookies to every request (session auth). Nil means no
 	// cookie handling.
 	Jar http.CookieJar
+	// Authenticator answers 401 challenges (WWW-Authenticate) with
+	// credentials for a retry, and supplies them up front once it has
+	// them; see NewBearerAuth and NewDigestAuth. It is shared by every
+	// worker and consulted only for the download's host and its
+	// subdomains. A challenge it cannot answer fails the download with an
+	// *AuthError.
+	Authenticator Authenticator
+	// Netrc sends Basic credentials from a .netrc file: the entry for
+	// each request's host (or the file's default entry), unless the
+	// request already carries an Authorization header. The file is
+	// NetrcFile, else $NETRC, else ~/.netrc (%USERPROFILE%\_netrc on
+	// Windows), read once by New; a missing ~/.netrc just means no
+	// credentials. Redirect hops get their own host's entry, and only
+	// when that host is the download's host or one of its subdomains.
+	Netrc bool
+	// NetrcFile is the .netrc file Netrc reads; setting it implies Netrc.
+	NetrcFile string
+	// Redirects restricts the redirects every request may follow (hop
+	// count, downgrades, target hosts) and whether parts request the final
+	// URL or the original one. A refused redirect fails the download with
+	// a *RedirectError. The zero value follows up to 10 redirects to any
+	// target.
+	Redirects RedirectPolicy
+	// Rewrite rewrites the source URL and every redirect target before the
+	// request is sent (see RewriteRule), e.g. to route downloads through an
+	// internal cache. Resume state stays bound to the original source.
+	Rewrite []RewriteRule
+	// PrepareRequest, when set, is called with every outgoing download
+	// request once its headers are final — the initial request (Range:
+	// bytes=0-), each part attempt and retry (a closed Range, plus If-Range
+	// once a validator is known), and each single-stream restart (no
+	// Range) — so it can sign the exact request or attach a trace ID. It
+	// may be called concurrently. Redirect hops and token-service requests
+	// are not passed to it; credentials an Authenticator adds after a 401
+	// are applied on top. An error fails the download without a retry.
+	PrepareRequest func(*http.Request) error
 	// Transport overrides the internal HTTP/1.1 transport (this is the HTTP/3
 	// escape hatch: plug in a quic-go RoundTripper here). WARNING: an HTTP/2 transport defeats
 	// parallel parts — h2 multiplexes every range request onto a single
 	// TCP connection. For *http.Transport, force HTTP/1.1 (Protocols) and
-	// choose its connection and header buffer sizes for the workload.
+	// choose its connection and header buffer sizes for the workload; for
+	// h2-only origins, prefer the internal transport with HTTP2.
 	Transport http.RoundTripper
 	// TLSConfig is used by the internal transport. Ignored when Transport
 	// is set.
@@ -83,6 +123,51 @@ type Options struct {
 	// Proxy selects a proxy per request for the internal transport (nil means
 	// http.ProxyFromEnvironment). Ignored when Transport is set.
 	Proxy func(*http.Request) (*url.URL, error)
+	// LocalAddrs binds the internal transport's connections to these source
+	// addresses, e.g. one per NIC or uplink, for link aggregation without OS
+	// bonding. Workers are spread across the addresses round-robin and each
+	// address is ramped as its own capacity pool: a saturated path stops
+	// admitting on its own without holding back the others. Parts is shared
+	// among the paths and must be at least len(LocalAddrs). Empty means the
+	// system picks the source. Ignored when Transport is set.
+	LocalAddrs []netip.Addr
+	// Resolve pins host names to addresses for the internal transport, like
+	// curl --resolve: keys are "host:port" and values are IP addresses tried
+	// in order instead of DNS. Only the connection target changes; the Host
+	// header and TLS server name stay those of the URL, which makes it the
+	// tool for testing an origin before a DNS cutover. Behind a proxy the
+	// rules apply to the proxy connection. Ignored when Transport is set.
+	Resolve map[string][]string
+	// ConnectTo redirects connections like curl --connect-to: a key
+	// "host:port" maps to a target "host2:port2". Either part of a key may
+	// be empty to match any host or port (the most specific rule wins), and
+	// an empty target part keeps the original. Resolve applies to the
+	// rewritten target. Ignored when Transport is set.
+	ConnectTo map[string]string
+	// UnixSocket sends every internal transport connection to this Unix
+	// domain socket instead of TCP, like curl --unix-socket; URLs keep
+	// their scheme, host, and path. A single URL can instead name its socket
+	// as unix:///path/to.sock:/request/path, which is requested over plain
+	// HTTP with Host "localhost". Resolve, ConnectTo, and LocalAddrs do not
+	// apply to socket connections. Ignored when Transport is set.
+	UnixSocket string
+	// HTTP2 lets the internal transport negotiate HTTP/2 (HTTP/1.1 remains
+	// the fallback) for origins that only serve h2. Parallel parts stay
+	// parallel: each worker dials its own h2 connection from a private pool
+	// instead of multiplexing onto a shared one. Ignored when Transport is
+	// set.
+	HTTP2 bool
+	// PinnedSPKI restricts the internal transport's TLS peers to these
+	// public keys: each entry is the base64 (standard encoding) SHA-256 of
+	// a certificate's SubjectPublicKeyInfo, as printed by
+	// `openssl x509 -pubkey -noout | openssl pkey -pubin -outform der |
+	// openssl dgst -sha256 -binary | base64`. Every TLS connection — the
+	// initial request, each part, every redirect hop, and an HTTPS proxy's
+	// own connection — must present a verified chain containing a pinned
+	// key (with InsecureSkipVerify, the leaf itself must be pinned), else
+	// the download fails with a *PinError. List a backup key to survive
+	// rotation. Requires the internal transport.
+	PinnedSPKI []string
 	// ExpectedSHA256 is the hex-encoded checksum to verify before the
 	// final install. Empty disables verification.
 	ExpectedSHA256 string
@@ -91,6 +176,27 @@ type Options struct {
 	// disables verification. May be combined with ExpectedSHA256; the
 	// file is read once.
 	ExpectedSHA1 string
+	// Caches are base URLs of content-addressed stores tried, in order,
+	// before the origin whenever the SHA-256 is known (ExpectedSHA256 or an
+	// oci:// digest): <cache>/sha256/<hex digest>. A miss, failure, or
+	// mismatch falls back to the next cache and finally the origin; the
+	// download is verified like any other. Credentials meant for the origin
+	// are not sent to a cache on an unrelated host.
+	Caches []string
+	// CacheDir, when set, keeps a local content-addressed store of
+	// verified downloads, keyed by SHA-256 and by source and validator
+	// (strong ETag, else Last-Modified). A download whose ExpectedSHA256 is
+	// stored is materialized at the destination without a request; one
+	// whose initial response carries a stored validator for the same
+	// source, without transferring the body. Materialization reflinks where
+	// the filesystem supports it (FICLONE on Linux), else hard links (the
+	// file then shares the store's read-only inode) unless FileMode or
+	// PreserveMetadata is set, else copies. Finished
+	// downloads are inserted after installation. Processes may share it.
+	CacheDir string
+	// CacheMaxBytes caps CacheDir's size, evicting the least recently used
+	// objects beyond it. 0 means no cap.
+	CacheMaxBytes int64
 	// RejectContentTypes aborts a download at the initial response — before any byte
 	// is staged — when the response's media type matches an entry (e.g.
 	// "text/html" for CDNs that answer dead links with an HTML error page
@@ -99,6 +205,40 @@ type Options struct {
 	RejectContentTypes []string
 	// Overwrite allows replacing an existing destination file.
 	Overwrite bool
+	// OnExists decides what happens when a file already exists at a
+	// destination named after the response (Dest a directory or ""), and
+	// the download would not overwrite it: "fail" (the default) is
+	// ErrDestExists; "overwrite" replaces it; "skip" leaves it and returns
+	// it as a Result with Skipped set; "rename" keeps both, installing the
+	// download as "name (1).ext" (or the first free number). A renamed
+	// download claims its name under the same in-process lock as any
+	// destination and is still installed without replacing, so a name
+	// taken meanwhile, even by another process, moves it to the next one.
+	// An explicit file Dest, and Request.Extract's Dir, are unaffected.
+	OnExists string
+	// SkipValid makes a download whose destination already holds it a
+	// no-op: Do returns the existing file as a Result with Skipped set,
+	// neither downloading again nor failing with ErrDestExists. The file
+	// qualifies when it has the expected checksums (the decompressed one
+	// with Request.Decompress), checked up front for an explicit Dest;
+	// without checksums, when it has the size the server reports and
+	// the validator PreserveMetadata recorded on it (a strong ETag, else
+	// Last-Modified as the mtime). Any other existing file is handled as
+	// Overwrite and OnExists say. Request.Extract and Request.Writer
+	// downloads are never skipped.
+	SkipValid bool
+	// PreserveMetadata keeps the server's metadata on installed files: the
+	// modification time from Last-Modified (like curl -R), and where the
+	// filesystem supports extended attributes (Linux), the source URL
+	// redacted as by RedactURL (user.xdg.origin.url), the ETag
+	// (user.etag), and the Content-Type (user.mime_type). Metadata the
+	// filesystem refuses is logged and skipped. Files from CacheDir are
+	// reflinked or copied, never hard-linked to the store's object.
+	PreserveMetadata bool
+	// FileMode, when nonzero, is the permission bits of installed files
+	// instead of 0644 (e.g. 0o755 for downloaded binaries). As with
+	// PreserveMetadata, files from CacheDir are not hard-linked.
+	FileMode os.FileMode
 	// Reporter receives progress events. Nil means silent.
 	Reporter Reporter
 	// Logger receives debug-level internals. Nil means discard.
@@ -107,7 +247,8 @@ type Options struct {
 
 // Result describes a completed download.
 type Result struct {
-	// Path is the final destination path.
+	// Path is the final destination path; "" when Request.Extract
+	// discarded the archive or the download went to Request.Writer.
 	Path string
 	// Size is the downloaded size in bytes.
 	Size int64
@@ -126,14 +267,65 @@ type Result struct {
 	SHA256 string
 	// SHA1 is the hex checksum, set only when ExpectedSHA1 was verified.
 	SHA1 string
+	// Cache is the Options.Caches entry that served the download; "" when
+	// it came from the origin.
+	Cache string
+	// Seeded counts the bytes copied from a local seed (Request.Delta or
+	// Request.Seed) instead of downloaded.
+	Seeded int64
+	// Skipped reports that an existing file was left in place, by
+	// Options.OnExists "skip" or as valid under Options.SkipValid: Path and
+	// Size describe it (with SHA256 and SHA1 when SkipValid verified them),
+	// and nothing was downloaded.
+	Skipped bool
+	// Materialized reports how the download came from Options.CacheDir:
+	// "reflink", "hardlink", or "copy"; "" when it was fetched.
+	Materialized string
+	// Extracted is the directory Request.Extract unpacked the download
+	// into.
+	Extracted string
+	// Decompressed is the decoding Request.Decompress applied, "gzip" or
+	// "bzip2"; "" when the download was installed as received. Size and
+	// SHA256 still describe the downloaded (compressed) bytes.
+	Decompressed string
+	// DecompressedSHA256 is the hex checksum of the installed file, set
+	// only when ExpectedDecompressedSHA256 was verified.
+	DecompressedSHA256 string
+	// WarmConns counts the connections pre-established while the initial
+	// response streamed (for the eagerly started flows and the ramp's first
+	// batch) that carried at least one successful request.
+	WarmConns int
+	// Redirects lists the URLs (redacted) the initial request was
+	// redirected through, ending with the final one; empty when it was
+	// not redirected.
+	Redirects []string
 }
 
 // Downloader downloads files. It is safe for concurrent use.
 type Downloader struct {
 	opt  Options
-	base *http.Transport // nil when opt.Transport is set
-	rep  Reporter
-	log  *slog.Logger
+	base *http.Transport // nil when opt.Transport is set; paths[0] otherwise
+	// paths holds one internal transport per source path (see
+	// Options.LocalAddrs); nil when opt.Transport is set.
+	paths []*http.Transport
+	// pathDials are the per-path dialers behind paths, reused for
+	// per-worker transports in HTTP/2 mode.
+	pathDials []dialFunc
+	// route rewrites internal transport dial targets (Options.ConnectTo,
+	// Options.Resolve); nil without rules.
+	route *router
+	rep   Reporter
+	log   *slog.Logger
+
+	// netrc holds Options.Netrc's credentials; nil when disabled.
+	netrc *netrc
+	// rewrite holds the compiled Options.Rewrite rules; nil without any.
+	rewrite *rewriter
+	// store is the Options.CacheDir store; nil when unset.
+	store *store
+	// ociAuth answers registry token challenges for oci:// sources when
+	// Options.Authenticator is unset: anonymous pulls.
+	ociAuth Authenticator
 
 	// A Reporter has no run identifier, so configured reporter streams must
 	// not interleave across concurrent Get calls on this Downloader. Nil
@@ -149,6 +341,8 @@ type Downloader struct {
 	// sleepHook replaces every worker's retry/backoff sleeper in tests
 	// (channel-coordinated fakes instead of wall-clock assertions).
 	sleepHook func(ctx context.Context, d time.Duration) error
+	// streamWindow replaces the streamWindow constant in tests; 0 keeps it.
+	streamWindow int64
 }
 
 // New returns a Downloader. A nil opt selects all defaults.
@@ -188,7 +382,45 @@ func New(opt *Options) (*Downloader, error) {
 	if o.MaxRetries < 0 {
 		return nil, fmt.Errorf("invalid MaxRetries %d: must be >= 1", o.MaxRetries)
 	}
-	var err error
+	if err := validateLocalAddrs(o.LocalAddrs, o.Parts); err != nil {
+		return nil, err
+	}
+	if o.UnixSocket != "" && len(o.LocalAddrs) > 0 {
+		return nil, errors.New("invalid options: UnixSocket and LocalAddrs are mutually exclusive")
+	}
+	if err := validatePins(o.PinnedSPKI); err != nil {
+		return nil, err
+	}
+	if len(o.PinnedSPKI) > 0 && o.Transport != nil {
+		return nil, errors.New("invalid options: PinnedSPKI requires the internal transport, not Transport")
+	}
+	route, err := newRouter(o.Resolve, o.ConnectTo)
+	if err != nil {
+		return nil, err
+	}
+	rewrite, err := newRewriter(o.Rewrite)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCaches(o.Caches); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(onExistsPolicies, cmp.Or(o.OnExists, "fail")) {
+		return nil, fmt.Errorf("invalid OnExists %q: want one of %q", o.OnExists, onExistsPolicies)
+	}
+	if o.FileMode&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("invalid FileMode %v: only permission bits are allowed", o.FileMode)
+	}
+	st, err := newStore(o.CacheDir, o.CacheMaxBytes)
+	if err != nil {
+		return nil, err
+	}
+	var creds *netrc
+	if o.Netrc || o.NetrcFile != "" {
+		if creds, err = loadNetrc(&o); err != nil {
+			return nil, err
+		}
+	}
 	if o.ExpectedSHA256, err = normalizeChecksum(o.ExpectedSHA256, sha256HexLen, "ExpectedSHA256"); err != nil {
 		return nil, err
 	}
@@ -204,7 +436,8 @@ func New(opt *Options) (*Downloader, error) {
 	if o.Logger == nil {
 		o.Logger = slog.New(slog.DiscardHandler)
 	}
-	d := &Downloader{opt: o, rep: o.Reporter, log: o.Logger, reportSem: reportSem}
+	d := &Downloader{opt: o, rep: o.Reporter, log: o.Logger, reportSem: reportSem, route: route, netrc: creds,
+		ociAuth: NewBearerAuth("", ""), rewrite: rewrite, store: st}
 	d.bufs.New = func() any {
 		b := make([]byte, bufSize)
 		return &b
@@ -214,11 +447,32 @@ func New(opt *Options) (*Downloader, error) {
 		KeepAlive: 30 * time.Second,
 	}).DialContext
 	if o.Transport == nil {
-		d.base = newTransport(o, d.dialContext)
+		d.paths = d.newPathTransports()
+		d.base = d.paths[0]
 	}
 	return d, nil
 }
 
+// validateLocalAddrs checks Options.LocalAddrs: every address usable as a
+// source, no duplicates, and at least one part per path.
+func validateLocalAddrs(addrs []netip.Addr, parts int) error {
+	for i, a := range addrs {
+		if !a.IsValid() || a.IsUnspecified() || a.IsMulticast() {
+			return fmt.Errorf("invalid LocalAddrs[%d] %q: want a unicast source address", i, a)
+		}
+		for _, b := range addrs[:i] {
+			if a == b {
+				return fmt.Errorf("invalid LocalAddrs: %s listed twice", a)
+			}
+		}
+	}
+	if len(addrs) > parts {
+		return fmt.Errorf("invalid LocalAddrs: %d addresses need Parts >= %d, have %d",
+			len(addrs), len(addrs), parts)
+	}
+	return nil
+}
+
 // dialContext routes internal transport dials through the test seam.
 func (d *Downloader) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	return d.dial(ctx, network, addr)
@@ -226,21 +480,21 @@ func (d *Downloader) dialContext(ctx context.Context, network, addr string) (net
 
 // newTransport builds the internal transport: HTTP/1.1 only, because HTTP/2
 // would multiplex every parallel range request onto a single TCP connection
-// and defeat the purpose of parallel parts.
+// and defeat the purpose of parallel parts. Options.HTTP2 adds h2, paired
+// with a private transport per worker (see flowTransport).
 func newTransport(
 	o Options, dial func(context.Context, string, string) (net.Conn, error),
 ) *http.Transport {
 	var protocols http.Protocols
 	protocols.SetHTTP1(true)
-	proxy := o.Proxy
-	if proxy == nil {
-		proxy = http.ProxyFromEnvironment
-	}
+	protocols.SetHTTP2(o.HTTP2)
+	// Each transport gets its own TLS config: configuring h2 writes
+	// NextProtos into it, and source paths and h2 workers each build one.
 	return &http.Transport{
-		Proxy:                 proxy,
+		Proxy:                 proxyFor(o),
 		DialContext:           dial,
 		Protocols:             &protocols,
-		TLSClientConfig:       o.TLSConfig,
+		TLSClientConfig:       pinnedTLSConfig(o),
 		TLSHandshakeTimeout:   15 * time.Second,
 		ResponseHeaderTimeout: 30 * time.Second,
 		MaxIdleConnsPerHost:   o.Parts + 1,
@@ -256,14 +510,37 @@ func (d *Downloader) roundTripper() http.RoundTripper {
 }
 
 // newClient wraps a transport in an http.Client carrying the configured
-// cookie jar.
-func (d *Downloader) newClient(rt http.RoundTripper) *http.Client {
-	return &http.Client{Transport: rt, Jar: d.opt.Jar}
+// cookie jar and, for requests toward source's host, .netrc credentials and
+// the Authenticator.
+func (d *Downloader) newClient(rt http.RoundTripper, source *url.URL) *http.Client {
+	if d.netrc != nil {
+		rt = &netrcTransport{creds: d.netrc, source: source, next: rt}
+	}
+	auth := d.opt.Authenticator
+	if auth == nil && source != nil && source.Scheme == "oci" {
+		auth = d.ociAuth
+	}
+	if auth != nil {
+		rt = &authTransport{
+			auth:   auth,
+			source: source,
+			client: &http.Client{Transport: d.roundTripper(), Jar: d.opt.Jar},
+			next:   rt,
+		}
+	}
+	return &http.Client{Transport: rt, Jar: d.opt.Jar, CheckRedirect: d.checkRedirect}
 }
 
-func (d *Downloader) applyHeaders(req *http.Request, source *url.URL) {
+// applyHeaders adds the configured headers (Options.Headers, or the
+// request's merged set) to req, withholding credentials
+// from hosts unrelated to source. Requests to a unix:// URL's socket carry
+// Host "localhost" rather than the synthetic routing host.
+func (d *Downloader) applyHeaders(req *http.Request, source *url.URL, headers http.Header) {
+	if _, ok, _ := unixRoute(req.Context(), req.URL.Hostname()); ok {
+		req.Host = "localhost"
+	}
 	copySensitive := shouldCopySensitiveHeaders(source, req.URL)
-	for k, vs := range d.opt.Headers {
+	for k, vs := range headers {
 		if !copySensitive && isSensitiveRequestHeader(k) {
 			continue
 		}
@@ -273,6 +550,17 @@ func (d *Downloader) applyHeaders(req *http.Request, source *url.URL) {
 	}
 }
 
+// prepare passes a finished request to Options.PrepareRequest.
+func (d *Downloader) prepare(req *http.Request) error {
+	if d.opt.PrepareRequest == nil {
+		return nil
+	}
+	if err := d.opt.PrepareRequest(req); err != nil {
+		return fmt.Errorf("prepare request: %w", err)
+	}
+	return nil
+}
+
 // isSensitiveRequestHeader mirrors the header set protected by net/http
 // while following redirects.
 func isSensitiveRequestHeader(name string) bool {
@@ -310,7 +598,8 @@ func shouldCopySensitiveHeaders(initial, dest *url.URL) bool {
 // Options, so a single long-lived Downloader can serve a whole batch with
 // per-file reporters and checksums.
 type Request struct {
-	// URL is the resource to download.
+	// URL is the resource to download: http(s)://, unix:// (see
+	// Options.UnixSocket), or oci:// for a registry blob (see Get).
 	URL string
 	// Dest may be an explicit file path, an existing directory, or ""
 	// (filename derived from the response).
@@ -323,12 +612,106 @@ type Request struct {
 	// this download (hex; empty falls back).
 	ExpectedSHA256 string
 	ExpectedSHA1   string
+
+	// The fields below override their Options namesakes for this download;
+	// zero values fall back. Requests of one Downloader share its
+	// transports, idle connections, and buffers whatever they override.
+
+	// Headers are merged over Options.Headers, replacing fields of the
+	// same name, under the same redirect rules.
+	Headers http.Header
+	// Parts and MinParts bound this download's connections. Parts is
+	// capped at Options.Parts, which sizes the shared connection pools; a
+	// Parts below Options.MinParts lowers the floor with it unless MinParts
+	// is set.
+	Parts    int
+	MinParts int
+	// Timeout is the base per-read stall timeout.
+	Timeout time.Duration
+	// MaxRetries is the per-chunk retry budget.
+	MaxRetries int
+	// Overwrite allows replacing an existing destination file (false
+	// falls back to Options.Overwrite).
+	Overwrite bool
+	// RejectContentTypes replaces Options.RejectContentTypes.
+	RejectContentTypes []string
+	// Logger receives this download's debug-level internals.
+	Logger *slog.Logger
+
+	// Method is the HTTP method of every download request; "" means GET.
+	// Ranged parts and retries resend it, so the server must treat the
+	// request as a repeatable read. A server ignoring Range for it (200)
+	// gets a single stream.
+	Method string
+	// Body returns a fresh copy of the request body, like
+	// http.Request.GetBody: it is called for the initial request, each
+	// part, and each retry, and once up front to bind resume state to the
+	// body. Nil sends none. After a redirect that turns the request into
+	// a GET (301, 302, 303), parts request the final URL without it.
+	Body func() (io.ReadCloser, error)
+
+	// Delta, when set, makes this a zsync-style delta download that copies
+	// the blocks a local seed already holds and fetches only the rest (see
+	// Delta). A server ignoring Range gets a full single-stream download.
+	Delta *Delta
+	// Seed names a local file believed to hold the start of the resource,
+	// or all of it: a download interrupted in another tool, or the same
+	// file under another name. It may be the destination itself, which is
+	// then replaced. A seed of the resource's size is trusted when it has
+	// the expected checksum; otherwise its first, middle, and last 4 KiB
+	// must match ranges fetched under the server's validator (If-Range).
+	// Trusted bytes are cloned into staging and only the rest is fetched;
+	// a seed that cannot be checked means a full download. It needs Range
+	// support and excludes Delta.
+	Seed string
+
+	// Extract, when set, unpacks the verified archive into a directory (see
+	// Extract). A tar archive downloaded in parts is unpacked while it
+	// downloads, as far as its leading bytes are written.
+	Extract *Extract
+
+	// Decompress installs a compressed resource decompressed: "gzip",
+	// "bzip2", or "auto" for a response with Content-Encoding: gzip or a
+	// name ending in .gz or .bz2; "" or "none" installs it as received.
+	// With "gzip", and with "auto" for a URL naming a .gz or .bz2 file,
+	// requests accept the gzip encoding unless Headers set
+	// Accept-Encoding. Parts are transferred, resumed, and
+	// checked against ExpectedSHA256/ExpectedSHA1 as the compressed bytes;
+	// a multipart download is decompressed while it downloads, as far as
+	// its leading bytes are written. A file name derived from the response
+	// loses its .gz or .bz2 suffix. Excludes Extract, which unpacks
+	// compressed tar archives itself.
+	Decompress string
+	// ExpectedDecompressedSHA256 (hex) verifies the decompressed file, so
+	// a download can be checked as compressed bytes, decompressed bytes, or
+	// both. When nothing is decompressed it checks the download like
+	// ExpectedSHA256.
+	ExpectedDecompressedSHA256 string
+
+	// Writer, when set, receives the download instead of a file: parts are
+	// fetched in parallel and written to it in order. Parts are fetched at
+	// most 32 MiB ahead of the stream, with bytes arriving early held in
+	// memory; only the tail of a part straddling that window is spilled to
+	// a temporary file. Nothing is staged or installed, so there is no resume,
+	// and the checksums are verified as the stream ends: a mismatch fails
+	// the download after the bytes were written. Dest must be "", and
+	// Delta, Seed, Extract, and Decompress are not supported. Writer
+	// downloads always come from the source: Options.CacheDir and
+	// Options.Caches are neither consulted nor filled.
+	Writer io.Writer
 }
 
 // Get downloads url to dest. dest may be an explicit file path, an existing
 // directory, or "" (filename derived from the response). The destination
 // never holds a partial file: bytes are staged in dest+".part" and installed
 // only after verification. Interrupted downloads resume automatically.
+//
+// An oci://registry/repository@sha256:<hex> URL (or repository:tag, resolved
+// through its manifest) downloads a registry blob: the token handshake runs
+// through Options.Authenticator (anonymous Bearer when unset), the blob
+// redirect to storage is followed without credentials, the file is verified
+// against the digest, and an interrupted download resumes from the oci://
+// URL rather than the storage backend's expiring one.
 func (d *Downloader) Get(ctx context.Context, url, dest string) (*Result, error) {
 	return d.Do(ctx, &Request{URL: url, Dest: dest})
 }
@@ -352,6 +735,13 @@ func (d *Downloader) Do(ctx context.Context, req *Request) (*Result, error) {
 	if sha1sum == "" {
 		sha1sum = d.opt.ExpectedSHA1
 	}
+	rq := &resolvedRequest{
+		url: req.URL, dest: req.Dest,
+		sha256: sha256sum, sha1: sha1sum,
+	}
+	if err := d.resolveOverrides(req, rq); err != nil {
+		return nil, err
+	}
 	rep := req.Reporter
 	if rep == nil {
 		rep = d.rep
@@ -365,11 +755,9 @@ func (d *Downloader) Do(ctx context.Context, req *Request) (*Result, error) {
 			}
 		}
 	}
+	rq.rep = rep
 	start := time.Now()
-	res, err := d.get(ctx, &resolvedRequest{
-		url: req.URL, dest: req.Dest, rep: rep,
-		sha256: sha256sum, sha1: sha1sum,
-	})
+	res, err := d.get(ctx, rq)
 	if res != nil {
 		res.Elapsed = time.Since(start)
 	}
@@ -382,37 +770,294 @@ type resolvedRequest struct {
 	url, dest    string
 	rep          Reporter
 	sha256, sha1 string
+
+	headers         http.Header
+	parts, minParts int
+	timeout         time.Duration
+	maxRetries      int
+	overwrite       bool
+	rejectTypes     []string
+	log             *slog.Logger
+	method          string
+	body            func() (io.ReadCloser, error)
+	bodyLen         int64  // set by digestBody
+	bodySum         string // hex SHA-256 of the body; set by digestBody
+	delta           *Delta
+	zsync           *zsyncControl // Delta's control file, loaded by get
+	seed            string
+	extract         *Extract
+	decompress      string // "auto", "gzip", "bzip2", or "" for none
+	decompressed256 string
+	writer          io.Writer
+	onExists        string
+	validChecked    bool // SkipValid hashed dest before any request
+}
+
+// resolveOverrides fills rq's settings from req, falling back to Options,
+// and validates them as New validates Options.
+func (d *Downloader) resolveOverrides(req *Request, rq *resolvedRequest) error {
+	o := &d.opt
+	rq.headers = o.Headers
+	if len(req.Headers) > 0 {
+		rq.headers = o.Headers.Clone()
+		if rq.headers == nil {
+			rq.headers = make(http.Header, len(req.Headers))
+		}
+		for k, vs := range req.Headers {
+			rq.headers[http.CanonicalHeaderKey(k)] = slices.Clone(vs)
+		}
+	}
+	if req.Parts < 0 {
+		return fmt.Errorf("invalid Request.Parts %d: must be >= 1", req.Parts)
+	}
+	rq.parts = min(cmp.Or(req.Parts, o.Parts), o.Parts) // the idle pools hold o.Parts
+	rq.minParts = req.MinParts
+	if rq.minParts == 0 {
+		rq.minParts = min(o.MinParts, rq.parts)
+	}
+	if rq.minParts < 1 || rq.minParts > rq.parts {
+		return fmt.Errorf("invalid Request.MinParts %d: must satisfy 1 <= MinParts <= Parts (%d)",
+			rq.minParts, rq.parts)
+	}
+	if err := validateLocalAddrs(o.LocalAddrs, rq.parts); err != nil {
+		return err
+	}
+	if req.Timeout < 0 {
+		return fmt.Errorf("invalid Request.Timeout %v: must be > 0", req.Timeout)
+	}
+	rq.timeout = cmp.Or(req.Timeout, o.Timeout)
+	if req.MaxRetries < 0 {
+		return fmt.Errorf("invalid Request.MaxRetries %d: must be >= 1", req.MaxRetries)
+	}
+	rq.maxRetries = cmp.Or(req.MaxRetries, o.MaxRetries)
+	rq.overwrite = req.Overwrite || o.Overwrite
+	rq.rejectTypes = o.RejectContentTypes
+	if req.RejectContentTypes != nil {
+		rq.rejectTypes = req.RejectContentTypes
+	}
+	rq.log = cmp.Or(req.Logger, d.log)
+	rq.method = cmp.Or(req.Method, http.MethodGet)
+	if rq.method == http.MethodHead {
+		return errors.New("invalid Request.Method HEAD: a download needs a response body")
+	}
+	rq.body = req.Body
+	if req.Delta != nil && (req.Delta.Control == "" || req.Delta.Seed == "") {
+		return errors.New("invalid Request.Delta: Control and Seed are required")
+	}
+	rq.delta = req.Delta
+	if req.Seed != "" && req.Delta != nil {
+		return errors.New("invalid Request: Seed and Delta are mutually exclusive")
+	}
+	rq.seed = req.Seed
+	if rq.seed != "" && sameFile(rq.seed, rq.dest) {
+		// The seed is the destination: a download interrupted in place.
+		rq.overwrite = true
+	}
+	if req.Extract != nil {
+		if err := req.Extract.validate(); err != nil {
+			return err
+		}
+	}
+	rq.extract = req.Extract
+	if !slices.Contains(decompressModes, cmp.Or(req.Decompress, "none")) {
+		return fmt.Errorf("invalid Request.Decompress %q: want one of %q", req.Decompress, decompressModes)
+	}
+	if req.Decompress != "none" {
+		rq.decompress = req.Decompress
+	}
+	if rq.decompress != "" && rq.extract != nil {
+		return errors.New("invalid Request: Decompress and Extract are mutually exclusive")
+	}
+	var err error
+	if rq.decompressed256, err = normalizeChecksum(req.ExpectedDecompressedSHA256, sha256HexLen,
+		"ExpectedDecompressedSHA256"); err != nil {
+		return err
+	}
+	if acceptsGzip(rq.decompress, rq.url) && rq.headers.Get("Accept-Encoding") == "" {
+		rq.headers = rq.headers.Clone()
+		if rq.headers == nil {
+			rq.headers = make(http.Header, 1)
+		}
+		rq.headers.Set("Accept-Encoding", "gzip")
+	}
+	if req.Writer != nil && (req.Dest != "" || req.Delta != nil || req.Seed != "" || req.Extract != nil ||
+		rq.decompress != "") {
+		return errors.New("invalid Request: Writer excludes Dest, Delta, Seed, Extract, and Decompress")
+	}
+	rq.writer = req.Writer
+	rq.onExists = cmp.Or(o.OnExists, "fail")
+	return nil
+}
+
+// digestBody reads one copy of rq's body for its length and checksum.
+func (rq *resolvedRequest) digestBody() error {
+	if rq.body == nil {
+		return nil
+	}
+	rc, err := rq.body()
+	if err != nil {
+		return fmt.Errorf("request body: %w", err)
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if rq.bodyLen, err = io.Copy(h, rc); err != nil {
+		return fmt.Errorf("request body: %w", err)
+	}
+	rq.bodySum = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// newDownloadRequest builds a download request with the given method and a
+// fresh copy of body (nil for none) of bodyLen bytes.
+func newDownloadRequest(
+	ctx context.Context, method, rawURL string, body func() (io.ReadCloser, error), bodyLen int64,
+) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, cmp.Or(method, http.MethodGet), rawURL, nil)
+	if err != nil || body == nil {
+		return req, err
+	}
+	if req.Body, err = body(); err != nil {
+		return nil, fmt.Errorf("request body: %w", err)
+	}
+	req.GetBody, req.ContentLength = body, bodyLen
+	return req, nil
 }
 
 func (d *Downloader) get(ctx context.Context, rq *resolvedRequest) (*Result, error) {
-	rawURL, dest := rq.url, rq.dest
+	rawURL := rq.url
 	sourceURL, err := parseURL(rawURL)
 	if err != nil {
 		return nil, fmt.Errorf("parse url: %w", err)
 	}
+	reqURL, nameURL := rawURL, ""
+	switch sourceURL.Scheme {
+	case "unix":
+		if d.opt.Transport != nil {
+			return nil, errors.New("unix URLs need the internal transport: Options.Transport is set")
+		}
+		u, err := unixRequestURL(sourceURL)
+		if err != nil {
+			return nil, err
+		}
+		reqURL = u.String()
+		socket, _ := unixSocketOf(u.Hostname())
+		ctx = context.WithValue(ctx, unixSocketKey{}, socket)
+	case "oci":
+		if rq.method != http.MethodGet || rq.body != nil {
+			return nil, errors.New("oci sources are fetched with GET: Request.Method and Request.Body must be unset")
+		}
+		ref, err := parseOCIRef(sourceURL)
+		if err != nil {
+			return nil, err
+		}
+		blobURL, digest, name, err := d.resolveOCI(ctx, ref, sourceURL, rq.headers)
+		if err != nil {
+			return nil, err
+		}
+		sum := strings.TrimPrefix(digest, "sha256:")
+		if rq.sha256 != "" && rq.sha256 != sum {
+			return nil, fmt.Errorf("ExpectedSHA256 %s contradicts the blob digest %s", rq.sha256, digest)
+		}
+		rq.sha256 = sum
+		reqURL = blobURL
+		nameURL = (&url.URL{Scheme: "https", Host: ref.registry, Path: "/" + name}).String()
+	}
+	if err := rq.digestBody(); err != nil {
+		return nil, err
+	}
+	if rq.delta != nil {
+		if rq.zsync, err = d.loadControl(ctx, rq.delta.Control, rq.headers); err != nil {
+			return nil, err
+		}
+		if z := rq.zsync.sha1; z != "" {
+			if rq.sha1 != "" && rq.sha1 != z {
+				return nil, fmt.Errorf("ExpectedSHA1 %s contradicts the zsync control file's SHA-1 %s", rq.sha1, z)
+			}
+			rq.sha1 = z
+		}
+	}
+	if res := d.skipValidDest(rq); res != nil {
+		return res, nil
+	}
+	if d.store != nil && rq.sha256 != "" && rq.decompress == "" && rq.writer == nil {
+		if res, err := d.fromStore(ctx, rq, cmp.Or(nameURL, reqURL)); res != nil || err != nil {
+			return res, err
+		}
+	}
+	if rq.sha256 != "" && len(d.opt.Caches) > 0 && sourceURL.Scheme != "unix" && rq.writer == nil {
+		res, err := d.getCached(ctx, rq, sourceURL, cmp.Or(nameURL, reqURL))
+		if err == nil || ctx.Err() != nil || errors.Is(err, ErrDestExists) {
+			return res, err
+		}
+	}
+	return d.fetch(ctx, rq, sourceURL, reqURL, nameURL)
+}
+
+// fetch downloads reqURL, the request URL for sourceURL, which scopes
+// credentials even when a rewrite rule sends the request elsewhere (nameURL
+// names the file, "" meaning the final URL).
+func (d *Downloader) fetch(
+	ctx context.Context, rq *resolvedRequest, sourceURL *url.URL, reqURL, nameURL string,
+) (*Result, error) {
+	origURL := reqURL
+	var err error
+	var rule *RewriteRule
+	if sourceURL.Scheme != "unix" {
+		if reqURL, rule, err = d.rewrite.rewrite(reqURL); err != nil {
+			return nil, err
+		}
+		if rule != nil {
+			rq.log.Debug("rewrite", "url", redactURL(origURL), "to", redactURL(reqURL))
+		}
+	}
 	electStart := time.Now()
-	resp, remoteAddr, electCancel, err := d.elect(ctx, rawURL)
+	resp, remoteAddr, electCancel, err := d.elect(ctx, reqURL, sourceURL, rq)
+	if err != nil && rule != nil && rule.Fallback && ctx.Err() == nil {
+		rq.log.Debug("rewrite fallback", "url", redactURL(origURL), "err", err)
+		reqURL, rule = origURL, nil
+		resp, remoteAddr, electCancel, err = d.elect(ctx, reqURL, sourceURL, rq)
+	}
 	if err != nil {
 		return nil, err
 	}
 	electDur := time.Since(electStart)
 	finalURL := resp.Request.URL.String()
+	if nameURL == "" && rule != nil && resp.Request.Response == nil {
+		nameURL = origURL // name the file after the source, not the cache
+	}
+	if nameURL == "" {
+		nameURL = finalURL
+	}
 	etag := resp.Header.Get("ETag")
 	lastMod := resp.Header.Get("Last-Modified")
 	contentType := resp.Header.Get("Content-Type")
 
-	if rejected(contentType, d.opt.RejectContentTypes) {
+	if rejected(contentType, rq.rejectTypes) {
 		electCancel(nil)
 		resp.Body.Close()
 		return nil, &ContentTypeError{ContentType: contentType}
 	}
 
-	destPath, err := resolveDest(dest, finalURL, resp.Header)
+	var destPath string
+	if rq.writer != nil {
+		name, _ := deriveName(nameURL, resp.Header)
+		destPath = cmp.Or(name, "-") // names the download for the Reporter only
+	} else {
+		destPath, err = resolveDest(rq.dest, nameURL, resp.Header)
+	}
 	if err != nil {
 		electCancel(nil)
 		resp.Body.Close()
 		return nil, err
 	}
+	codec := ""
+	if rq.decompress != "" {
+		name, _ := deriveName(nameURL, resp.Header)
+		codec = codecFor(rq.decompress, resp.Header, name)
+		if codec != "" && destPath != rq.dest {
+			destPath = filepath.Join(filepath.Dir(destPath), decompressedName(filepath.Base(destPath), codec))
+		}
+	}
 	var total int64 = -1
 	multipart := false
 	initialUsable := false
@@ -436,7 +1081,7 @@ func (d *Downloader) get(ctx context.Context, rq *resolvedRequest) (*Result, err
 		}
 	}
 
-	d.log.Debug("election", "url", redactURL(finalURL), "status", resp.StatusCode,
+	rq.log.Debug("election", "url", redactURL(finalURL), "status", resp.StatusCode,
 		"total", total, "multipart", multipart, "dest", destPath)
 
 	r := &run{
@@ -446,6 +1091,7 @@ func (d *Downloader) get(ctx context.Context, rq *resolvedRequest) (*Result, err
 		sha1:        rq.sha1,
 		url:         finalURL,
 		sourceURL:   sourceURL,
+		redirects:   redirectChain(resp),
 		destPath:    destPath,
 		partPath:    destPath + ".part",
 		total:       total,
@@ -454,6 +1100,22 @@ func (d *Downloader) get(ctx context.Context, rq *resolvedRequest) (*Result, err
 		contentType: contentType,
 		electDur:    electDur,
 	}
+	r.useSettings(rq)
+	if codec == "" && rq.decompressed256 != "" {
+		if r.sha256 != "" && r.sha256 != rq.decompressed256 {
+			electCancel(nil)
+			resp.Body.Close()
+			return nil, fmt.Errorf("ExpectedDecompressedSHA256 %s contradicts ExpectedSHA256 %s for an uncompressed download",
+				rq.decompressed256, r.sha256)
+		}
+		r.sha256 = rq.decompressed256
+	}
+	if d.opt.Redirects.StayOnOriginal {
+		r.url = reqURL
+	} else if r.method = resp.Request.Method; r.method != rq.method {
+		// A 301/302/303 turned the request into a bodiless GET.
+		r.body, r.bodyLen = nil, 0
+	}
 	if initialUsable {
 		resp.Body = &closeOnceBody{ReadCloser: resp.Body}
 		r.initial = resp
@@ -472,10 +1134,13 @@ func (d *Downloader) get(ctx context.Context, rq *resolvedRequest) (*Result, err
 			// Fall back to a fresh full GET and let it declare its own length.
 			r.closeInitial()
 			r.total = -1
-			d.log.Debug("capped initial range discarded without validator or checksum",
+			rq.log.Debug("capped initial range discarded without validator or checksum",
 				"url", redactURL(finalURL))
 		}
 	}
+	if rq.writer != nil {
+		return r.stream(ctx, rq.writer, multipart)
+	}
 
 	unlock, contended, err := tryAcquireDestination(ctx, destPath)
 	if err != nil {
@@ -491,19 +1156,93 @@ func (d *Downloader) get(ctx context.Context, rq *resolvedRequest) (*Result, err
 			return nil, fmt.Errorf("lock destination %s: %w", destPath, err)
 		}
 	}
-	defer unlock()
+	defer func() { unlock() }()
 
-	if !d.opt.Overwrite {
-		if _, err := os.Lstat(destPath); err == nil {
-			return nil, fmt.Errorf("%w: %s", ErrDestExists, destPath)
-		} else if !os.IsNotExist(err) {
-			return nil, fmt.Errorf("stat destination %s: %w", destPath, err)
+	if r.seedPath != "" && r.zsync == nil && sameFile(r.seedPath, destPath) {
+		// As in resolveOverrides, for a destination named by the response.
+		r.overwrite = true
+	}
+	if rq.onExists == "rename" && destPath != rq.dest && rq.extract == nil {
+		r.renameBase = destPath
+	}
+	if d.opt.SkipValid && rq.extract == nil && !(rq.validChecked && destPath == rq.dest) {
+		want256, want1, total := r.sha256, r.sha1, r.total
+		if codec != "" {
+			want256, want1, total = rq.decompressed256, "", -1
+		}
+		if res := d.validExisting(destPath, want256, want1, total, r.meta(), rq.log); res != nil {
+			return res, nil
+		}
+	}
+	if err := rq.checkDest(destPath, r.overwrite); err != nil {
+		switch rq.existsPolicy(destPath, err) {
+		case "overwrite":
+			r.overwrite = true
+		case "skip":
+			return skipExisting(destPath)
+		case "rename":
+			unlock()
+			if destPath, unlock, err = claimNumbered(ctx, destPath); err != nil {
+				return nil, err
+			}
+			r.destPath, r.partPath = destPath, destPath+".part"
+			rq.log.Debug("destination exists, renamed", "dest", destPath)
+		default:
+			return nil, err
+		}
+	}
+	if d.store != nil && codec == "" {
+		if res, err := r.fromStore(rq); res != nil || err != nil {
+			return res, err
+		}
+	}
+	if rq.extract != nil {
+		if r.extraction, err = newExtraction(rq.extract, rq.log); err != nil {
+			return nil, err
 		}
+		defer r.extraction.abort()
+	}
+	if codec != "" {
+		r.decompression = &decompression{codec: codec, out: destPath + ".decoded", part: r.partPath,
+			want256: rq.decompressed256, buf: make([]byte, 256<<10)}
+		defer r.decompression.abort()
+	}
+	if r.seedPath != "" && !multipart {
+		rq.log.Debug("seeding needs ranges; fetching the whole resource", "status", resp.StatusCode)
 	}
+	var res *Result
 	if multipart {
-		return r.multipart(ctx)
+		res, err = r.multipart(ctx)
+	} else {
+		res, err = r.single(ctx)
+	}
+	if err == nil && d.store != nil && res.Path != "" && res.Decompressed == "" {
+		r.store(res)
+	}
+	return res, err
+}
+
+// checkDest fails with ErrDestExists when rq would replace destPath, or
+// its Extract.Dir, without overwrite.
+func (rq *resolvedRequest) checkDest(destPath string, overwrite bool) error {
+	if overwrite {
+		return nil
+	}
+	paths := []string{destPath}
+	if rq.extract != nil {
+		paths = []string{rq.extract.Dir}
+		if rq.extract.Keep {
+			paths = append(paths, destPath)
+		}
+	}
+	for _, path := range paths {
+		if _, err := os.Lstat(path); err == nil {
+			return fmt.Errorf("%w: %s", ErrDestExists, path)
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("stat destination %s: %w", path, err)
+		}
 	}
-	return r.single(ctx)
+	return nil
 }
 
 const (
@@ -546,8 +1285,8 @@ func rejected(contentType string, reject []string) bool {
 // transport (and a user-supplied Options.Transport that implements the
 // method). Useful for long-lived Downloaders between batches.
 func (d *Downloader) CloseIdleConnections() {
-	if d.base != nil {
-		d.base.CloseIdleConnections()
+	for _, tr := range d.paths {
+		tr.CloseIdleConnections()
 	}
 	if tr, ok := d.opt.Transport.(interface{ CloseIdleConnections() }); ok {
 		tr.CloseIdleConnections()
@@ -593,7 +1332,7 @@ func Discard(ctx context.Context, dest string) error {
 	return nil
 }
 
-// elect sends a useful initial GET (Range: bytes=0-) that follows redirects
+// elect sends a useful initial request (Range: bytes=0-) that follows redirects
 // and decides between multipart (206), single-stream (200), and empty (416 on
 // a zero-length resource). A successful 200/206 body is transferred directly
 // to worker 0 instead of paying for a second request. Transient failures are
@@ -604,9 +1343,18 @@ func Discard(ctx context.Context, dest string) error {
 // contract that Close is safe (or effective) concurrently with Read, and
 // Options.Transport bodies are arbitrary. Callers must invoke it exactly
 // once the response is finished with (any cause; nil for ordinary cleanup).
-func (d *Downloader) elect(ctx context.Context, rawURL string) (
+//
+// source is the URL credentials are scoped to (an oci:// reference for its
+// blob URL); nil means rawURL itself.
+func (d *Downloader) elect(ctx context.Context, rawURL string, source *url.URL, rq *resolvedRequest) (
 	*http.Response, string, context.CancelCauseFunc, error) {
-	client := d.newClient(d.roundTripper())
+	if source == nil {
+		var err error
+		if source, err = url.Parse(rawURL); err != nil {
+			return nil, "", nil, fmt.Errorf("build request: %w", err)
+		}
+	}
+	client := d.newClient(d.roundTripper(), source)
 	var bo backoff
 	var lastErr error
 	for attempt := range 3 {
@@ -616,13 +1364,17 @@ func (d *Downloader) elect(ctx context.Context, rawURL string) (
 			}
 		}
 		ectx, ecancel := context.WithCancelCause(ctx)
-		req, err := http.NewRequestWithContext(ectx, http.MethodGet, rawURL, nil)
+		req, err := newDownloadRequest(ectx, rq.method, rawURL, rq.body, rq.bodyLen)
 		if err != nil {
 			ecancel(nil)
 			return nil, "", nil, fmt.Errorf("build request: %w", err)
 		}
-		d.applyHeaders(req, req.URL)
+		d.applyHeaders(req, source, rq.headers)
 		req.Header.Set("Range", "bytes=0-")
+		if err := d.prepare(req); err != nil {
+			ecancel(nil)
+			return nil, "", nil, err
+		}
 		var remoteAddr string
 		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
 			GotConn: func(ci httptrace.GotConnInfo) {
@@ -632,8 +1384,9 @@ func (d *Downloader) elect(ctx context.Context, rawURL string) (
 		resp, err := client.Do(req)
 		if err != nil {
 			ecancel(nil)
+			fillPinHost(err)
 			err = redactErr(err)
-			if ctx.Err() != nil {
+			if isPolicyError(err) || ctx.Err() != nil {
 				return nil, "", nil, err
 			}
 			lastErr = err
@@ -725,6 +1478,8 @@ func (r *run) verifyAndFinalize(file *os.File, resumed bool) (*Result, error) {
 		LastModified: r.lastMod,
 		ContentType:  r.contentType,
 		Resumed:      resumed,
+		WarmConns:    r.warmUsed,
+		Redirects:    r.redirects,
 	}
 	if r.checksumConfigured() {
 		bp := r.d.bufs.Get().(*[]byte)
@@ -752,6 +1507,18 @@ func (r *run) verifyAndFinalize(file *os.File, resumed bool) (*Result, error) {
 	if err := file.Sync(); err != nil {
 		return nil, fmt.Errorf("sync %s: %w", r.partPath, err)
 	}
+	if r.extraction != nil {
+		if err := r.extraction.finish(file, r.overwrite); err != nil {
+			return nil, err
+		}
+		res.Extracted = r.extraction.x.Dir
+	}
+	if z := r.decompression; z != nil {
+		if err := z.finish(file); err != nil {
+			return nil, err
+		}
+		res.Decompressed, res.DecompressedSHA256 = z.codec, z.sum256
+	}
 	// Where flock exists, install while the descriptor — and with it the
 	// cross-process lock — is still held: closing first would let a second
 	// process grab the .part inode in the window before it becomes the
@@ -764,34 +1531,63 @@ func (r *run) verifyAndFinalize(file *os.File, resumed bool) (*Result, error) {
 			return nil, fmt.Errorf("close %s: %w", r.partPath, err)
 		}
 	}
-	if err := r.install(); err != nil {
+	if r.extraction != nil && !r.extraction.x.Keep {
+		// Unpacked, the archive itself is not wanted.
+		res.Path = ""
+		if err := os.Remove(r.partPath); err != nil {
+			r.log.Debug("removing unpacked archive failed", "path", r.partPath, "err", err)
+		}
+	} else if r.decompression != nil {
+		if err := r.install(r.decompression.out); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(r.partPath); err != nil {
+			r.log.Debug("removing decompressed download failed", "path", r.partPath, "err", err)
+		}
+	} else if err := r.install(r.partPath); err != nil {
 		return nil, err
 	}
+	if res.Path != "" {
+		res.Path = r.destPath // OnExists "rename" may have moved it on
+	}
 	if err := os.Remove(statePath(r.partPath)); err != nil && !os.IsNotExist(err) {
-		r.d.log.Debug("removing resume sidecar failed", "err", err)
+		r.log.Debug("removing resume sidecar failed", "err", err)
 	}
 	return res, nil
 }
 
-// install moves the verified .part file to the destination. With Overwrite it
-// is a plain rename; otherwise Link creates the destination only if it is
-// still absent. Filesystems without hard links fail safely and preserve the
-// staging file because the standard library has no portable no-replace rename.
-func (r *run) install() error {
-	if r.d.opt.Overwrite {
-		if err := os.Rename(r.partPath, r.destPath); err != nil {
-			return fmt.Errorf("rename %s -> %s: %w", r.partPath, r.destPath, err)
+// install moves the verified staging file (the .part file, or its
+// decompressed copy) to the destination. With Overwrite it is a plain rename;
+// otherwise Link creates the destination only if it is still absent.
+// Filesystems without hard links fail safely and preserve the staging file
+// because the standard library has no portable no-replace rename.
+func (r *run) install(staged string) error {
+	if r.d.opt.FileMode != 0 || r.d.opt.PreserveMetadata {
+		if err := r.d.preserve(staged, r.meta(), r.log); err != nil {
+			return err
+		}
+	}
+	if r.overwrite {
+		if err := os.Rename(staged, r.destPath); err != nil {
+			return fmt.Errorf("rename %s -> %s: %w", staged, r.destPath, err)
 		}
 		return nil
 	}
-	if err := installNoReplace(r.partPath, r.destPath, os.Link); err != nil {
+	err := installNoReplace(staged, r.destPath, os.Link)
+	for n := 1; errors.Is(err, ErrDestExists) && r.renameBase != "" && n <= maxRenames; n++ {
+		// Taken since it was claimed (by another process, or a download
+		// here that has not installed yet): keep both all the same.
+		r.destPath = numberedName(r.renameBase, n)
+		err = installNoReplace(staged, r.destPath, os.Link)
+	}
+	if err != nil {
 		return err
 	}
-	if err := os.Remove(r.partPath); err != nil && !os.IsNotExist(err) {
+	if err := os.Remove(staged); err != nil && !os.IsNotExist(err) {
 		// The leftover name is a second hard link to the installed file: a
 		// later download to the same destination would truncate it in place.
-		r.d.log.Warn("stale staging link left behind; remove it manually",
-			"path", r.partPath, "err", err)
+		r.log.Warn("stale staging link left behind; remove it manually",
+			"path", staged, "err", err)
 	}
 	return nil
 }
@@ -848,12 +1644,32 @@ type run struct {
 	sha1        string
 	url         string
 	sourceURL   *url.URL
+	redirects   []string // the initial request's, for Result.Redirects
 	destPath    string
 	partPath    string
 	total       int64 // -1 when unknown
 	etag        string
 	lastMod     string
 	contentType string // from the initial response
+
+	// The request's effective settings (Request overrides over Options).
+	headers         http.Header
+	parts, minParts int
+	timeout         time.Duration
+	maxRetries      int
+	overwrite       bool
+	log             *slog.Logger
+	method          string // of the requests to url
+	body            func() (io.ReadCloser, error)
+	bodyLen         int64
+	sourceMethod    string // the caller's; with bodySum, binds resume state
+	bodySum         string
+	zsync           *zsyncControl // with seedPath, a delta download's plan
+	seedPath        string        // Delta.Seed, or Request.Seed
+	extraction      *extraction   // Request.Extract's; nil without one
+	decompression   *decompression
+	renameBase      string // the derived destination, under OnExists "rename"
+
 	// electDur is the election round-trip wall time: the best available
 	// proxy for what a fresh connection on this path costs (DNS, dial, TLS,
 	// TTFB). It scales the ramp's settling floor.
@@ -872,10 +1688,26 @@ type run struct {
 	initialCancel context.CancelCauseFunc
 	// progress counts body bytes read this run (drives the concurrency ramp).
 	progress atomic.Int64
-	// ramp is the adaptive-concurrency governor; nil on the single-stream
-	// path. Its throughput ramp may be finished from the start, but its
-	// throttle control stays live for the run.
-	ramp *rampState
+	// warm holds the connections pre-established for the eager flows and the
+	// ramp's first batch (nil when none); warmUsed counts those a request
+	// completed a round trip on.
+	warm     *warmPool
+	warmUsed int
+	// ramps holds the adaptive-concurrency governors, one per source path
+	// (see Options.LocalAddrs); nil on the single-stream path. A ramp's
+	// throughput ramp may be finished from the start, but its throttle
+	// control stays live for the run.
+	ramps []*rampState
+}
+
+// rampFor returns the governor of worker id's source path and the worker's
+// index within that path (nil on the single-stream path). Ramps count flows
+// in path-local ids: worker id serves path id%n as that path's flow id/n.
+func (r *run) rampFor(id int) (*rampState, int) {
+	if len(r.ramps) == 0 {
+		return nil, 0
+	}
+	return r.ramps[id%len(r.ramps)], id / len(r.ramps)
 }
 
 // closeOnceBody lets the worker timeout close an initial response to unblock a
@@ -920,7 +1752,29 @@ func (r *run) closeInitial() {
 func (r *run) name() string { return filepath.Base(r.destPath) }
 
 func (r *run) applyHeaders(req *http.Request) {
-	r.d.applyHeaders(req, r.sourceURL)
+	r.d.applyHeaders(req, r.sourceURL, r.headers)
+}
+
+// useSettings adopts rq's effective settings.
+func (r *run) useSettings(rq *resolvedRequest) {
+	r.headers = rq.headers
+	r.parts, r.minParts = rq.parts, rq.minParts
+	r.timeout = rq.timeout
+	r.maxRetries = rq.maxRetries
+	r.overwrite = rq.overwrite
+	r.log = rq.log
+	r.method, r.body, r.bodyLen = rq.method, rq.body, rq.bodyLen
+	r.sourceMethod, r.bodySum = rq.method, rq.bodySum
+	if rq.zsync != nil {
+		r.zsync, r.seedPath = rq.zsync, rq.delta.Seed
+	} else {
+		r.seedPath = rq.seed
+	}
+}
+
+// newRequest builds a request for r.url with r's method and body.
+func (r *run) newRequest(ctx context.Context) (*http.Request, error) {
+	return newDownloadRequest(ctx, r.method, r.url, r.body, r.bodyLen)
 }
 
 // validator returns the If-Range value proving the content is unchanged
@@ -943,7 +1797,7 @@ func (r *run) resumable() bool {
 // workers, dynamic chunk splitting, and resume.
 func (r *run) multipart(ctx context.Context) (*Result, error) {
 	sched := newScheduler(r.d.opt.MinPartSize)
-	sourceID := sourceIdentity(r.sourceURL)
+	sourceID := requestIdentity(r.sourceURL, r.sourceMethod, r.bodySum)
 
 	flag := os.O_RDWR | os.O_CREATE
 	file, err := os.OpenFile(r.partPath, flag, 0o644)
@@ -955,7 +1809,7 @@ func (r *run) multipart(ctx context.Context) (*Result, error) {
 		if !errors.Is(err, errFlockUnsupported) {
 			return nil, fmt.Errorf("%w: %s", err, r.partPath)
 		}
-		r.d.log.Debug("staging lock unavailable, proceeding unprotected",
+		r.log.Debug("staging lock unavailable, proceeding unprotected",
 			"path", r.partPath, "err", err)
 	}
 	st := loadState(statePath(r.partPath))
@@ -967,7 +1821,7 @@ func (r *run) multipart(ctx context.Context) (*Result, error) {
 		r.closeInitial()
 	}
 
-	var resumedBytes int64
+	var resumedBytes, seeded int64
 	if resumed {
 		for _, c := range st.Chunks {
 			if c.Done < c.End-c.Off {
@@ -975,18 +1829,37 @@ func (r *run) multipart(ctx context.Context) (*Result, error) {
 			}
 		}
 		resumedBytes = r.total - st.remaining()
-		r.d.log.Debug("resuming", "bytes", resumedBytes, "chunks", len(st.Chunks))
+		r.log.Debug("resuming", "bytes", resumedBytes, "chunks", len(st.Chunks))
 	} else {
 		if err := file.Truncate(r.total); err != nil {
 			return nil, fmt.Errorf("preallocate %s: %w", r.partPath, err)
 		}
-		sched.addPending(0, r.total, 0)
+		if r.zsync != nil {
+			// Seeded blocks break the byte-zero stream's continuity.
+			r.closeInitial()
+			if seeded, err = r.seedDelta(file, sched); err != nil {
+				return nil, err
+			}
+		} else if r.seedPath != "" {
+			if seeded, err = r.seedPrefix(ctx, file, sched); err != nil {
+				return nil, err
+			}
+		} else {
+			sched.addPending(0, r.total, 0)
+		}
 	}
 	st = &stateFile{
 		Version: stateVersion, SourceID: sourceID, Size: r.total,
 		ETag: r.etag, LastModified: r.lastMod,
 	}
-	r.rep.Start(Info{Name: r.name(), Total: r.total, Resumed: resumedBytes})
+	r.rep.Start(Info{Name: r.name(), Total: r.total, Resumed: resumedBytes + seeded})
+	written := func() int64 { return sched.writtenPrefix(r.total) }
+	if r.extraction != nil {
+		r.extraction.stream(file, written, r.total)
+	}
+	if r.decompression != nil {
+		r.decompression.stream(file, written, r.total)
+	}
 
 	err = r.runWorkers(ctx, sched, file, st)
 	if err != nil {
@@ -994,12 +1867,15 @@ func (r *run) multipart(ctx context.Context) (*Result, error) {
 			// Leave .part and sidecar in place for a future resume.
 			st.Chunks = sched.snapshot()
 			if serr := st.save(statePath(r.partPath)); serr != nil {
-				r.d.log.Debug("saving resume state failed", "err", serr)
+				r.log.Debug("saving resume state failed", "err", serr)
 			}
 		}
 		return nil, err
 	}
 	res, err := r.verifyAndFinalize(file, resumed)
+	if res != nil {
+		res.Seeded = seeded
+	}
 	if err != nil && r.resumable() {
 		if _, ok := errors.AsType[*ChecksumError](err); ok {
 			// The bytes are complete; only the published checksum disagrees.
@@ -1007,7 +1883,7 @@ func (r *run) multipart(ctx context.Context) (*Result, error) {
 			// none) finalize without re-downloading.
 			st.Chunks = sched.snapshot() // empty: everything is written
 			if serr := st.save(statePath(r.partPath)); serr != nil {
-				r.d.log.Debug("saving complete-state sidecar failed", "err", serr)
+				r.log.Debug("saving complete-state sidecar failed", "err", serr)
 			}
 		}
 	}
@@ -1044,6 +1920,16 @@ func rampEligible(remaining, minPartSize int64, parts int) bool {
 	return parts > 1 && minPartSize > 0 && remaining/minPartSize >= int64(parts)
 }
 
+// shareOf returns pool p's share when n items are dealt round-robin across
+// pools pools.
+func shareOf(n, p, pools int) int {
+	share := n / pools
+	if p < n%pools {
+		share++
+	}
+	return share
+}
+
 // settleFloorFor derives a run's settling wall floor from its election
 // round-trip: twice the observed cost of a fresh request on this path,
 // clamped so a degenerate measurement can neither erase the floor nor
@@ -1067,15 +1953,19 @@ func settleFloorFor(electDur time.Duration) time.Duration {
 // land, so the ramp is byte-accurate at any link speed.
 type rampState struct {
 	done atomic.Bool // fast path for the per-read check
-	mu   sync.Mutex
+	// delivered counts body bytes read by this ramp's workers; note is fed
+	// from it so each source path is judged on its own throughput.
+	delivered atomic.Int64
+	mu        sync.Mutex
 	// spawn and demote are side effects executed by note AFTER rs.mu is
 	// released; rs.mu never nests with the scheduler or controller locks.
 	spawn  func(int)
 	demote func(keep int)
 	now    func() time.Time // injected in tests
 	parts  int
-	// floor is the flow count the run started with (Options.MinParts,
-	// clamped); the governor probes upward from it and never retires below it.
+	// floor is the flow count the path started with (its share of
+	// Options.MinParts, clamped); the governor probes upward from it and
+	// never retires below it. parts is likewise the path's share of Parts.
 	floor    int
 	window   int64
 	warmed   bool // burn-in window consumed
@@ -1271,10 +2161,30 @@ func (rs *rampState) admitLocked(sample rampSample, now time.Time) (spawnFrom, s
 	return spawnFrom, add, 0
 }
 
+// warmCounts returns how many connections to pre-establish on each source
+// path: one per eagerly started flow plus the ramp's first batch when it can
+// still admit one, less the flow that will consume the initial response on
+// the election's connection (counted against the first path).
+func (r *run) warmCounts() []int {
+	counts := make([]int, len(r.ramps))
+	for p, rs := range r.ramps {
+		counts[p] = rs.floor
+		if !rs.done.Load() {
+			counts[p] += min(rs.admitted, rs.parts-rs.admitted)
+		}
+	}
+	r.initialMu.Lock()
+	if r.initial != nil && len(counts) > 0 && counts[0] > 0 {
+		counts[0]--
+	}
+	r.initialMu.Unlock()
+	return counts
+}
+
 // runWorkers drives the worker pool and the periodic sidecar flusher,
 // returning the first real error (or the context's cause).
 func (r *run) runWorkers(
-	ctx context.Context, sched *scheduler, file *os.File, st *stateFile,
+	ctx context.Context, sched *scheduler, file sink, st *stateFile,
 ) error {
 	sched.onGrant = r.rep.ChunkStart
 	if rz, ok := r.rep.(ChunkResizer); ok {
@@ -1317,8 +2227,8 @@ func (r *run) runWorkers(
 			}
 		})
 	}
-	retire := func(keep int) {
-		victims := sched.demote(keep)
+	retire := func(pool, keep int) {
+		victims := sched.demotePool(pool, keep)
 		for _, id := range victims {
 			ctl.mu.Lock()
 			wcancel := ctl.cancels[id]
@@ -1329,30 +2239,43 @@ func (r *run) runWorkers(
 		}
 	}
 	remaining := sched.remainingBytes()
-	start := sched.prepare(r.d.opt.MinParts)
+	// Every source path starts with at least one flow when the work allows.
+	pools := r.d.pools()
+	sched.partition(pools)
+	start := sched.prepare(max(r.minParts, pools))
 	// Window: big enough to measure meaningfully while leaving room to
 	// evaluate several doubling steps. At the remaining/16 branch, the
 	// default 1→2→4→8 ramp reaches its final judgment near the midpoint;
 	// the fixed 2*MinPartSize cap makes it earlier on larger objects.
 	// Size from REMAINING work so a near-complete resume still ramps.
 	window := max(min(2*r.d.opt.MinPartSize, remaining/16), 1)
-	r.ramp = &rampState{
-		spawn:     spawn,
-		demote:    retire,
-		now:       time.Now,
-		parts:     r.d.opt.Parts,
-		floor:     start,
-		window:    window,
-		settleMin: settleFloorFor(r.electDur),
-		admitted:  start,
-		markTime:  time.Now(),
-	}
-	if start >= r.d.opt.Parts || !rampEligible(remaining, r.d.opt.MinPartSize, r.d.opt.Parts) {
-		// No throughput ramp: the floor already fills Parts, or the remaining
-		// work cannot feed every configured connection. The governor still
-		// exists so an explicit 429 can shed eager flows.
-		r.ramp.done.Store(true)
+	eligible := rampEligible(remaining, r.d.opt.MinPartSize, r.parts)
+	r.ramps = make([]*rampState, pools)
+	for p := range pools {
+		// Path p owns worker ids p, p+pools, p+2*pools, ...: its share of
+		// Parts and of the eagerly started flows.
+		parts, floor := shareOf(r.parts, p, pools), shareOf(start, p, pools)
+		rs := &rampState{
+			spawn:     func(local int) { spawn(local*pools + p) },
+			demote:    func(keep int) { retire(p, keep) },
+			now:       time.Now,
+			parts:     parts,
+			floor:     floor,
+			window:    window,
+			settleMin: settleFloorFor(r.electDur),
+			admitted:  floor,
+			markTime:  time.Now(),
+		}
+		if floor == 0 || floor >= parts || !eligible {
+			// No throughput ramp: the path got no flow, its floor already
+			// fills its share of Parts, or the remaining work cannot feed
+			// every configured connection. The governor still exists so an
+			// explicit 429 can shed eager flows.
+			rs.done.Store(true)
+		}
+		r.ramps[p] = rs
 	}
+	r.warm = r.startWarm(runCtx, r.warmCounts())
 	for id := range start {
 		spawn(id)
 	}
@@ -1360,7 +2283,7 @@ func (r *run) runWorkers(
 	flushDone := make(chan struct{})
 	go func() {
 		defer close(flushDone)
-		if !r.resumable() {
+		if st == nil || !r.resumable() {
 			return
 		}
 		t := time.NewTicker(flushEvery)
@@ -1381,7 +2304,7 @@ func (r *run) runWorkers(
 				}
 				lastRemaining = rem
 				if err := st.save(statePath(r.partPath)); err != nil {
-					r.d.log.Debug("flush resume state failed", "err", err)
+					r.log.Debug("flush resume state failed", "err", err)
 				}
 			}
 		}
@@ -1390,6 +2313,11 @@ func (r *run) runWorkers(
 	wg.Wait()
 	cancel(nil)
 	<-flushDone
+	if r.warm != nil {
+		dialed, used := r.warm.close()
+		r.warmUsed = used
+		r.log.Debug("connection warm-up", "dialed", dialed, "used", used)
+	}
 	if firstErr != nil {
 		return firstErr
 	}
@@ -1399,8 +2327,8 @@ func (r *run) runWorkers(
 	if !sched.idle() {
 		sched.mu.Lock()
 		var detail strings.Builder
-		detail.WriteString(fmt.Sprintf("pending=%d active=%d live=%v retiring=%v limit=%d",
-			len(sched.pending), len(sched.active), sched.live, sched.retiring, sched.limit))
+		detail.WriteString(fmt.Sprintf("pending=%d active=%d live=%v retiring=%v limits=%v",
+			len(sched.pending), len(sched.active), sched.live, sched.retiring, sched.limits))
 		for _, c := range sched.active {
 			detail.WriteString(fmt.Sprintf(" active[%d]{owner=%d off=%d done=%d end=%d}",
 				c.id, c.owner, c.off, c.done, c.end))
@@ -1431,7 +2359,7 @@ func (r *run) single(ctx context.Context) (*Result, error) {
 		if !errors.Is(err, errFlockUnsupported) {
 			return nil, fmt.Errorf("%w: %s", err, r.partPath)
 		}
-		r.d.log.Debug("staging lock unavailable, proceeding unprotected",
+		r.log.Debug("staging lock unavailable, proceeding unprotected",
 			"path", r.partPath, "err", err)
 	}
 
@@ -70,6 +70,42 @@ func (e *ChecksumError) Error() string {
 	return msg
 }
 
+// PinError is returned when a TLS peer of the internal transport presents
+// no public key listed in Options.PinnedSPKI. It is never retried: the
+// connection may be intercepted.
+type PinError struct {
+	Host string // the TLS server name of the rejected connection
+}
+
+func (e *PinError) Error() string {
+	return fmt.Sprintf("certificate for %s matches no pinned public key", e.Host)
+}
+
+// RedirectError is returned when a redirect violates Options.Redirects. It
+// is never retried.
+type RedirectError struct {
+	URL    string // the refused target, redacted
+	Reason string
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("redirect to %s refused: %s", e.URL, e.Reason)
+}
+
+// isPolicyError reports whether err is a refusal retrying cannot change: a
+// pin mismatch, an unanswerable authentication challenge, or a redirect
+// the policy forbids.
+func isPolicyError(err error) bool {
+	if _, ok := errors.AsType[*PinError](err); ok {
+		return true
+	}
+	if _, ok := errors.AsType[*AuthError](err); ok {
+		return true
+	}
+	_, ok := errors.AsType[*RedirectError](err)
+	return ok
+}
+
 // SizeError is returned when the final file size does not match the size
 // advertised by the server.
 type SizeError struct {
@@ -115,7 +151,9 @@ func redactURL(raw string) string {
 func redactErr(err error) error {
 	if uerr, ok := errors.AsType[*url.Error](err); ok {
 		uerr.URL = redactURL(uerr.URL)
-		if uerr.Err != nil && containsUnsafeURLDetails(uerr.Err.Error()) {
+		// The package's own policy errors carry redacted URLs already;
+		// keep them reachable for callers.
+		if uerr.Err != nil && !isPolicyError(uerr.Err) && containsUnsafeURLDetails(uerr.Err.Error()) {
 			uerr.Err = errURLDetailsRedacted
 		}
 	}
@@ -0,0 +1,139 @@
+package download
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var onExistsPolicies = []string{"fail", "overwrite", "skip", "rename"}
+
+// maxRenames bounds the numbered names OnExists "rename" tries.
+const maxRenames = 9999
+
+// existsPolicy returns rq's OnExists policy for err, checkDest's verdict on
+// destPath: "" unless err is ErrDestExists for a file destination derived
+// from the response.
+func (rq *resolvedRequest) existsPolicy(destPath string, err error) string {
+	if !errors.Is(err, ErrDestExists) || rq.extract != nil || destPath == rq.dest || rq.onExists == "fail" {
+		return ""
+	}
+	return rq.onExists
+}
+
+// numberedName returns path with " (n)" before its extension, keeping a
+// compressed tar's two: "a (1).tar.gz".
+func numberedName(path string, n int) string {
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	stem := base[:len(base)-len(ext)]
+	if inner := filepath.Ext(stem); strings.EqualFold(inner, ".tar") {
+		stem, ext = stem[:len(stem)-len(inner)], inner+ext
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, n, ext))
+}
+
+// claimNumbered returns the first numbered variant of destPath that does
+// not exist and that no other download in this process is using, with its
+// destination lock held.
+func claimNumbered(ctx context.Context, destPath string) (string, func(), error) {
+	for n := 1; n <= maxRenames; n++ {
+		candidate := numberedName(destPath, n)
+		unlock, contended, err := tryAcquireDestination(ctx, candidate)
+		if err != nil {
+			return "", nil, fmt.Errorf("lock destination %s: %w", candidate, err)
+		}
+		if contended {
+			continue // another download is about to install it
+		}
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate, unlock, nil
+		}
+		unlock()
+	}
+	return "", nil, fmt.Errorf("%w: %s and %d numbered names", ErrDestExists, destPath, maxRenames)
+}
+
+// skipExisting returns the Result for an existing destination kept by
+// OnExists "skip".
+func skipExisting(destPath string) (*Result, error) {
+	fi, err := os.Stat(destPath)
+	if err != nil {
+		return nil, fmt.Errorf("stat destination %s: %w", destPath, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: %s is not a file", ErrDestExists, destPath)
+	}
+	return &Result{Path: destPath, Size: fi.Size(), Skipped: true}, nil
+}
+
+// skipValidDest returns a Skipped Result, before any request, when
+// SkipValid applies and rq's explicit file Dest has the checksums the
+// installed file would.
+func (d *Downloader) skipValidDest(rq *resolvedRequest) *Result {
+	if !d.opt.SkipValid || rq.writer != nil || rq.extract != nil {
+		return nil
+	}
+	want256, want1 := cmp.Or(rq.sha256, rq.decompressed256), rq.sha1
+	if rq.decompress != "" {
+		want256, want1 = rq.decompressed256, ""
+	}
+	if want256 == "" && want1 == "" {
+		return nil
+	}
+	if fi, err := os.Stat(rq.dest); err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	rq.validChecked = true
+	return d.validExisting(rq.dest, want256, want1, -1, fileMeta{}, rq.log)
+}
+
+// validExisting returns a Skipped Result when the file at path already is
+// the download, else nil. With checksums (want256, want1) it must have
+// them. Without, it must be total bytes long and carry m's validator as
+// PreserveMetadata records it: a strong ETag in its attribute, else
+// Last-Modified as its mtime; before a request (total < 0) nothing but a
+// checksum can vouch for it.
+func (d *Downloader) validExisting(path, want256, want1 string, total int64, m fileMeta, log *slog.Logger) *Result {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	res := &Result{Path: path, Size: fi.Size(), ETag: m.etag, LastModified: m.lastMod, ContentType: m.contentType,
+		Skipped: true}
+	if want256 != "" || want1 != "" {
+		bp := d.bufs.Get().(*[]byte)
+		sum256, sum1, err := hashFile(f, want256 != "", want1 != "", *bp)
+		d.bufs.Put(bp)
+		if err != nil || sum256 != want256 || sum1 != want1 {
+			log.Debug("existing destination does not match the checksum", "path", path, "err", err)
+			return nil
+		}
+		res.SHA256, res.SHA1 = sum256, sum1
+		return res
+	}
+	if total < 0 || fi.Size() != total {
+		return nil
+	}
+	if isStrongETag(m.etag) {
+		if recorded, err := getXattr(path, xattrETag); err != nil || recorded != m.etag {
+			return nil
+		}
+		return res
+	}
+	if t, err := http.ParseTime(m.lastMod); err != nil || !fi.ModTime().Equal(t) {
+		return nil
+	}
+	return res
+}
@@ -0,0 +1,223 @@
+package download
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNumberedName(t *testing.T) {
+	t.Parallel()
+	for in, want := range map[string]string{
+		"file.bin":        "file (2).bin",
+		"dir/a.tar.gz":    filepath.Join("dir", "a (2).tar.gz"),
+		"noext":           "noext (2)",
+		"report.v2.pdf":   "report.v2 (2).pdf",
+		"archive.TAR.bz2": "archive (2).TAR.bz2",
+		"dir/sub/x.tar":   filepath.Join("dir", "sub", "x (2).tar"),
+	} {
+		if got := numberedName(in, 2); got != want {
+			t.Errorf("numberedName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// TestOnExists: the policies for a derived destination that exists, and an
+// explicit Dest they leave alone.
+func TestOnExists(t *testing.T) {
+	t.Parallel()
+	data := testData(64 << 10)
+	var st stats
+	srv := httptest.NewServer(rangeHandler(data, `"v1"`, &st))
+	t.Cleanup(srv.Close)
+	old := []byte("old contents")
+	for _, policy := range []string{"", "fail", "overwrite", "skip", "rename"} {
+		dir := t.TempDir()
+		existing := filepath.Join(dir, "file.bin")
+		if err := os.WriteFile(existing, old, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		d := newDL(t, &Options{Parts: 2, MinPartSize: 16 << 10, OnExists: policy})
+
+		res, err := d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: dir})
+		switch policy {
+		case "", "fail":
+			if !errors.Is(err, ErrDestExists) {
+				t.Errorf("%q: err = %v, want ErrDestExists", policy, err)
+			}
+			assertFile(t, existing, old)
+		case "overwrite":
+			if err != nil {
+				t.Fatalf("%q: %v", policy, err)
+			}
+			assertFile(t, existing, data)
+			if res.Skipped {
+				t.Errorf("%q: Skipped", policy)
+			}
+		case "skip":
+			if err != nil {
+				t.Fatalf("%q: %v", policy, err)
+			}
+			if !res.Skipped || res.Path != existing || res.Size != int64(len(old)) {
+				t.Errorf("%q: Skipped, Path, Size = %v, %q, %d", policy, res.Skipped, res.Path, res.Size)
+			}
+			assertFile(t, existing, old)
+		case "rename":
+			if err != nil {
+				t.Fatalf("%q: %v", policy, err)
+			}
+			if want := filepath.Join(dir, "file (1).bin"); res.Path != want {
+				t.Errorf("%q: Path = %q, want %q", policy, res.Path, want)
+			}
+			assertFile(t, res.Path, data)
+			assertFile(t, existing, old)
+			assertOnly(t, dir, "file (1).bin", "file.bin")
+
+			// An explicit Dest is not renamed.
+			_, err := d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: existing})
+			if !errors.Is(err, ErrDestExists) {
+				t.Errorf("%q, explicit Dest: err = %v, want ErrDestExists", policy, err)
+			}
+		}
+	}
+
+	if _, err := New(&Options{OnExists: "ask"}); err == nil {
+		t.Error("New accepted OnExists \"ask\"")
+	}
+}
+
+// TestOnExistsRenameConcurrent: concurrent downloads of one name each keep
+// their own copy.
+func TestOnExistsRenameConcurrent(t *testing.T) {
+	t.Parallel()
+	data := testData(128 << 10)
+	var st stats
+	srv := httptest.NewServer(rangeHandler(data, `"v1"`, &st))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{Parts: 2, MinPartSize: 16 << 10, OnExists: "rename"})
+	dir := t.TempDir()
+
+	const n = 4
+	var wg sync.WaitGroup
+	paths := make([]string, n)
+	for i := range n {
+		wg.Go(func() {
+			rep := NopReporter{} // per-request: do not serialize on the Options reporter
+			res, err := d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: dir, Reporter: rep})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			paths[i] = res.Path
+		})
+	}
+	wg.Wait()
+	assertOnly(t, dir, "file (1).bin", "file (2).bin", "file (3).bin", "file.bin")
+	for _, p := range paths {
+		assertFile(t, p, data)
+	}
+}
+
+// TestInstallRenamesTakenName: a name taken after it was claimed moves the
+// install to the next free number instead of failing or replacing it.
+func TestInstallRenamesTakenName(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	base := filepath.Join(dir, "f.txt")
+	for _, p := range []string{base, numberedName(base, 1)} {
+		if err := os.WriteFile(p, []byte("taken"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	staged := filepath.Join(dir, "staged")
+	if err := os.WriteFile(staged, []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d := newDL(t, &Options{})
+	r := defaultRun(t, &run{d: d, rep: NopReporter{}, destPath: numberedName(base, 1), renameBase: base})
+	if err := r.install(staged); err != nil {
+		t.Fatal(err)
+	}
+	if want := numberedName(base, 2); r.destPath != want {
+		t.Errorf("installed at %q, want %q", r.destPath, want)
+	}
+	assertFile(t, r.destPath, []byte("new"))
+	assertFile(t, numberedName(base, 1), []byte("taken"))
+}
+
+// TestSkipValidChecksum: an explicit Dest with the expected checksum is
+// skipped without a request; one without it is handled as usual.
+func TestSkipValidChecksum(t *testing.T) {
+	t.Parallel()
+	data := testData(96 << 10)
+	sum := strings.TrimPrefix(sha256Digest(data), "sha256:")
+	var st stats
+	srv := httptest.NewServer(rangeHandler(data, `"v1"`, &st))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{SkipValid: true})
+	dest := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(dest, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: dest, ExpectedSHA256: sum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Skipped || res.Path != dest || res.SHA256 != sum || res.Size != int64(len(data)) {
+		t.Errorf("Skipped, Path, SHA256, Size = %v, %q, %q, %d", res.Skipped, res.Path, res.SHA256, res.Size)
+	}
+	if n := len(st.rangeHeaders()); n != 0 {
+		t.Errorf("server saw %d requests, want none", n)
+	}
+
+	if err := os.WriteFile(dest, []byte("stale"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	req := &Request{URL: srv.URL + "/file.bin", Dest: dest, ExpectedSHA256: sum}
+	if _, err := d.Do(t.Context(), req); !errors.Is(err, ErrDestExists) {
+		t.Fatalf("stale file: err = %v, want ErrDestExists", err)
+	}
+	req.Overwrite = true
+	if res, err = d.Do(t.Context(), req); err != nil || res.Skipped {
+		t.Fatalf("stale file, Overwrite: Skipped = %v, err = %v", res != nil && res.Skipped, err)
+	}
+	assertFile(t, dest, data)
+}
+
+// TestSkipValidValidator: without a checksum, a file PreserveMetadata
+// stamped with the server's Last-Modified and of its size is skipped, and
+// one touched since is not.
+func TestSkipValidValidator(t *testing.T) {
+	t.Parallel()
+	data := testData(64 << 10)
+	var st stats
+	srv := httptest.NewServer(rangeHandler(data, "", &st)) // Last-Modified only
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{PreserveMetadata: true, SkipValid: true})
+	dir := t.TempDir()
+
+	first, err := d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Skipped || res.Path != first.Path {
+		t.Errorf("Skipped, Path = %v, %q; want %q skipped", res.Skipped, res.Path, first.Path)
+	}
+
+	if err := os.Chtimes(first.Path, time.Time{}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: dir}); !errors.Is(err, ErrDestExists) {
+		t.Errorf("touched file: err = %v, want ErrDestExists", err)
+	}
+}
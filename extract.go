@@ -0,0 +1,376 @@
+package download
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Extract unpacks a downloaded archive into a directory. The archive is
+// unpacked into a staging directory beside Dir, which is renamed into place
+// only once the download is verified, so Dir never holds a partial tree.
+// Entries naming a path outside Dir (absolute, or through "..") and
+// symlinks pointing outside it fail the download, and no entry is written
+// through a symlink that resolves outside the staging directory.
+type Extract struct {
+	// Dir is the directory to create. An existing Dir is ErrDestExists
+	// unless the request overwrites, in which case it is replaced whole.
+	Dir string
+	// Format is "tar", "tar.gz", "tar.bz2", or "zip"; "" detects it from
+	// the archive's leading bytes.
+	Format string
+	// Keep installs the archive at the destination too; by default it is
+	// discarded once unpacked.
+	Keep bool
+}
+
+var extractFormats = []string{"tar", "tar.gz", "tar.bz2", "zip"}
+
+func (x *Extract) validate() error {
+	if x.Dir == "" {
+		return errors.New("invalid Request.Extract: Dir is required")
+	}
+	if x.Format != "" && !slices.Contains(extractFormats, x.Format) {
+		return fmt.Errorf("invalid Request.Extract.Format %q: want one of %q", x.Format, extractFormats)
+	}
+	return nil
+}
+
+// errNotStreamable stops a streaming extraction of a zip archive, whose
+// directory is at its end; it is unpacked once downloaded.
+var errNotStreamable = errors.New("archive cannot be unpacked while downloading")
+
+// extraction is one Extract in progress: entries are written under staging
+// until install renames it to x.Dir.
+type extraction struct {
+	stage // a streaming pass, when started
+
+	x       *Extract
+	staging string
+	log     *slog.Logger
+	buf     []byte
+}
+
+func newExtraction(x *Extract, log *slog.Logger) (*extraction, error) {
+	staging, err := os.MkdirTemp(filepath.Dir(x.Dir), "."+filepath.Base(x.Dir)+".extract-")
+	if err != nil {
+		return nil, fmt.Errorf("extract: %w", err)
+	}
+	if err := os.Chmod(staging, 0o755); err != nil { // MkdirTemp's 0700 would become Dir's
+		_ = os.Remove(staging)
+		return nil, fmt.Errorf("extract: %w", err)
+	}
+	return &extraction{x: x, staging: staging, log: log, buf: make([]byte, 256<<10)}, nil
+}
+
+// stream starts unpacking the archive in f as it is written: avail reports
+// the length of its written prefix, which reaches total when the download
+// completes. Zip archives wait for finish.
+func (e *extraction) stream(f *os.File, avail func() int64, total int64) {
+	e.start(f, avail, total, func(br *bufio.Reader) error {
+		head, err := br.Peek(512)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		format := archiveFormat(e.x.Format, head)
+		if format == "zip" {
+			return errNotStreamable
+		}
+		return e.unpackTar(br, format)
+	})
+}
+
+// finish completes the extraction from the verified archive f and installs
+// the directory.
+func (e *extraction) finish(f *os.File, overwrite bool) error {
+	if e.started() {
+		err := e.wait()
+		if err == nil {
+			return e.install(overwrite)
+		}
+		if !errors.Is(err, errNotStreamable) {
+			return err
+		}
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("extract: %w", err)
+	}
+	if err := e.unpackFile(f, fi.Size()); err != nil {
+		return err
+	}
+	return e.install(overwrite)
+}
+
+// abort stops a streaming pass and removes the staging directory; a no-op
+// after install.
+func (e *extraction) abort() {
+	e.cancel()
+	_ = os.RemoveAll(e.staging)
+}
+
+// unpackFile unpacks the size-byte archive ra.
+func (e *extraction) unpackFile(ra io.ReaderAt, size int64) error {
+	head := make([]byte, 512)
+	n, err := ra.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("extract: %w", err)
+	}
+	format := archiveFormat(e.x.Format, head[:n])
+	if format != "zip" {
+		return e.unpackTar(io.NewSectionReader(ra, 0, size), format)
+	}
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return fmt.Errorf("extract: %w", err)
+	}
+	return e.unpackZip(zr)
+}
+
+// archiveFormat returns format, or when "" the one head's magic bytes show.
+func archiveFormat(format string, head []byte) string {
+	if format != "" {
+		return format
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "tar.gz"
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return "tar.bz2"
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip"
+	}
+	return "tar" // tar has no reliable magic (v7 archives lack "ustar")
+}
+
+func (e *extraction) unpackTar(r io.Reader, format string) error {
+	switch format {
+	case "tar.gz":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("extract: %w", err)
+		}
+		r = zr
+	case "tar.bz2":
+		r = bzip2.NewReader(r)
+	}
+	root, err := os.OpenRoot(e.staging)
+	if err != nil {
+		return fmt.Errorf("extract: %w", err)
+	}
+	defer root.Close()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("extract: %w", err)
+		}
+		name, err := entryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			continue
+		}
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = root.MkdirAll(name, mode.Perm()|0o700)
+		case tar.TypeReg:
+			err = e.writeEntry(root, name, tr, mode.Perm(), hdr.ModTime)
+		case tar.TypeSymlink:
+			err = symlinkEntry(root, name, hdr.Linkname)
+		case tar.TypeLink:
+			var target string
+			if target, err = entryName(hdr.Linkname); err == nil {
+				err = linkEntry(root, name, target)
+			}
+		default:
+			e.log.Debug("extract: skipping special entry", "name", hdr.Name, "type", hdr.Typeflag)
+		}
+		if err != nil {
+			return fmt.Errorf("extract %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+func (e *extraction) unpackZip(zr *zip.Reader) error {
+	root, err := os.OpenRoot(e.staging)
+	if err != nil {
+		return fmt.Errorf("extract: %w", err)
+	}
+	defer root.Close()
+	for _, f := range zr.File {
+		name, err := entryName(f.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			continue
+		}
+		if err := e.zipEntry(root, name, f); err != nil {
+			return fmt.Errorf("extract %s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func (e *extraction) zipEntry(root *os.Root, name string, f *zip.File) error {
+	mode := f.Mode()
+	if mode.IsDir() {
+		return root.MkdirAll(name, mode.Perm()|0o700)
+	}
+	if mode&fs.ModeType != 0 && mode&fs.ModeSymlink == 0 {
+		e.log.Debug("extract: skipping special entry", "name", f.Name, "mode", mode)
+		return nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if mode&fs.ModeSymlink != 0 {
+		target, err := io.ReadAll(io.LimitReader(rc, 4096))
+		if err != nil {
+			return err
+		}
+		return symlinkEntry(root, name, string(target))
+	}
+	return e.writeEntry(root, name, rc, mode.Perm(), f.Modified)
+}
+
+// entryName turns an archive entry name into a path local to the staging
+// directory; "." for the root itself.
+func entryName(name string) (string, error) {
+	local := filepath.FromSlash(path.Clean(name))
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("extract: entry %q escapes the directory", name)
+	}
+	return local, nil
+}
+
+// writeEntry writes a regular file, replacing an earlier entry of the same
+// name as tar does.
+func (e *extraction) writeEntry(root *os.Root, name string, r io.Reader, perm fs.FileMode, mtime time.Time) error {
+	if err := root.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	if err := root.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	f, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyBuffer(f, r, e.buf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && !mtime.IsZero() {
+		err = root.Chtimes(name, mtime, mtime)
+	}
+	return err
+}
+
+// symlinkEntry creates a symlink whose target stays inside the directory.
+// The target is judged against name's path as written, so name may not
+// lead through a symlink an earlier entry created: a/b -> .. followed by
+// a/b/x -> ../out would otherwise place x, and its target, one level up.
+func symlinkEntry(root *os.Root, name, target string) error {
+	if target == "" || filepath.IsAbs(target) || path.IsAbs(target) ||
+		!filepath.IsLocal(filepath.Join(filepath.Dir(name), filepath.FromSlash(target))) {
+		return fmt.Errorf("symlink target %q escapes the directory", target)
+	}
+	if err := noSymlinkParent(root, name); err != nil {
+		return err
+	}
+	if err := root.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	if err := root.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return root.Symlink(target, name)
+}
+
+// noSymlinkParent fails if a directory leading to name is a symlink.
+// Components that do not exist yet are created as directories later.
+func noSymlinkParent(root *os.Root, name string) error {
+	dir := ""
+	for elem := range strings.SplitSeq(filepath.Dir(name), string(filepath.Separator)) {
+		if elem == "." {
+			break
+		}
+		dir = filepath.Join(dir, elem)
+		fi, err := root.Lstat(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("entry %q leads through symlink %q", name, filepath.ToSlash(dir))
+		}
+	}
+	return nil
+}
+
+func linkEntry(root *os.Root, name, target string) error {
+	if err := root.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	if err := root.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return root.Link(target, name)
+}
+
+// install renames the staging directory to x.Dir. Without overwrite an
+// existing Dir is ErrDestExists (the rename itself can only replace an
+// empty directory created since the check). With overwrite the old tree is
+// moved aside first and removed once the new one is in place.
+func (e *extraction) install(overwrite bool) error {
+	dir := e.x.Dir
+	if _, err := os.Lstat(dir); err == nil {
+		if !overwrite {
+			return fmt.Errorf("%w: %s", ErrDestExists, dir)
+		}
+		old := e.staging + ".old"
+		if err := os.Rename(dir, old); err != nil {
+			return fmt.Errorf("extract: move aside %s: %w", dir, err)
+		}
+		if err := os.Rename(e.staging, dir); err != nil {
+			_ = os.Rename(old, dir)
+			return fmt.Errorf("extract: rename %s -> %s: %w", e.staging, dir, err)
+		}
+		if err := os.RemoveAll(old); err != nil {
+			e.log.Debug("removing replaced extraction failed", "path", old, "err", err)
+		}
+		return nil
+	}
+	if err := os.Rename(e.staging, dir); err != nil {
+		if _, serr := os.Lstat(dir); serr == nil {
+			return fmt.Errorf("%w: %s", ErrDestExists, dir)
+		}
+		return fmt.Errorf("extract: rename %s -> %s: %w", e.staging, dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package download
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarEntry is a tar header with, for regular files, its body.
+type tarEntry struct {
+	tar.Header
+	body string
+}
+
+func makeTar(t *testing.T, gz bool, entries ...tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var tw *tar.Writer
+	var zw *gzip.Writer
+	if gz {
+		zw = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(zw)
+	} else {
+		tw = tar.NewWriter(&buf)
+	}
+	for _, e := range entries {
+		if e.Mode == 0 {
+			e.Mode = 0o644
+		}
+		e.Size = int64(len(e.body))
+		if err := tw.WriteHeader(&e.Header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func tarFile(name, body string) tarEntry {
+	return tarEntry{tar.Header{Name: name, Typeflag: tar.TypeReg}, body}
+}
+
+func tarSymlink(name, target string) tarEntry {
+	return tarEntry{tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target}, ""}
+}
+
+// assertOnly fails unless dir holds exactly the named entries.
+func assertOnly(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, e := range entries {
+		have = append(have, e.Name())
+	}
+	if strings.Join(have, ",") != strings.Join(names, ",") {
+		t.Errorf("%s holds %q, want %q", dir, have, names)
+	}
+}
+
+// TestExtractTarGz: a multipart tar.gz is unpacked (while downloading) into
+// Dir, and the archive is discarded.
+func TestExtractTarGz(t *testing.T) {
+	t.Parallel()
+	big := string(testData(300 << 10))
+	archive := makeTar(t, true,
+		tarEntry{tar.Header{Name: "./pkg/", Typeflag: tar.TypeDir, Mode: 0o755}, ""},
+		tarFile("pkg/bin/tool", big),
+		tarFile("pkg/README", "hello\n"),
+		tarSymlink("pkg/current", "bin/tool"),
+		tarEntry{tar.Header{Name: "pkg/tool.hard", Typeflag: tar.TypeLink, Linkname: "pkg/bin/tool"}, ""},
+	)
+	var st stats
+	srv := httptest.NewServer(rangeHandler(archive, `"v1"`, &st))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{Parts: 4, MinPartSize: 4 << 10})
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "out")
+
+	res, err := d.Do(t.Context(), &Request{URL: srv.URL + "/pkg.tar.gz", Dest: filepath.Join(parent, "pkg.tar.gz"),
+		Extract: &Extract{Dir: dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Extracted != dir || res.Path != "" {
+		t.Errorf("Extracted, Path = %q, %q; want %q and no archive", res.Extracted, res.Path, dir)
+	}
+	assertFile(t, filepath.Join(dir, "pkg/bin/tool"), []byte(big))
+	assertFile(t, filepath.Join(dir, "pkg/current"), []byte(big))
+	assertFile(t, filepath.Join(dir, "pkg/tool.hard"), []byte(big))
+	assertFile(t, filepath.Join(dir, "pkg/README"), []byte("hello\n"))
+	assertOnly(t, parent, "out")
+}
+
+// TestExtractZipKeep: a zip is unpacked after the download, and Keep
+// installs the archive too.
+func TestExtractZipKeep(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, body := range map[string]string{"a.txt": "alpha", "sub/b.txt": "beta"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write([]byte(body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+	var st stats
+	srv := httptest.NewServer(rangeHandler(archive, `"v1"`, &st))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{Parts: 2, MinPartSize: 256})
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "x")
+
+	res, err := d.Do(t.Context(), &Request{URL: srv.URL + "/a.zip", Dest: parent,
+		Extract: &Extract{Dir: dir, Keep: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, res.Path, archive)
+	assertFile(t, filepath.Join(dir, "a.txt"), []byte("alpha"))
+	assertFile(t, filepath.Join(dir, "sub/b.txt"), []byte("beta"))
+	assertOnly(t, parent, "a.zip", "x")
+}
+
+// TestExtractRejectsEscapes: entries and symlinks reaching outside Dir fail
+// the download and leave nothing behind.
+func TestExtractRejectsEscapes(t *testing.T) {
+	t.Parallel()
+	for name, entries := range map[string][]tarEntry{
+		"dotdot":        {tarFile("ok", "x"), tarFile("../evil", "x")},
+		"absolute":      {tarFile("/tmp/evil", "x")},
+		"abs symlink":   {tarSymlink("etc", "/etc")},
+		"up symlink":    {tarSymlink("up", "../..")},
+		"through links": {tarSymlink("a", "."), tarSymlink("b", "a/../c"), tarFile("b/evil", "x")},
+		"link parent":   {tarSymlink("a/b", ".."), tarSymlink("a/b/x", "../outside")},
+		"hard link":     {tarEntry{tar.Header{Name: "h", Typeflag: tar.TypeLink, Linkname: "../x"}, ""}},
+	} {
+		archive := makeTar(t, false, entries...)
+		var st stats
+		srv := httptest.NewServer(rangeHandler(archive, `"v1"`, &st))
+		parent := t.TempDir()
+		if err := os.Mkdir(filepath.Join(parent, "sub"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		d := newDL(t, &Options{Parts: 2, MinPartSize: 512})
+		_, err := d.Do(t.Context(), &Request{URL: srv.URL + "/a.tar", Dest: filepath.Join(parent, "a.tar"),
+			Extract: &Extract{Dir: filepath.Join(parent, "sub", "out")}})
+		srv.Close()
+		if err == nil {
+			t.Errorf("%s: extracted", name)
+		}
+		if _, err := os.Lstat(filepath.Join(parent, "sub", "out")); err == nil {
+			t.Errorf("%s: Dir created", name)
+		}
+		if _, err := os.Lstat(filepath.Join(parent, "c")); err == nil {
+			t.Errorf("%s: wrote outside the staging directory", name)
+		}
+		assertOnly(t, filepath.Join(parent, "sub"))
+	}
+}
+
+// TestExtractExistingDir: an existing Dir is refused before any download,
+// and replaced whole with Overwrite.
+func TestExtractExistingDir(t *testing.T) {
+	t.Parallel()
+	archive := makeTar(t, false, tarFile("new", "n"))
+	var st stats
+	srv := httptest.NewServer(rangeHandler(archive, `"v1"`, &st))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{})
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "out")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "old"), []byte("o"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &Request{URL: srv.URL + "/a.tar", Dest: filepath.Join(parent, "a.tar"), Extract: &Extract{Dir: dir}}
+	if _, err := d.Do(t.Context(), req); !errors.Is(err, ErrDestExists) {
+		t.Fatalf("err = %v, want ErrDestExists", err)
+	}
+	if n := len(st.rangeHeaders()); n != 1 {
+		t.Errorf("server saw %d requests, want only the initial one", n)
+	}
+	req.Overwrite = true
+	if _, err := d.Do(t.Context(), req); err != nil {
+		t.Fatal(err)
+	}
+	assertOnly(t, dir, "new")
+	assertOnly(t, parent, "out")
+
+	req.Extract = &Extract{Dir: dir, Format: "rar"}
+	if _, err := d.Do(t.Context(), req); err == nil || !strings.Contains(err.Error(), "Extract.Format") {
+		t.Errorf("unknown format: err = %v", err)
+	}
+}
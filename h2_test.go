@@ -0,0 +1,85 @@
+package download
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// connRecorder wraps h and records each request's protocol and client
+// connection (remote address).
+type connRecorder struct {
+	h      http.Handler
+	mu     sync.Mutex
+	protos map[string]int
+	conns  map[string]struct{}
+}
+
+func (cr *connRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cr.mu.Lock()
+	cr.protos[r.Proto]++
+	cr.conns[r.RemoteAddr] = struct{}{}
+	cr.mu.Unlock()
+	cr.h.ServeHTTP(w, r)
+}
+
+func newH2Server(t *testing.T, data []byte) (*httptest.Server, *connRecorder, *tls.Config) {
+	t.Helper()
+	var st stats
+	cr := &connRecorder{
+		h:      rangeHandler(data, `"v1"`, &st),
+		protos: make(map[string]int),
+		conns:  make(map[string]struct{}),
+	}
+	srv := httptest.NewUnstartedServer(cr)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	return srv, cr, &tls.Config{RootCAs: roots}
+}
+
+// TestHTTP2OneConnectionPerFlow: in HTTP/2 mode every ranged flow must ride
+// its own TCP connection, not multiplex onto the election's.
+func TestHTTP2OneConnectionPerFlow(t *testing.T) {
+	t.Parallel()
+	data := testData(256 << 10)
+	srv, cr, tlsConf := newH2Server(t, data)
+
+	d := newDL(t, &Options{
+		Parts: 4, MinParts: 4, MinPartSize: 16 << 10,
+		HTTP2: true, TLSConfig: tlsConf,
+	})
+	_, got := mustGet(t, d, srv.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.protos["HTTP/2.0"] == 0 || cr.protos["HTTP/1.1"] != 0 {
+		t.Fatalf("request protocols = %v, want HTTP/2.0 only", cr.protos)
+	}
+	// The election plus three eager siblings: four requests, four conns.
+	if len(cr.conns) < 4 {
+		t.Fatalf("%d connections served %d h2 requests, want one per flow",
+			len(cr.conns), cr.protos["HTTP/2.0"])
+	}
+}
+
+func TestHTTP1RemainsDefault(t *testing.T) {
+	t.Parallel()
+	data := testData(32 << 10)
+	srv, cr, tlsConf := newH2Server(t, data)
+
+	d := newDL(t, &Options{TLSConfig: tlsConf})
+	mustGet(t, d, srv.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.protos["HTTP/2.0"] != 0 {
+		t.Fatalf("request protocols = %v, want HTTP/1.1 without Options.HTTP2", cr.protos)
+	}
+}
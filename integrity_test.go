@@ -323,11 +323,11 @@ func TestRetryableResponseBodiesCloseOnce(t *testing.T) {
 					Body:       body,
 				}, nil
 			})})
-			r := &run{
+			r := defaultRun(t, &run{
 				d: d, rep: NopReporter{}, url: "http://example.test/file.bin",
 				sourceURL: &url.URL{Scheme: "http", Host: "example.test"},
 				total:     1, etag: `"v1"`,
-			}
+			})
 			w := newWorker(0, r, nil, nil)
 			var err error
 			if ranged {
@@ -444,7 +444,7 @@ func TestFinalNoOverwriteIsAtomic(t *testing.T) {
 		t.Fatal(err)
 	}
 	d := newDL(t, nil)
-	r := &run{d: d, rep: NopReporter{}, destPath: dest, partPath: part, total: int64(len(newData))}
+	r := defaultRun(t, &run{d: d, rep: NopReporter{}, destPath: dest, partPath: part, total: int64(len(newData))})
 	if _, err := r.verifyAndFinalize(file, false); !errors.Is(err, ErrDestExists) {
 		t.Fatalf("finalization error = %v, want ErrDestExists", err)
 	}
@@ -675,7 +675,7 @@ func TestAdaptiveTimeoutNeverDropsConfiguredBase(t *testing.T) {
 	t.Parallel()
 	const base = 2 * time.Minute
 	d := newDL(t, &Options{Timeout: base})
-	w := newWorker(0, &run{d: d, rep: NopReporter{}}, nil, nil)
+	w := newWorker(0, defaultRun(t, &run{d: d, rep: NopReporter{}}), nil, nil)
 	w.bumpTimeout()
 	if w.timeout != base {
 		t.Errorf("bumpTimeout reduced configured base: got %v, want %v", w.timeout, base)
@@ -688,7 +688,7 @@ func TestAdaptiveTimeoutNeverDropsConfiguredBase(t *testing.T) {
 
 	const huge = time.Duration(1<<63 - 1)
 	hugeDownloader := newDL(t, &Options{Timeout: huge})
-	hugeWorker := newWorker(0, &run{d: hugeDownloader, rep: NopReporter{}}, nil, nil)
+	hugeWorker := newWorker(0, defaultRun(t, &run{d: hugeDownloader, rep: NopReporter{}}), nil, nil)
 	hugeWorker.bumpTimeout()
 	if hugeWorker.timeout != huge {
 		t.Errorf("bumpTimeout overflowed configured base: got %v, want %v", hugeWorker.timeout, huge)
@@ -0,0 +1,96 @@
+package download
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestLocalAddrsValidation(t *testing.T) {
+	t.Parallel()
+	lo2 := netip.MustParseAddr("127.0.0.2")
+	for _, tc := range []struct {
+		name  string
+		opt   Options
+		valid bool
+	}{
+		{name: "two paths", opt: Options{LocalAddrs: []netip.Addr{lo2, netip.MustParseAddr("127.0.0.3")}}, valid: true},
+		{name: "zero addr", opt: Options{LocalAddrs: []netip.Addr{{}}}},
+		{name: "unspecified", opt: Options{LocalAddrs: []netip.Addr{netip.IPv4Unspecified()}}},
+		{name: "duplicate", opt: Options{LocalAddrs: []netip.Addr{lo2, lo2}}},
+		{name: "more paths than parts", opt: Options{Parts: 1, LocalAddrs: []netip.Addr{
+			lo2, netip.MustParseAddr("127.0.0.3")}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := New(&tc.opt)
+			if (err == nil) != tc.valid {
+				t.Fatalf("New error = %v, want valid=%t", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestShareOf(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct{ n, pools, want0, want1, want2 int }{
+		{8, 3, 3, 3, 2},
+		{2, 3, 1, 1, 0},
+		{0, 3, 0, 0, 0},
+	} {
+		got := []int{shareOf(tc.n, 0, tc.pools), shareOf(tc.n, 1, tc.pools), shareOf(tc.n, 2, tc.pools)}
+		if got[0] != tc.want0 || got[1] != tc.want1 || got[2] != tc.want2 {
+			t.Errorf("shareOf(%d, *, %d) = %v, want [%d %d %d]",
+				tc.n, tc.pools, got, tc.want0, tc.want1, tc.want2)
+		}
+	}
+}
+
+// TestLocalAddrsSpreadAcrossSourcePaths binds two loopback source addresses
+// and checks that ranged workers arrive from both. Linux routes all of
+// 127/8 to lo; other platforms configure only 127.0.0.1.
+func TestLocalAddrsSpreadAcrossSourcePaths(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS != "linux" {
+		t.Skip("127.0.0.x source addresses beyond .1 need Linux loopback routing")
+	}
+	data := testData(256 << 10)
+	var st stats
+	var mu sync.Mutex
+	sources := make(map[string]int)
+	h := rangeHandler(data, `"v1"`, &st)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		mu.Lock()
+		sources[host]++
+		mu.Unlock()
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	d := newDL(t, &Options{
+		Parts: 4, MinParts: 4, MinPartSize: 16 << 10,
+		LocalAddrs: []netip.Addr{netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.3")},
+	})
+	dest := filepath.Join(t.TempDir(), "file.bin")
+	_, got := mustGet(t, d, srv.URL+"/file.bin", dest)
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if sources["127.0.0.2"] == 0 || sources["127.0.0.3"] == 0 {
+		t.Fatalf("requests by source address = %v, want both 127.0.0.2 and 127.0.0.3", sources)
+	}
+	for src := range sources {
+		if src != "127.0.0.2" && src != "127.0.0.3" {
+			t.Fatalf("request from unbound source %s", src)
+		}
+	}
+}
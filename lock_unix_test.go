@@ -60,7 +60,7 @@ func TestInstallHoldsLockThroughRename(t *testing.T) {
 	}
 
 	d := newDL(t, nil)
-	r := &run{d: d, rep: NopReporter{}, destPath: dest, partPath: part, total: int64(len(data))}
+	r := defaultRun(t, &run{d: d, rep: NopReporter{}, destPath: dest, partPath: part, total: int64(len(data))})
 	res, err := r.verifyAndFinalize(file, false)
 	if err != nil {
 		t.Fatal(err)
@@ -0,0 +1,66 @@
+package download
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// md4Sum returns the MD4 digest (RFC 1320) of b. zsync control files use
+// MD4 for their per-block strong checksums; it is not used for security,
+// and the whole file is still verified with SHA-1 or SHA-256.
+func md4Sum(b []byte) [16]byte {
+	s := [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	n := len(b)
+	for len(b) >= 64 {
+		md4Block(&s, b[:64])
+		b = b[64:]
+	}
+	var tail [128]byte
+	k := copy(tail[:], b)
+	tail[k] = 0x80
+	end := 64
+	if k >= 56 {
+		end = 128
+	}
+	binary.LittleEndian.PutUint64(tail[end-8:], uint64(n)<<3)
+	for p := 0; p < end; p += 64 {
+		md4Block(&s, tail[p:p+64])
+	}
+	var sum [16]byte
+	for i, v := range s {
+		binary.LittleEndian.PutUint32(sum[4*i:], v)
+	}
+	return sum
+}
+
+var (
+	md4Shift1 = [4]int{3, 7, 11, 19}
+	md4Shift2 = [4]int{3, 5, 9, 13}
+	md4Shift3 = [4]int{3, 9, 11, 15}
+	md4Order3 = [16]int{0, 8, 4, 12, 2, 10, 6, 14, 1, 9, 5, 13, 3, 11, 7, 15}
+)
+
+func md4Block(s *[4]uint32, p []byte) {
+	var x [16]uint32
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(p[4*i:])
+	}
+	a, b, c, d := s[0], s[1], s[2], s[3]
+	for i := range 16 {
+		f := a + (b&c | ^b&d) + x[i]
+		a, b, c, d = d, bits.RotateLeft32(f, md4Shift1[i%4]), b, c
+	}
+	for i := range 16 {
+		j := i/4 + i%4*4
+		f := a + (b&c | b&d | c&d) + x[j] + 0x5a827999
+		a, b, c, d = d, bits.RotateLeft32(f, md4Shift2[i%4]), b, c
+	}
+	for i := range 16 {
+		f := a + (b ^ c ^ d) + x[md4Order3[i]] + 0x6ed9eba1
+		a, b, c, d = d, bits.RotateLeft32(f, md4Shift3[i%4]), b, c
+	}
+	s[0] += a
+	s[1] += b
+	s[2] += c
+	s[3] += d
+}
@@ -0,0 +1,66 @@
+package download
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Extended attributes PreserveMetadata writes, named as wget and curl
+// --xattr name them (ETag has no common name).
+const (
+	xattrOriginURL = "user.xdg.origin.url"
+	xattrMimeType  = "user.mime_type"
+	xattrETag      = "user.etag"
+)
+
+// fileMeta is what PreserveMetadata records on an installed file.
+type fileMeta struct {
+	origin      string // redacted
+	etag        string
+	lastMod     string
+	contentType string
+}
+
+// preserve applies Options.FileMode and, with PreserveMetadata, m to path.
+// Only the mode is required to succeed: a filesystem without extended
+// attributes, or an unparseable Last-Modified, costs the metadata alone.
+func (d *Downloader) preserve(path string, m fileMeta, log *slog.Logger) error {
+	if d.opt.FileMode != 0 {
+		if err := os.Chmod(path, d.opt.FileMode); err != nil {
+			return fmt.Errorf("chmod %s: %w", path, err)
+		}
+	}
+	if !d.opt.PreserveMetadata {
+		return nil
+	}
+	if m.lastMod != "" {
+		if t, err := http.ParseTime(m.lastMod); err != nil {
+			log.Debug("ignoring unparseable Last-Modified", "value", m.lastMod)
+		} else if err := os.Chtimes(path, time.Time{}, t); err != nil {
+			log.Debug("setting mtime failed", "path", path, "err", err)
+		}
+	}
+	for _, a := range [...]struct{ name, value string }{
+		{xattrOriginURL, m.origin},
+		{xattrETag, m.etag},
+		{xattrMimeType, m.contentType},
+	} {
+		if a.value == "" {
+			continue
+		}
+		if err := setXattr(path, a.name, a.value); err != nil {
+			log.Debug("setting extended attribute failed", "path", path, "name", a.name, "err", err)
+			break // the filesystem (or platform) is unlikely to take the next one
+		}
+	}
+	return nil
+}
+
+// meta returns what PreserveMetadata records for r's download.
+func (r *run) meta() fileMeta {
+	return fileMeta{origin: redactURL(r.sourceURL.String()), etag: r.etag, lastMod: r.lastMod,
+		contentType: r.contentType}
+}
@@ -0,0 +1,86 @@
+package download
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// TestPreserveMetadata: installed files take Last-Modified as their mtime
+// and FileMode as their permissions, in parts or as a single stream.
+func TestPreserveMetadata(t *testing.T) {
+	t.Parallel()
+	data := testData(128 << 10)
+	var st, plain stats
+	parts := httptest.NewServer(rangeHandler(data, `"v1"`, &st))
+	t.Cleanup(parts.Close)
+	single := httptest.NewServer(plainHandler(data, &plain))
+	t.Cleanup(single.Close)
+	d := newDL(t, &Options{Parts: 2, MinPartSize: 16 << 10, PreserveMetadata: true, FileMode: 0o755})
+	dir := t.TempDir()
+
+	res, err := d.Do(t.Context(), &Request{URL: parts.URL + "/tool", Dest: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, res.Path, data)
+	fi, err := os.Stat(res.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(testModTime) {
+		t.Errorf("mtime = %v, want Last-Modified %v", fi.ModTime(), testModTime)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0o755 {
+		t.Errorf("mode = %v, want 0755", fi.Mode().Perm())
+	}
+
+	// No Last-Modified: the mtime is the download's.
+	res, err = d.Do(t.Context(), &Request{URL: single.URL + "/plain", Dest: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err = os.Stat(res.Path); err != nil {
+		t.Fatal(err)
+	}
+	if fi.ModTime().Equal(testModTime) || (runtime.GOOS != "windows" && fi.Mode().Perm() != 0o755) {
+		t.Errorf("mtime, mode = %v, %v", fi.ModTime(), fi.Mode().Perm())
+	}
+	assertOnly(t, dir, "plain", "tool")
+
+	if _, err := New(&Options{FileMode: os.ModeSetuid | 0o755}); err == nil {
+		t.Error("New accepted a FileMode beyond permission bits")
+	}
+}
+
+// TestPreserveMetadataStored: a copy materialized from CacheDir gets the
+// metadata too, unless it is a hard link to the store.
+func TestPreserveMetadataStored(t *testing.T) {
+	t.Parallel()
+	data := testData(64 << 10)
+	var st stats
+	srv := httptest.NewServer(rangeHandler(data, `"v1"`, &st))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{PreserveMetadata: true, FileMode: 0o700, CacheDir: t.TempDir()})
+
+	if _, err := d.Do(t.Context(), &Request{URL: srv.URL + "/a", Dest: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := d.Do(t.Context(), &Request{URL: srv.URL + "/a", Dest: filepath.Join(t.TempDir(), "b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Materialized == "" {
+		t.Fatal("not served from the cache dir")
+	}
+	fi, err := os.Stat(res.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Materialized == "hardlink" || !fi.ModTime().Equal(testModTime) ||
+		(runtime.GOOS != "windows" && fi.Mode().Perm() != 0o700) {
+		t.Errorf("%s: mtime, mode = %v, %v", res.Materialized, fi.ModTime(), fi.Mode().Perm())
+	}
+}
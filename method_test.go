@@ -0,0 +1,207 @@
+package download
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const exportQuery = `{"query":"all","format":"csv"}`
+
+func exportBody() (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(exportQuery)), nil
+}
+
+// exportHandler serves data to POSTs carrying exportQuery through h, and
+// counts the requests that arrive without it.
+func exportHandler(h http.Handler, bad *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || string(body) != exportQuery ||
+			r.ContentLength != int64(len(exportQuery)) {
+			bad.Add(1)
+			http.Error(w, "want the export query", http.StatusBadRequest)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// TestDoPostBodyReplayed: every part of a multipart POST resends the body.
+func TestDoPostBodyReplayed(t *testing.T) {
+	t.Parallel()
+	data := testData(256 << 10)
+	var st stats
+	var bad atomic.Int32
+	srv := httptest.NewServer(exportHandler(rangeHandler(data, `"v1"`, &st), &bad))
+	t.Cleanup(srv.Close)
+
+	d := newDL(t, &Options{MinPartSize: 16 << 10})
+	res, err := d.Do(t.Context(), &Request{
+		URL: srv.URL + "/export", Dest: filepath.Join(t.TempDir(), "export.csv"),
+		Parts: 4, MinParts: 4, Method: http.MethodPost, Body: exportBody,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, res.Path, data)
+	if n := bad.Load(); n != 0 {
+		t.Errorf("%d requests arrived without the method and body", n)
+	}
+	if n := len(st.rangeHeaders()); n < 4 {
+		t.Errorf("served %d requests, want every part", n)
+	}
+}
+
+// TestDoPostRangeIgnored: a server answering a ranged POST with 200 gets
+// one single-stream request.
+func TestDoPostRangeIgnored(t *testing.T) {
+	t.Parallel()
+	data := testData(128 << 10)
+	var hits, bad atomic.Int32
+	srv := httptest.NewServer(exportHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(data)
+	}), &bad))
+	t.Cleanup(srv.Close)
+
+	d := newDL(t, &Options{Parts: 4, MinPartSize: 16 << 10})
+	res, err := d.Do(t.Context(), &Request{
+		URL: srv.URL + "/export", Dest: filepath.Join(t.TempDir(), "export.csv"),
+		Method: http.MethodPost, Body: exportBody,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, res.Path, data)
+	if n := hits.Load(); n != 1 || bad.Load() != 0 {
+		t.Errorf("server saw %d exports (%d bad), want one single-stream request", n, bad.Load())
+	}
+}
+
+// TestDoPostSeeOther: after a 303 the parts GET the result without the body.
+func TestDoPostSeeOther(t *testing.T) {
+	t.Parallel()
+	data := testData(256 << 10)
+	var st stats
+	var bad, posts atomic.Int32
+	var mu sync.Mutex
+	var methods []string
+	mux := http.NewServeMux()
+	mux.Handle("/export", exportHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		http.Redirect(w, r, "/result.csv", http.StatusSeeOther)
+	}), &bad))
+	mux.Handle("/result.csv", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+		if r.ContentLength > 0 {
+			bad.Add(1)
+		}
+		rangeHandler(data, `"v1"`, &st).ServeHTTP(w, r)
+	}))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	d := newDL(t, &Options{MinPartSize: 16 << 10})
+	res, err := d.Do(t.Context(), &Request{
+		URL: srv.URL + "/export", Dest: filepath.Join(t.TempDir(), "export.csv"),
+		Parts: 4, MinParts: 4, Method: http.MethodPost, Body: exportBody,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, res.Path, data)
+	if n := posts.Load(); n != 1 || bad.Load() != 0 {
+		t.Errorf("export saw %d posts (%d bad), want only the initial one", n, bad.Load())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(methods) < 4 || strings.Count(strings.Join(methods, " "), http.MethodGet) != len(methods) {
+		t.Errorf("result requests = %q, want every part as GET", methods)
+	}
+}
+
+// TestDoPostResumeBoundToBody: resume state is only reused for the same
+// method and body.
+func TestDoPostResumeBoundToBody(t *testing.T) {
+	t.Parallel()
+	data := testData(128 << 10)
+	var st stats
+	var bad atomic.Int32
+	srv := httptest.NewServer(exportHandler(rangeHandler(data, `"shared"`, &st), &bad))
+	t.Cleanup(srv.Close)
+	source := srv.URL + "/export"
+	u, err := url.Parse(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(exportQuery))
+	if requestIdentity(u, http.MethodGet, "") != sourceIdentity(u) ||
+		requestIdentity(u, http.MethodPost, "") == sourceIdentity(u) {
+		t.Fatal("requestIdentity must only differ from sourceIdentity for a method or body")
+	}
+
+	d := newDL(t, &Options{Parts: 1, MinPartSize: 4 << 10})
+	for _, tc := range []struct {
+		name   string
+		id     string
+		resume bool
+	}{
+		{"plain GET state", sourceIdentity(u), false},
+		{"same body", requestIdentity(u, http.MethodPost, hex.EncodeToString(sum[:])), true},
+	} {
+		dest := filepath.Join(t.TempDir(), "export.csv")
+		writePartialState(t, dest, source, data)
+		state := loadState(statePath(dest + ".part"))
+		state.SourceID = tc.id
+		if err := state.save(statePath(dest + ".part")); err != nil {
+			t.Fatal(err)
+		}
+		res, err := d.Do(t.Context(), &Request{URL: source, Dest: dest, Method: http.MethodPost, Body: exportBody})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if res.Resumed != tc.resume {
+			t.Errorf("%s: Resumed = %v, want %v", tc.name, res.Resumed, tc.resume)
+		}
+		assertFile(t, dest, data)
+	}
+}
+
+func TestDoInvalidMethod(t *testing.T) {
+	t.Parallel()
+	d := newDL(t, &Options{})
+	dest := filepath.Join(t.TempDir(), "out")
+	_, err := d.Do(t.Context(), &Request{URL: "http://127.0.0.1:1/x", Dest: dest, Method: http.MethodHead})
+	if err == nil || !strings.Contains(err.Error(), "invalid Request.Method") {
+		t.Errorf("HEAD: err = %v, want an invalid Request.Method error", err)
+	}
+	_, err = d.Do(t.Context(), &Request{URL: "oci://example.com/lib/app:v1", Dest: dest, Body: exportBody})
+	if err == nil || !strings.Contains(err.Error(), "fetched with GET") {
+		t.Errorf("oci: err = %v, want a method error", err)
+	}
+}
+
+func assertFile(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s differs from source", path)
+	}
+}
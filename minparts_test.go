@@ -325,7 +325,7 @@ func newElectionHarness(t *testing.T, size int) *electionHarness {
 	t.Cleanup(srv.Close)
 	d := newDL(t, &Options{Parts: 2, MinPartSize: 1 << 10})
 	h := newRetireHarness(t, d, srv.URL, int64(len(data)))
-	resp, addr, cancel, err := d.elect(t.Context(), srv.URL+"/file.bin")
+	resp, addr, cancel, err := d.elect(t.Context(), srv.URL+"/file.bin", nil, &resolvedRequest{method: http.MethodGet})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1,51 +1,186 @@
 package download
 
 import (
+	"cmp"
 	"fmt"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
-	"regexp"
+	"runtime"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
-// https://regex101.com/r/N4AovD/3
-var reContentDisposition = regexp.MustCompile(`filename[^;\n=]*=(['"](.*?)['"]|[^;\n]*)`)
-
 // parseContentDisposition extracts a filename from a Content-Disposition
-// header value, handling quoted values and RFC 5987 extended encoding. Only
-// the RFC 5987 form is percent-encoded; plain and quoted filenames are
-// returned verbatim.
+// header value (RFC 6266). An RFC 5987 filename* (UTF-8 or ISO-8859-1,
+// percent-encoded) takes precedence over filename wherever it appears; a
+// plain filename is a token or a quoted string, returned unescaped but
+// otherwise verbatim. Single quotes around a plain value are stripped, as
+// some servers send them.
 func parseContentDisposition(input string) string {
-	group := reContentDisposition.FindStringSubmatch(input)
-	if len(group) != 3 {
+	var plain, ext string
+	for _, param := range splitParams(input) {
+		key, value, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "filename":
+			plain = unquoteParam(strings.TrimSpace(value))
+		case "filename*":
+			if v, ok := decodeExtValue(strings.TrimSpace(value)); ok {
+				ext = v
+			}
+		}
+	}
+	return cmp.Or(ext, plain)
+}
+
+// splitParams splits a header value at the ';' outside quoted strings.
+func splitParams(s string) []string {
+	var params []string
+	quoted, escaped, start := false, false, 0
+	for i := range len(s) {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ';' && !quoted:
+			params = append(params, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(params, s[start:])
+}
+
+// unquoteParam returns a parameter value without its quotes: a quoted
+// string with its backslash escapes resolved, or a single-quoted or bare
+// value as is.
+func unquoteParam(v string) string {
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		var b strings.Builder
+		escaped := false
+		for _, c := range []byte(v[1 : len(v)-1]) {
+			if c == '\\' && !escaped {
+				escaped = true
+				continue
+			}
+			escaped = false
+			b.WriteByte(c)
+		}
+		return b.String()
+	}
+	if len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'' {
+		return v[1 : len(v)-1]
+	}
+	return v
+}
+
+// decodeExtValue decodes an RFC 5987 ext-value, charset'language'pct-value.
+// Only the UTF-8 and ISO-8859-1 charsets RFC 5987 requires are understood.
+func decodeExtValue(v string) (string, bool) {
+	charset, rest, ok := strings.Cut(unquoteParam(v), "'")
+	if !ok {
+		return "", false
+	}
+	_, encoded, ok := strings.Cut(rest, "'")
+	if !ok {
+		return "", false
+	}
+	raw, err := url.PathUnescape(encoded)
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(charset) {
+	case "utf-8":
+		if !utf8.ValidString(raw) {
+			return "", false
+		}
+		return raw, true
+	case "iso-8859-1":
+		r := make([]rune, len(raw))
+		for i := range len(raw) {
+			r[i] = rune(raw[i]) // Latin-1 bytes are the first 256 code points
+		}
+		return string(r), true
+	}
+	return "", false
+}
+
+// maxNameLen caps derived names in bytes: NAME_MAX on common filesystems.
+const maxNameLen = 255
+
+// sanitizeName makes a name taken from a response safe to create in a
+// directory: the last path element only, without control characters or
+// Unicode direction overrides (which disguise an extension), without
+// leading dots (hidden or relative names) and trailing dots and spaces
+// (stripped by Windows), not a Windows device name, and at most maxNameLen
+// bytes, keeping a short extension. It returns "" when nothing is left.
+func sanitizeName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r), unicode.Is(unicode.Bidi_Control, r):
+			return -1
+		case runtime.GOOS == "windows" && strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, strings.ToValidUTF8(name, ""))
+	name = strings.TrimRight(strings.TrimLeft(name, ". "), ". ")
+	if name == "" {
 		return ""
 	}
-	if group[2] != "" {
-		return group[2]
+	stem, _, _ := strings.Cut(name, ".")
+	if isReservedName(strings.TrimRight(stem, " ")) {
+		name = "_" + name
 	}
-	b, a, found := strings.Cut(group[1], "''")
-	if found && strings.EqualFold(b, "utf-8") {
-		decoded, err := url.PathUnescape(a)
-		if err != nil {
-			return ""
+	if len(name) > maxNameLen {
+		ext := path.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		stem := name[:maxNameLen-len(ext)]
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
 		}
-		return decoded
+		name = stem + ext
 	}
-	if b != `""` {
-		return b
+	return name
+}
+
+// isReservedName reports whether stem is a Windows device name, which
+// names the device rather than a file whatever its extension.
+func isReservedName(stem string) bool {
+	switch s := strings.ToUpper(stem); s {
+	case "CON", "PRN", "AUX", "NUL", "CONIN$", "CONOUT$":
+		return true
+	default:
+		return len(s) == 4 && (strings.HasPrefix(s, "COM") || strings.HasPrefix(s, "LPT")) &&
+			s[3] >= '0' && s[3] <= '9'
 	}
-	return ""
 }
 
 // deriveName resolves the output filename from the final response location
 // and headers: Content-Disposition wins, then the URL path base. u.Path is
 // already percent-decoded by url.Parse, so no further decoding happens (a
-// second pass would corrupt names containing '+' or literal '%').
+// second pass would corrupt names containing '+' or literal '%'). Names are
+// sanitized. A URL naming no file (a bare host, "/") is named "download",
+// and only that generic name takes an extension from Content-Type when the
+// type has one (e.g. "/" or "/download" serving a zip is download.zip);
+// other names, such as kubectl or LICENSE, are kept as they are.
 func deriveName(location string, header http.Header) (string, error) {
-	if name := parseContentDisposition(header.Get("Content-Disposition")); name != "" {
-		return filepath.Base(name), nil
+	if name := sanitizeName(parseContentDisposition(header.Get("Content-Disposition"))); name != "" {
+		return name, nil
 	}
 	u, err := parseURL(location)
 	if err != nil {
@@ -55,10 +190,35 @@ func deriveName(location string, header http.Header) (string, error) {
 	if name == "" {
 		name = u.Opaque
 	}
-	if base := filepath.Base(name); base != "." && base != string(filepath.Separator) && base != "/" {
-		return base, nil
+	name = cmp.Or(sanitizeName(name), "download")
+	if name != "download" {
+		return name, nil
 	}
-	return "", nil
+	return name + typeExtension(header.Get("Content-Type")), nil
+}
+
+// preferredExtensions breaks ties where a type has several extensions.
+var preferredExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"text/html":  ".html",
+	"text/plain": ".txt",
+}
+
+// typeExtension returns the extension for a Content-Type, or "" for none
+// or one that says nothing about the content.
+func typeExtension(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/octet-stream" {
+		return ""
+	}
+	if ext, ok := preferredExtensions[mediaType]; ok {
+		return ext
+	}
+	exts, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(exts) == 0 {
+		return ""
+	}
+	return exts[0]
 }
 
 // resolveDest turns the user-supplied dest into a concrete file path.
@@ -77,9 +237,5 @@ func resolveDest(dest, location string, header http.Header) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	if name == "" {
-		return "", fmt.Errorf("cannot derive filename from %q: pass an explicit file path",
-			redactURL(location))
-	}
 	return filepath.Join(dir, name), nil
 }
@@ -3,7 +3,9 @@ package download
 import (
 	"net/http"
 	"path/filepath"
+	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestParseContentDisposition(t *testing.T) {
@@ -23,6 +25,13 @@ func TestParseContentDisposition(t *testing.T) {
 		{input: "attachment; filename='content.txt'", output: "content.txt"},
 		{input: `attachment; filename="content.txt"`, output: "content.txt"},
 		{input: "attachment; filename*=UTF-8''content.txt", output: "content.txt"},
+		{input: `attachment; filename*=UTF-8''%E2%82%AC.txt; filename="EUR.txt"`, output: "€.txt"},
+		{input: `attachment; filename="EUR.txt"; filename*=utf-8'en'%E2%82%AC.txt`, output: "€.txt"},
+		{input: "attachment; filename*=iso-8859-1''na%EFve.txt", output: "naïve.txt"},
+		{input: `attachment; filename*=koi8-r''x.txt; filename="fallback.txt"`, output: "fallback.txt"},
+		{input: `attachment; filename*=UTF-8''%FF.txt; filename=ok.txt`, output: "ok.txt"},
+		{input: `attachment; filename="a;b \"c\".txt"`, output: `a;b "c".txt`},
+		{input: `inline; FILENAME = report.pdf ; size=3`, output: "report.pdf"},
 	}
 
 	for _, test := range tests {
@@ -38,14 +47,15 @@ func TestParseContentDisposition(t *testing.T) {
 func TestDeriveName(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
-		name     string
-		location string
-		header   string
-		expected string
+		name        string
+		location    string
+		header      string
+		contentType string
+		expected    string
 	}{
-		{name: "empty", location: "", expected: ""},
-		{name: "host only", location: "http://example.org", expected: ""},
-		{name: "trailing slash", location: "http://example.org/", expected: ""},
+		{name: "empty", location: "", expected: "download"},
+		{name: "host only", location: "http://example.org", expected: "download"},
+		{name: "trailing slash", location: "http://example.org/", expected: "download"},
 		{name: "path", location: "http://example.org/abc", expected: "abc"},
 		{name: "escaped path", location: "http://example.org/abc%20d", expected: "abc d"},
 		{name: "nested path", location: "http://example.org/a/b/c.ipsw", expected: "c.ipsw"},
@@ -68,6 +78,48 @@ func TestDeriveName(t *testing.T) {
 			header:   `attachment; filename="report.pdf"`,
 			expected: "report.pdf",
 		},
+		{
+			name:     "content disposition path",
+			location: "http://example.org/abc",
+			header:   `attachment; filename="..\\..\\evil.exe"`,
+			expected: "evil.exe",
+		},
+		{
+			name:     "content disposition sanitized away",
+			location: "http://example.org/abc",
+			header:   `attachment; filename="..."`,
+			expected: "abc",
+		},
+		{
+			name:        "extension from content type",
+			location:    "http://example.org/download",
+			contentType: "application/zip",
+			expected:    "download.zip",
+		},
+		{
+			name:        "root named from content type",
+			location:    "http://example.org/",
+			contentType: "application/json; charset=utf-8",
+			expected:    "download.json",
+		},
+		{
+			name:        "generic content type adds nothing",
+			location:    "http://example.org/download",
+			contentType: "application/octet-stream",
+			expected:    "download",
+		},
+		{
+			name:        "extensionless name kept",
+			location:    "http://example.org/bin/kubectl",
+			contentType: "text/plain",
+			expected:    "kubectl",
+		},
+		{
+			name:        "extension kept",
+			location:    "http://example.org/a.tar",
+			contentType: "application/zip",
+			expected:    "a.tar",
+		},
 	}
 
 	for _, test := range tests {
@@ -77,6 +129,9 @@ func TestDeriveName(t *testing.T) {
 			if test.header != "" {
 				h.Add("Content-Disposition", test.header)
 			}
+			if test.contentType != "" {
+				h.Set("Content-Type", test.contentType)
+			}
 			output, err := deriveName(test.location, h)
 			if err != nil {
 				t.Fatal(err)
@@ -88,6 +143,36 @@ func TestDeriveName(t *testing.T) {
 	}
 }
 
+func TestSanitizeName(t *testing.T) {
+	t.Parallel()
+	long := strings.Repeat("é", 200) + ".tar.gz"
+	for in, want := range map[string]string{
+		"report.pdf":            "report.pdf",
+		"a/b/c.txt":             "c.txt",
+		`C:\Users\x\c.txt`:      "c.txt",
+		"bad\x00na\x1bme\n.txt": "badname.txt",
+		"invoice\u202Efdp.exe":  "invoicefdp.exe",
+		"\u2066x\u2069.bin":     "x.bin",
+		".bashrc":               "bashrc",
+		"..":                    "",
+		"trailing. . ":          "trailing",
+		"CON":                   "_CON",
+		"nul.txt":               "_nul.txt",
+		"com1.tar.gz":           "_com1.tar.gz",
+		"COM10":                 "COM10",
+		"console.log":           "console.log",
+		"\xff\xfe.txt":          "txt",
+	} {
+		if got := sanitizeName(in); got != want {
+			t.Errorf("sanitizeName(%q) = %q, want %q", in, got, want)
+		}
+	}
+	got := sanitizeName(long)
+	if len(got) > maxNameLen || !strings.HasSuffix(got, ".gz") || !utf8.ValidString(got) {
+		t.Errorf("sanitizeName(long) = %q (%d bytes)", got, len(got))
+	}
+}
+
 func TestResolveDest(t *testing.T) {
 	t.Parallel()
 	h := make(http.Header)
@@ -126,10 +211,14 @@ func TestResolveDest(t *testing.T) {
 		}
 	})
 
-	t.Run("underivable errors", func(t *testing.T) {
+	t.Run("root named download", func(t *testing.T) {
 		t.Parallel()
-		if _, err := resolveDest("", "http://example.org/", h); err == nil {
-			t.Error("expected error")
+		got, err := resolveDest("", "http://example.org/", h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "download" {
+			t.Errorf("got %q", got)
 		}
 	})
 }
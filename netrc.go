@@ -0,0 +1,191 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// netrcEntry is one machine's (or the default's) credentials.
+type netrcEntry struct {
+	login, password string
+}
+
+// netrc holds the parsed credentials of a .netrc file.
+type netrc struct {
+	machines map[string]netrcEntry // by lower-case host name
+	def      *netrcEntry
+}
+
+// lookup returns the credentials for host: its machine entry, else the
+// default entry.
+func (n *netrc) lookup(host string) (netrcEntry, bool) {
+	if e, ok := n.machines[strings.ToLower(host)]; ok {
+		return e, true
+	}
+	if n.def != nil {
+		return *n.def, true
+	}
+	return netrcEntry{}, false
+}
+
+// netrcPath returns the file Options.Netrc reads and whether the caller
+// named it (NetrcFile or $NETRC) rather than it being the default.
+func netrcPath(o *Options) (string, bool, error) {
+	if o.NetrcFile != "" {
+		return o.NetrcFile, true, nil
+	}
+	if p := os.Getenv("NETRC"); p != "" {
+		return p, true, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", false, fmt.Errorf("locate .netrc: %w", err)
+	}
+	name := ".netrc"
+	if runtime.GOOS == "windows" {
+		name = "_netrc"
+	}
+	return filepath.Join(home, name), false, nil
+}
+
+// loadNetrc reads the credentials file for Options.Netrc. A missing default
+// file means no credentials; a missing named one is an error.
+func loadNetrc(o *Options) (*netrc, error) {
+	path, named, err := netrcPath(o)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !named {
+		return &netrc{machines: map[string]netrcEntry{}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read netrc: %w", err)
+	}
+	n, err := parseNetrc(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("parse netrc %s: %w", path, err)
+	}
+	return n, nil
+}
+
+// parseNetrc parses the .netrc format: whitespace-separated "machine",
+// "default", "login", "password", and "account" tokens, "#" comments, and
+// "macdef" macros (skipped up to the next blank line).
+func parseNetrc(s string) (*netrc, error) {
+	n := &netrc{machines: make(map[string]netrcEntry)}
+	type token struct {
+		s    string
+		line int
+	}
+	var tokens []token
+	var blank []int // line numbers of empty lines, ascending
+	line := 0
+	for l := range strings.Lines(s) {
+		line++
+		switch t := strings.TrimSpace(l); {
+		case t == "":
+			blank = append(blank, line)
+		case strings.HasPrefix(t, "#"):
+		default:
+			for _, f := range strings.Fields(t) {
+				tokens = append(tokens, token{f, line})
+			}
+		}
+	}
+	next := func(i int, what string) (string, error) {
+		if i+1 >= len(tokens) {
+			return "", fmt.Errorf("%s without a value", what)
+		}
+		return tokens[i+1].s, nil
+	}
+
+	var cur *netrcEntry
+	var host string
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		if host == "" {
+			if n.def == nil {
+				n.def = cur
+			}
+		} else if _, dup := n.machines[host]; !dup {
+			n.machines[host] = *cur // the first entry for a host wins
+		}
+	}
+	for i := 0; i < len(tokens); i++ {
+		switch kw := tokens[i].s; kw {
+		case "machine":
+			flush()
+			name, err := next(i, kw)
+			if err != nil {
+				return nil, err
+			}
+			cur, host = &netrcEntry{}, strings.ToLower(name)
+			i++
+		case "default":
+			flush()
+			cur, host = &netrcEntry{}, ""
+		case "login", "password", "account":
+			v, err := next(i, kw)
+			if err != nil {
+				return nil, err
+			}
+			if cur == nil {
+				return nil, fmt.Errorf("%s outside a machine entry", kw)
+			}
+			switch kw {
+			case "login":
+				cur.login = v
+			case "password":
+				cur.password = v
+			}
+			i++
+		case "macdef":
+			// The macro body runs to the next empty line.
+			end := len(s) + 1
+			if j, _ := slices.BinarySearch(blank, tokens[i].line); j < len(blank) {
+				end = blank[j]
+			}
+			for i+1 < len(tokens) && tokens[i+1].line < end {
+				i++
+			}
+		default:
+			return nil, fmt.Errorf("unexpected token %q", kw)
+		}
+	}
+	flush()
+	return n, nil
+}
+
+// netrcTransport adds Basic credentials from .netrc to each request hop
+// whose host has an entry, unless the request already carries an
+// Authorization header. Like Options.Headers, credentials never reach a
+// host unrelated to source, the download's URL, even if .netrc lists it.
+type netrcTransport struct {
+	creds  *netrc
+	source *url.URL
+	next   http.RoundTripper
+}
+
+func (t *netrcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" || !shouldCopySensitiveHeaders(t.source, req.URL) {
+		return t.next.RoundTrip(req)
+	}
+	e, ok := t.creds.lookup(req.URL.Hostname())
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(e.login, e.password)
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,159 @@
+package download
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func writeNetrc(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "netrc")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseNetrc(t *testing.T) {
+	t.Parallel()
+	n, err := parseNetrc(`# mirrors
+machine Mirror.Example login alice password s3cret
+machine other.example
+	login bob
+	account ignored
+	password hunter2
+macdef init
+	machine evil.example login mallory password x
+	cd /pub
+
+machine mirror.example login shadowed password shadowed
+default login anonymous password guest@
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]netrcEntry{
+		"mirror.example": {"alice", "s3cret"},
+		"other.example":  {"bob", "hunter2"},
+	}
+	if !reflect.DeepEqual(n.machines, want) {
+		t.Errorf("machines = %v, want %v", n.machines, want)
+	}
+	if e, _ := n.lookup("MIRROR.example"); e.login != "alice" {
+		t.Errorf("lookup is case-sensitive: %v", e)
+	}
+	if e, ok := n.lookup("unlisted.example"); !ok || e.login != "anonymous" {
+		t.Errorf("lookup(unlisted) = %v, %v; want the default entry", e, ok)
+	}
+
+	for _, bad := range []string{"login alice", "machine", "machine m login", "machine m user alice"} {
+		if _, err := parseNetrc(bad); err == nil {
+			t.Errorf("parseNetrc(%q) succeeded", bad)
+		}
+	}
+}
+
+// TestNetrcCredentialsScopedToHost: the origin gets its own entry, and the
+// redirect to an unrelated host gets nothing, although .netrc lists it.
+func TestNetrcCredentialsScopedToHost(t *testing.T) {
+	t.Parallel()
+	data := testData(64 << 10)
+	var mu sync.Mutex
+	var leaked []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("Authorization"); v != "" {
+			mu.Lock()
+			leaked = append(leaked, v)
+			mu.Unlock()
+		}
+		writeBareRange(w, r, data, `"v1"`)
+	}))
+	t.Cleanup(target.Close)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "alice" || p != "s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, target.URL+"/file.bin", http.StatusFound)
+	}))
+	t.Cleanup(origin.Close)
+	// The origin is "localhost", the target 127.0.0.1: unrelated hosts.
+	source := strings.Replace(origin.URL, "127.0.0.1", "localhost", 1) + "/file.bin"
+
+	d := newDL(t, &Options{
+		Parts: 2, MinPartSize: 4 << 10,
+		NetrcFile: writeNetrc(t, "machine localhost login alice password s3cret\n"+
+			"machine 127.0.0.1 login bob password hunter2\n"),
+	})
+	_, got := mustGet(t, d, source, filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(leaked) > 0 {
+		t.Errorf("redirect host received credentials: %q", leaked)
+	}
+}
+
+func TestNetrcKeepsExplicitAuthorization(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var seen []string
+	var st stats
+	inner := rangeHandler(testData(1024), `"v1"`, &st)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Header.Get("Authorization"))
+		mu.Unlock()
+		inner.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	d := newDL(t, &Options{
+		Headers:   http.Header{"Authorization": {"Bearer explicit"}},
+		NetrcFile: writeNetrc(t, "default login alice password s3cret\n"),
+	})
+	mustGet(t, d, srv.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	mu.Lock()
+	defer mu.Unlock()
+	for _, v := range seen {
+		if v != "Bearer explicit" {
+			t.Errorf("Authorization = %q, want the explicit header", v)
+		}
+	}
+}
+
+func TestNetrcFileMissing(t *testing.T) {
+	t.Parallel()
+	_, err := New(&Options{NetrcFile: filepath.Join(t.TempDir(), "absent")})
+	if err == nil || !strings.Contains(err.Error(), "read netrc") {
+		t.Fatalf("err = %v, want a read error for the named file", err)
+	}
+}
+
+// TestNetrcEnv: $NETRC names the file when NetrcFile does not. Not
+// parallel: it sets the environment.
+func TestNetrcEnv(t *testing.T) {
+	t.Setenv("NETRC", writeNetrc(t, "machine m login from-env password x\n"))
+	d, err := New(&Options{Netrc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := d.netrc.lookup("m"); !ok || e.login != "from-env" {
+		t.Fatalf("lookup(m) = %v, %v; want the $NETRC entry", e, ok)
+	}
+	t.Setenv("NETRC", "")
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("USERPROFILE", os.Getenv("HOME"))
+	if _, err := New(&Options{Netrc: true}); err != nil {
+		t.Fatalf("missing default .netrc: %v, want no credentials", err)
+	}
+}
@@ -0,0 +1,162 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// An oci:// source names a blob in an OCI distribution registry:
+//
+//	oci://registry/repository@sha256:<hex>   the blob with that digest
+//	oci://registry/repository:tag            the single layer of the tag's manifest
+//	oci://registry/repository:tag#title      its layer titled so (the
+//	                                          org.opencontainers.image.title annotation)
+//
+// The registry is always reached over HTTPS; docker.io stands for Docker
+// Hub. The download is verified against the blob's digest.
+
+// ociRef is a parsed oci:// source.
+type ociRef struct {
+	registry, repo string
+	tag, digest    string // exactly one is set
+	title          string // the #fragment selecting a tag's layer
+}
+
+var (
+	reOCIRepo   = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	reOCITag    = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	reOCIDigest = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+)
+
+func parseOCIRef(u *url.URL) (*ociRef, error) {
+	ref := &ociRef{registry: u.Host, title: u.Fragment}
+	p := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || u.User != nil || u.RawQuery != "" || p == "" {
+		return nil, errors.New("invalid oci URL: want oci://registry/repository@sha256:<hex> or oci://registry/repository:tag")
+	}
+	if repo, digest, ok := strings.Cut(p, "@"); ok {
+		if !reOCIDigest.MatchString(digest) {
+			return nil, fmt.Errorf("invalid oci digest %q: want sha256:<64 hex digits>", digest)
+		}
+		ref.repo, ref.digest = repo, digest
+	} else {
+		ref.repo, ref.tag = p, "latest"
+		if i := strings.LastIndexByte(p, ':'); i > strings.LastIndexByte(p, '/') {
+			ref.repo, ref.tag = p[:i], p[i+1:]
+		}
+		if !reOCITag.MatchString(ref.tag) {
+			return nil, fmt.Errorf("invalid oci tag %q", ref.tag)
+		}
+	}
+	if !reOCIRepo.MatchString(ref.repo) {
+		return nil, fmt.Errorf("invalid oci repository %q", ref.repo)
+	}
+	if ref.registry == "docker.io" {
+		ref.registry = "registry-1.docker.io"
+		if !strings.Contains(ref.repo, "/") {
+			ref.repo = "library/" + ref.repo
+		}
+	}
+	return ref, nil
+}
+
+func (ref *ociRef) endpoint(kind, name string) string {
+	return (&url.URL{Scheme: "https", Host: ref.registry, Path: "/v2/" + ref.repo + "/" + kind + "/" + name}).String()
+}
+
+// ociManifestTypes are the manifest formats a tag may resolve to.
+var ociManifestTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+const ociTitleAnnotation = "org.opencontainers.image.title"
+
+// resolveOCI returns the blob URL, digest, and file name (the layer's
+// title, else the digest's hex) for ref, fetching the tag's manifest if
+// need be. source is the oci:// URL requests are scoped to; headers are
+// the request's.
+func (d *Downloader) resolveOCI(
+	ctx context.Context, ref *ociRef, source *url.URL, headers http.Header,
+) (blobURL, digest, name string, err error) {
+	digest = ref.digest
+	if digest == "" {
+		layer, err := d.ociLayer(ctx, ref, source, headers)
+		if err != nil {
+			return "", "", "", err
+		}
+		digest, name = layer.Digest, layer.Annotations[ociTitleAnnotation]
+	}
+	if name == "" {
+		name = strings.TrimPrefix(digest, "sha256:")
+	}
+	return ref.endpoint("blobs", digest), digest, name, nil
+}
+
+// ociLayer fetches ref's manifest and picks the layer to download.
+func (d *Downloader) ociLayer(
+	ctx context.Context, ref *ociRef, source *url.URL, headers http.Header,
+) (*ociDescriptor, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ref.endpoint("manifests", ref.tag), nil)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	d.applyHeaders(req, source, headers)
+	req.Header.Set("Accept", strings.Join(ociManifestTypes, ", "))
+	if err := d.prepare(req); err != nil {
+		return nil, err
+	}
+	resp, err := d.newClient(d.roundTripper(), source).Do(req)
+	if err != nil {
+		fillPinHost(err)
+		return nil, redactErr(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch manifest %s:%s: %w", ref.repo, ref.tag, StatusError(resp.StatusCode))
+	}
+	var m struct {
+		MediaType string          `json:"mediaType"`
+		Layers    []ociDescriptor `json:"layers"`
+		Manifests []ociDescriptor `json:"manifests"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&m); err != nil {
+		return nil, fmt.Errorf("parse manifest %s:%s: %w", ref.repo, ref.tag, err)
+	}
+	if len(m.Manifests) > 0 {
+		return nil, fmt.Errorf("%s:%s is an image index; reference a blob by digest", ref.repo, ref.tag)
+	}
+	var titles []string
+	for i := range m.Layers {
+		l := &m.Layers[i]
+		title := l.Annotations[ociTitleAnnotation]
+		if (ref.title == "" && len(m.Layers) == 1) || (ref.title != "" && title == ref.title) {
+			if !reOCIDigest.MatchString(l.Digest) {
+				return nil, fmt.Errorf("layer digest %q is not sha256", l.Digest)
+			}
+			return l, nil
+		}
+		titles = append(titles, title)
+	}
+	if ref.title != "" {
+		return nil, fmt.Errorf("%s:%s has no layer titled %q (have %q)", ref.repo, ref.tag, ref.title, titles)
+	}
+	return nil, fmt.Errorf("%s:%s has %d layers; select one with #title (have %q)",
+		ref.repo, ref.tag, len(m.Layers), titles)
+}
@@ -0,0 +1,260 @@
+package download
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func sha256Digest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// fakeRegistry serves repository lib/app as "example.com" (routed with
+// ConnectTo; httptest's certificate covers the name) behind a Bearer token
+// service, redirecting blob requests to a storage server on 127.0.0.1
+// with a fresh signature each time.
+type fakeRegistry struct {
+	registry, storage *httptest.Server
+	tokenFetches      atomic.Int32
+	refused           atomic.Int32
+	mu                sync.Mutex
+	leaked            []string
+	storageRanges     []string
+}
+
+func newFakeRegistry(t *testing.T, blobs map[string][]byte, manifests map[string]any) *fakeRegistry {
+	t.Helper()
+	fr := &fakeRegistry{}
+	var sig atomic.Int32
+	fr.storage = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fr.mu.Lock()
+		if v := r.Header.Get("Authorization"); v != "" {
+			fr.leaked = append(fr.leaked, v)
+		}
+		fr.storageRanges = append(fr.storageRanges, r.Header.Get("Range"))
+		fr.mu.Unlock()
+		data, ok := blobs[strings.TrimPrefix(r.URL.Path, "/store/")]
+		if !ok || r.URL.Query().Get("sig") == "" {
+			http.NotFound(w, r)
+			return
+		}
+		writeBareRange(w, r, data, `"shared"`)
+	}))
+	t.Cleanup(fr.storage.Close)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		fr.tokenFetches.Add(1)
+		if r.URL.Query().Get("scope") != "repository:lib/app:pull" {
+			http.Error(w, "bad scope", http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"token": "reg-token"})
+	})
+	authorized := func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Authorization") == "Bearer reg-token" {
+			return true
+		}
+		fr.refused.Add(1)
+		w.Header().Set("WWW-Authenticate",
+			`Bearer realm="https://example.com/token",service="example.com",scope="repository:lib/app:pull"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	mux.HandleFunc("/v2/lib/app/manifests/{ref}", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		m, ok := manifests[r.PathValue("ref")]
+		if !ok || !strings.Contains(r.Header.Get("Accept"), "application/vnd.oci.image.manifest.v1+json") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		_ = json.NewEncoder(w).Encode(m)
+	})
+	mux.HandleFunc("/v2/lib/app/blobs/{digest}", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		if _, ok := blobs[r.PathValue("digest")]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("%s/store/%s?sig=%d", fr.storage.URL, r.PathValue("digest"), sig.Add(1)),
+			http.StatusTemporaryRedirect)
+	})
+	fr.registry = httptest.NewTLSServer(mux)
+	t.Cleanup(fr.registry.Close)
+	return fr
+}
+
+// options returns Options reaching the fake registry.
+func (fr *fakeRegistry) options(o Options) *Options {
+	o.TLSConfig = fr.registry.Client().Transport.(*http.Transport).TLSClientConfig
+	o.ConnectTo = map[string]string{"example.com:443": fr.registry.Listener.Addr().String()}
+	return &o
+}
+
+func ociManifest(layers ...ociDescriptor) map[string]any {
+	return map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        map[string]any{"mediaType": "application/vnd.oci.empty.v1+json", "digest": sha256Digest([]byte("{}")), "size": 2},
+		"layers":        layers,
+	}
+}
+
+func ociLayerOf(data []byte, title string) ociDescriptor {
+	l := ociDescriptor{MediaType: "application/octet-stream", Digest: sha256Digest(data), Size: int64(len(data))}
+	if title != "" {
+		l.Annotations = map[string]string{ociTitleAnnotation: title}
+	}
+	return l
+}
+
+// TestOCITagDownload: a tag resolves through its manifest to the layer,
+// which downloads in parallel from storage with one token and no leaked
+// credentials, named by its title.
+func TestOCITagDownload(t *testing.T) {
+	t.Parallel()
+	data := testData(256 << 10)
+	fr := newFakeRegistry(t, map[string][]byte{sha256Digest(data): data},
+		map[string]any{"v1": ociManifest(ociLayerOf(data, "toolchain.tar.gz"))})
+
+	d := newDL(t, fr.options(Options{Parts: 4, MinParts: 4, MinPartSize: 16 << 10}))
+	dir := t.TempDir()
+	res, got := mustGet(t, d, "oci://example.com/lib/app:v1", dir)
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from the blob")
+	}
+	if want := filepath.Join(dir, "toolchain.tar.gz"); res.Path != want {
+		t.Errorf("Path = %q, want %q", res.Path, want)
+	}
+	if n := fr.tokenFetches.Load(); n != 1 {
+		t.Errorf("token fetched %d times, want 1", n)
+	}
+	if n := fr.refused.Load(); n != 1 {
+		t.Errorf("registry refused %d requests, want only the manifest's first", n)
+	}
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if len(fr.leaked) > 0 {
+		t.Errorf("storage received credentials: %q", fr.leaked)
+	}
+	if len(fr.storageRanges) < 4 {
+		t.Errorf("storage served %d requests, want every part", len(fr.storageRanges))
+	}
+}
+
+func TestOCITagSelectsLayerByTitle(t *testing.T) {
+	t.Parallel()
+	a, b := testData(32<<10), bytes.Repeat([]byte{0xB2}, 32<<10)
+	fr := newFakeRegistry(t, map[string][]byte{sha256Digest(a): a, sha256Digest(b): b},
+		map[string]any{"multi": ociManifest(ociLayerOf(a, "a.bin"), ociLayerOf(b, "b.bin"))})
+	d := newDL(t, fr.options(Options{}))
+
+	_, got := mustGet(t, d, "oci://example.com/lib/app:multi#b.bin", filepath.Join(t.TempDir(), "out"))
+	if !bytes.Equal(got, b) {
+		t.Fatal("downloaded the wrong layer")
+	}
+	_, err := d.Get(t.Context(), "oci://example.com/lib/app:multi", filepath.Join(t.TempDir(), "out"))
+	if err == nil || !strings.Contains(err.Error(), "has 2 layers") {
+		t.Fatalf("err = %v, want an ambiguous-layer error", err)
+	}
+}
+
+func TestOCIDigestVerified(t *testing.T) {
+	t.Parallel()
+	data := testData(64 << 10)
+	digest := sha256Digest([]byte("what the registry promised"))
+	fr := newFakeRegistry(t, map[string][]byte{digest: data}, nil)
+	d := newDL(t, fr.options(Options{Parts: 2, MinPartSize: 16 << 10}))
+
+	dest := filepath.Join(t.TempDir(), "blob")
+	_, err := d.Get(t.Context(), "oci://example.com/lib/app@"+digest, dest)
+	if _, ok := errors.AsType[*ChecksumError](err); !ok {
+		t.Fatalf("err = %v, want *ChecksumError against the digest", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Fatalf("unverified blob installed (stat err %v)", err)
+	}
+
+	_, err = d.Do(t.Context(), &Request{
+		URL: "oci://example.com/lib/app@" + digest, Dest: dest, ExpectedSHA256: strings.Repeat("0", 64),
+	})
+	if err == nil || !strings.Contains(err.Error(), "contradicts the blob digest") {
+		t.Fatalf("err = %v, want a conflicting-checksum error", err)
+	}
+}
+
+// TestOCIResumeBoundToReference: an interrupted blob download resumes from
+// the oci:// reference although storage hands out a new signed URL.
+func TestOCIResumeBoundToReference(t *testing.T) {
+	t.Parallel()
+	data := testData(128 << 10)
+	digest := sha256Digest(data)
+	fr := newFakeRegistry(t, map[string][]byte{digest: data}, nil)
+	source := "oci://example.com/lib/app@" + digest
+
+	dest := filepath.Join(t.TempDir(), "blob")
+	writePartialState(t, dest, source, data)
+	d := newDL(t, fr.options(Options{Parts: 1, MinPartSize: 4 << 10}))
+	res, got := mustGet(t, d, source, dest)
+	if !res.Resumed {
+		t.Error("blob download did not resume from its oci:// reference")
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("resumed blob differs from source")
+	}
+}
+
+func TestParseOCIRef(t *testing.T) {
+	t.Parallel()
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	for _, tc := range []struct {
+		in   string
+		want ociRef
+	}{
+		{"oci://ghcr.io/org/tools@" + digest, ociRef{registry: "ghcr.io", repo: "org/tools", digest: digest}},
+		{"oci://localhost:5000/a/b/c:1.2.3#tool.tgz", ociRef{registry: "localhost:5000", repo: "a/b/c", tag: "1.2.3", title: "tool.tgz"}},
+		{"oci://ghcr.io/org/tools", ociRef{registry: "ghcr.io", repo: "org/tools", tag: "latest"}},
+		{"oci://docker.io/alpine:3", ociRef{registry: "registry-1.docker.io", repo: "library/alpine", tag: "3"}},
+	} {
+		u, err := url.Parse(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseOCIRef(u)
+		if err != nil || *got != tc.want {
+			t.Errorf("parseOCIRef(%q) = %+v, %v; want %+v", tc.in, got, err, tc.want)
+		}
+	}
+	for _, bad := range []string{
+		"oci://ghcr.io/", "oci:///org/tools:v1", "oci://ghcr.io/Org/tools:v1",
+		"oci://ghcr.io/org/tools@sha256:abc", "oci://ghcr.io/org/tools@md5:" + strings.Repeat("a", 32),
+		"oci://ghcr.io/org/tools:bad/tag", "oci://user:pw@ghcr.io/org/tools:v1",
+	} {
+		u, err := url.Parse(bad)
+		if err != nil {
+			continue
+		}
+		if _, err := parseOCIRef(u); err == nil {
+			t.Errorf("parseOCIRef(%q) accepted", bad)
+		}
+	}
+}
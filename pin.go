@@ -0,0 +1,88 @@
+package download
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// validatePins checks that every Options.PinnedSPKI entry is a base64
+// SHA-256 digest.
+func validatePins(pins []string) error {
+	for i, p := range pins {
+		b, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid PinnedSPKI[%d] %q: want the base64 SHA-256 of a SubjectPublicKeyInfo", i, p)
+		}
+	}
+	return nil
+}
+
+// pinnedTLSConfig returns the internal transport's copy of Options.TLSConfig,
+// with Options.PinnedSPKI enforced after (and in addition to) any
+// VerifyConnection of the caller's. VerifyConnection also runs on resumed
+// sessions, so a resumption cannot bypass the pins.
+func pinnedTLSConfig(o Options) *tls.Config {
+	cfg := o.TLSConfig.Clone()
+	if len(o.PinnedSPKI) == 0 {
+		return cfg
+	}
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	pins := make(map[[sha256.Size]byte]bool, len(o.PinnedSPKI))
+	for _, p := range o.PinnedSPKI {
+		b, _ := base64.StdEncoding.DecodeString(p) // validated by New
+		pins[[sha256.Size]byte(b)] = true
+	}
+	verify := cfg.VerifyConnection
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		if !pinMatch(cs, pins) {
+			return &PinError{Host: cs.ServerName}
+		}
+		return nil
+	}
+	return cfg
+}
+
+// pinMatch reports whether the connection's certificates include a pinned
+// key. Only verified chains count: anything else in the handshake is
+// peer-supplied, and an interceptor can append the pinned CA's public
+// certificate. Without verification only the leaf is the peer's own.
+func pinMatch(cs tls.ConnectionState, pins map[[sha256.Size]byte]bool) bool {
+	if len(cs.VerifiedChains) == 0 {
+		return len(cs.PeerCertificates) > 0 &&
+			pins[sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)]
+	}
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fillPinHost names the host of a *PinError in err's chain from the failed
+// request's URL when the handshake had no server name to report: TLS sends
+// none for an IP address.
+func fillPinHost(err error) {
+	pe, ok := errors.AsType[*PinError](err)
+	if !ok || pe.Host != "" {
+		return
+	}
+	if uerr, ok := errors.AsType[*url.Error](err); ok {
+		if u, perr := url.Parse(uerr.URL); perr == nil {
+			pe.Host = u.Hostname()
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package download
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// selfSignedCert returns a fresh key pair for 127.0.0.1, unlike httptest's
+// shared certificate, so servers can be told apart by pin.
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A distinct subject per certificate: verification finds a self-signed
+	// root by subject.
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "pin test " + serial.String()},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func newSelfSignedTLSServer(t *testing.T, h http.Handler) *httptest.Server {
+	t.Helper()
+	cert, _ := selfSignedCert(t)
+	srv := httptest.NewUnstartedServer(h)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// trustBoth returns a TLS config trusting both servers' certificates.
+func trustBoth(a, b *httptest.Server) *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(a.Certificate())
+	roots.AddCert(b.Certificate())
+	return &tls.Config{RootCAs: roots}
+}
+
+func TestPinnedSPKIAcceptsPinnedKey(t *testing.T) {
+	t.Parallel()
+	data := testData(256 << 10)
+	var st stats
+	srv := httptest.NewTLSServer(rangeHandler(data, `"v1"`, &st))
+	t.Cleanup(srv.Close)
+
+	d := newDL(t, &Options{
+		Parts: 4, MinParts: 4, MinPartSize: 16 << 10,
+		TLSConfig:  trustBoth(srv, srv),
+		PinnedSPKI: []string{base64.StdEncoding.EncodeToString(make([]byte, 32)), spkiPin(srv.Certificate())},
+	})
+	_, got := mustGet(t, d, srv.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	if n := len(st.rangeHeaders()); n < 4 {
+		t.Fatalf("%d requests, want every part over a pinned connection", n)
+	}
+}
+
+func TestPinnedSPKIRejectsUnpinnedKey(t *testing.T) {
+	t.Parallel()
+	var st stats
+	srv := httptest.NewTLSServer(rangeHandler(testData(1024), `"v1"`, &st))
+	t.Cleanup(srv.Close)
+	other := newSelfSignedTLSServer(t, http.NotFoundHandler())
+
+	d := newDL(t, &Options{
+		TLSConfig:  trustBoth(srv, other),
+		PinnedSPKI: []string{spkiPin(other.Certificate())},
+	})
+	dest := filepath.Join(t.TempDir(), "file.bin")
+	start := time.Now()
+	_, err := d.Get(t.Context(), srv.URL+"/file.bin", dest)
+	pe, ok := errors.AsType[*PinError](err)
+	if !ok {
+		t.Fatalf("err = %v, want *PinError", err)
+	}
+	if pe.Host != "127.0.0.1" {
+		t.Errorf("PinError.Host = %q, want 127.0.0.1", pe.Host)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("pin failure was retried")
+	}
+	if n := len(st.rangeHeaders()); n != 0 {
+		t.Errorf("server served %d requests over an unpinned connection", n)
+	}
+	assertClean(t, dest)
+}
+
+// TestPinnedSPKIEnforcedOnEveryPart: one intercepted connection among the
+// parallel parts fails the download instead of feeding it a range.
+func TestPinnedSPKIEnforcedOnEveryPart(t *testing.T) {
+	t.Parallel()
+	data := testData(256 << 10)
+	var st stats
+	pinned, pinnedLeaf := selfSignedCert(t)
+	rogue, rogueLeaf := selfSignedCert(t)
+	var handshakes atomic.Int32
+	srv := httptest.NewUnstartedServer(rangeHandler(data, `"v1"`, &st))
+	// GetConfigForClient, not GetCertificate: without SNI (an IP host) the
+	// server would use the Certificates httptest fills in.
+	srv.TLS = &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		if handshakes.Add(1) == 1 {
+			return &tls.Config{Certificates: []tls.Certificate{pinned}}, nil // the election's
+		}
+		return &tls.Config{Certificates: []tls.Certificate{rogue}}, nil
+	}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(pinnedLeaf)
+	roots.AddCert(rogueLeaf)
+	d := newDL(t, &Options{
+		Parts: 4, MinParts: 4, MinPartSize: 16 << 10,
+		TLSConfig:  &tls.Config{RootCAs: roots},
+		PinnedSPKI: []string{spkiPin(pinnedLeaf)},
+	})
+	dest := filepath.Join(t.TempDir(), "file.bin")
+	_, err := d.Get(t.Context(), srv.URL+"/file.bin", dest)
+	if _, ok := errors.AsType[*PinError](err); !ok {
+		t.Fatalf("err = %v, want *PinError from a part's connection", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Fatalf("destination installed despite a pin failure (stat err %v)", err)
+	}
+}
+
+// TestPinnedSPKIEnforcedOnRedirectHop: a redirect to a host with a valid
+// but unpinned certificate must fail, not follow.
+func TestPinnedSPKIEnforcedOnRedirectHop(t *testing.T) {
+	t.Parallel()
+	var st stats
+	target := newSelfSignedTLSServer(t, rangeHandler(testData(1024), `"v1"`, &st))
+	origin := httptest.NewTLSServer(http.RedirectHandler(target.URL+"/file.bin", http.StatusFound))
+	t.Cleanup(origin.Close)
+
+	d := newDL(t, &Options{
+		TLSConfig:  trustBoth(origin, target),
+		PinnedSPKI: []string{spkiPin(origin.Certificate())},
+	})
+	_, err := d.Get(t.Context(), origin.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	if _, ok := errors.AsType[*PinError](err); !ok {
+		t.Fatalf("err = %v, want *PinError from the redirect hop", err)
+	}
+	if n := len(st.rangeHeaders()); n != 0 {
+		t.Errorf("redirect target served %d requests", n)
+	}
+}
+
+func TestPinnedSPKIValidation(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name string
+		opt  Options
+		want string
+	}{
+		{"not base64", Options{PinnedSPKI: []string{"not base64!"}}, "invalid PinnedSPKI[0]"},
+		{"wrong length", Options{PinnedSPKI: []string{base64.StdEncoding.EncodeToString(make([]byte, 20))}}, "invalid PinnedSPKI[0]"},
+		{"custom transport", Options{
+			PinnedSPKI: []string{base64.StdEncoding.EncodeToString(make([]byte, 32))},
+			Transport:  http.DefaultTransport,
+		}, "requires the internal transport"},
+	} {
+		_, err := New(&tc.opt)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: err = %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package download
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func rangeSignature(r *http.Request) string {
+	mac := hmac.New(sha256.New, []byte("k"))
+	mac.Write([]byte(r.Method + " " + r.URL.Path + " " + r.Header.Get("Range")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// TestPrepareRequestSignsEveryAttempt: the election, every part, and a
+// retried part each carry a signature over their own Range.
+func TestPrepareRequestSignsEveryAttempt(t *testing.T) {
+	t.Parallel()
+	data := testData(256 << 10)
+	var st stats
+	var served, unsigned, failed atomic.Int32
+	inner := rangeHandler(data, `"v1"`, &st)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Signature") != rangeSignature(r) {
+			unsigned.Add(1)
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+		// Fail the first part request once, so its retry must be signed too.
+		if served.Add(1) == 2 && failed.Add(1) == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		inner.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	var calls atomic.Int32
+	d := newDL(t, &Options{
+		Parts: 4, MinParts: 4, MinPartSize: 16 << 10,
+		PrepareRequest: func(r *http.Request) error {
+			calls.Add(1)
+			r.Header.Set("X-Signature", rangeSignature(r))
+			return nil
+		},
+	})
+	_, got := mustGet(t, d, srv.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	if n := unsigned.Load(); n != 0 {
+		t.Errorf("%d requests reached the server unsigned", n)
+	}
+	if failed.Load() == 0 {
+		t.Error("no attempt was retried; scenario not exercised")
+	}
+	if c, s := calls.Load(), served.Load(); c != s {
+		t.Errorf("PrepareRequest called %d times for %d requests", c, s)
+	}
+}
+
+func TestPrepareRequestErrorIsPermanent(t *testing.T) {
+	t.Parallel()
+	var st stats
+	srv := httptest.NewServer(rangeHandler(testData(1024), `"v1"`, &st))
+	t.Cleanup(srv.Close)
+	errNoKey := errors.New("signing key unavailable")
+	var calls atomic.Int32
+	d := newDL(t, &Options{PrepareRequest: func(*http.Request) error {
+		calls.Add(1)
+		return errNoKey
+	}})
+	dest := filepath.Join(t.TempDir(), "file.bin")
+	_, err := d.Get(t.Context(), srv.URL+"/file.bin", dest)
+	if !errors.Is(err, errNoKey) {
+		t.Fatalf("err = %v, want the hook's error", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("PrepareRequest called %d times, want no retry", n)
+	}
+	if n := len(st.rangeHeaders()); n != 0 {
+		t.Errorf("server saw %d requests", n)
+	}
+	assertClean(t, dest)
+}
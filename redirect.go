@@ -0,0 +1,74 @@
+package download
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// RedirectPolicy controls how redirects are followed; the zero value
+// follows up to 10 redirects to any target (net/http's default policy
+// stops one short, after 9).
+type RedirectPolicy struct {
+	// MaxHops caps the redirects followed from one request. 0 means 10;
+	// negative refuses every redirect.
+	MaxHops int
+	// NoDowngrade refuses a redirect from https to plain http.
+	NoDowngrade bool
+	// AllowHosts, when non-empty, lists the only hosts a redirect may
+	// lead to. An entry matches the host itself and its subdomains.
+	AllowHosts []string
+	// DenyHosts lists hosts (and their subdomains) a redirect may not
+	// lead to; it wins over AllowHosts.
+	DenyHosts []string
+	// StayOnOriginal sends every part request to the original URL, so each
+	// one follows (and is checked against) the redirects anew, instead of
+	// going straight to the final URL the initial request reached. Suits
+	// mirrors that balance per request or hand out short-lived links.
+	StayOnOriginal bool
+}
+
+const defaultMaxRedirects = 10 // redirects followed, not requests made
+
+// checkRedirect is the http.Client CheckRedirect enforcing the policy on
+// req, the next hop after via.
+func (p *RedirectPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	limit := p.MaxHops
+	if limit == 0 {
+		limit = defaultMaxRedirects
+	}
+	refuse := func(reason string) error {
+		return &RedirectError{URL: redactURL(req.URL.String()), Reason: reason}
+	}
+	switch host := strings.ToLower(req.URL.Hostname()); {
+	case len(via) > limit || limit < 0:
+		return refuse(fmt.Sprintf("more than %d redirects", max(limit, 0)))
+	case p.NoDowngrade && via[len(via)-1].URL.Scheme == "https" && req.URL.Scheme == "http":
+		return refuse("https to http downgrade")
+	case slices.ContainsFunc(p.DenyHosts, func(h string) bool { return hostWithin(host, h) }):
+		return refuse("host denied")
+	case len(p.AllowHosts) > 0 && !slices.ContainsFunc(p.AllowHosts, func(h string) bool { return hostWithin(host, h) }):
+		return refuse("host not allowed")
+	}
+	return nil
+}
+
+// hostWithin reports whether host is domain or one of its subdomains.
+func hostWithin(host, domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	host = strings.TrimSuffix(host, ".")
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// redirectChain returns the redacted URLs a response was redirected
+// through, in order, ending with its final URL; nil when it was not
+// redirected.
+func redirectChain(resp *http.Response) []string {
+	var chain []string
+	for req := resp.Request; req != nil && req.Response != nil; req = req.Response.Request {
+		chain = append(chain, redactURL(req.URL.String()))
+	}
+	slices.Reverse(chain)
+	return chain
+}
@@ -0,0 +1,177 @@
+package download
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// redirectOrigin redirects /hop/N to /hop/N-1 and /hop/0 to target with a
+// signed query, counting the requests it saw.
+func redirectOrigin(t *testing.T, target string, hits *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		var n int
+		if _, err := fmt.Sscanf(r.URL.Path, "/hop/%d", &n); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if n == 0 {
+			http.Redirect(w, r, target+"?sig=secret", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/hop/%d", n-1), http.StatusFound)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRedirectChainRecorded(t *testing.T) {
+	t.Parallel()
+	data := testData(64 << 10)
+	var st stats
+	target := httptest.NewServer(rangeHandler(data, `"v1"`, &st))
+	t.Cleanup(target.Close)
+	var hits atomic.Int32
+	origin := redirectOrigin(t, target.URL+"/file.bin", &hits)
+
+	d := newDL(t, &Options{Parts: 2, MinPartSize: 16 << 10, Redirects: RedirectPolicy{MaxHops: 3}})
+	res, got := mustGet(t, d, origin.URL+"/hop/2", filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	want := []string{origin.URL + "/hop/1", origin.URL + "/hop/0", target.URL + "/file.bin?REDACTED"}
+	if !slices.Equal(res.Redirects, want) {
+		t.Errorf("Redirects = %q, want %q", res.Redirects, want)
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("origin saw %d requests, want only the initial chain (parts go to the final URL)", n)
+	}
+
+	_, err := d.Get(t.Context(), origin.URL+"/hop/3", filepath.Join(t.TempDir(), "file.bin"))
+	re, ok := errors.AsType[*RedirectError](err)
+	if !ok || !strings.Contains(re.Reason, "more than 3 redirects") {
+		t.Fatalf("err = %v, want a *RedirectError for the fourth hop", err)
+	}
+}
+
+// TestRedirectDefaultLimit: the zero policy follows exactly 10 redirects.
+func TestRedirectDefaultLimit(t *testing.T) {
+	t.Parallel()
+	data := testData(1024)
+	var st stats
+	target := httptest.NewServer(rangeHandler(data, `"v1"`, &st))
+	t.Cleanup(target.Close)
+	var hits atomic.Int32
+	origin := redirectOrigin(t, target.URL+"/file.bin", &hits)
+	d := newDL(t, nil)
+
+	// /hop/N redirects N+1 times.
+	res, got := mustGet(t, d, origin.URL+"/hop/9", filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) || len(res.Redirects) != 10 {
+		t.Fatalf("followed %d redirects, want 10", len(res.Redirects))
+	}
+	_, err := d.Get(t.Context(), origin.URL+"/hop/10", filepath.Join(t.TempDir(), "file.bin"))
+	re, ok := errors.AsType[*RedirectError](err)
+	if !ok || !strings.Contains(re.Reason, "more than 10 redirects") {
+		t.Fatalf("err = %v, want a *RedirectError for the eleventh redirect", err)
+	}
+}
+
+func TestRedirectPolicyRefusals(t *testing.T) {
+	t.Parallel()
+	var st stats
+	target := httptest.NewServer(rangeHandler(testData(1024), `"v1"`, &st))
+	t.Cleanup(target.Close)
+	tlsOrigin := httptest.NewTLSServer(http.RedirectHandler(target.URL+"/file.bin", http.StatusFound))
+	t.Cleanup(tlsOrigin.Close)
+	var hits atomic.Int32
+	origin := redirectOrigin(t, target.URL+"/file.bin", &hits)
+	// The origin is "localhost", the target 127.0.0.1.
+	source := strings.Replace(origin.URL, "127.0.0.1", "localhost", 1) + "/hop/0"
+	tlsConfig := tlsOrigin.Client().Transport.(*http.Transport).TLSClientConfig
+
+	for _, tc := range []struct {
+		name   string
+		policy RedirectPolicy
+		url    string
+		reason string
+	}{
+		{"downgrade", RedirectPolicy{NoDowngrade: true}, tlsOrigin.URL + "/file.bin", "downgrade"},
+		{"no redirects", RedirectPolicy{MaxHops: -1}, source, "more than 0 redirects"},
+		{"not allowed", RedirectPolicy{AllowHosts: []string{"localhost", "example.com"}}, source, "not allowed"},
+		{"denied", RedirectPolicy{AllowHosts: []string{"127.0.0.1"}, DenyHosts: []string{"127.0.0.1"}}, source, "denied"},
+	} {
+		d := newDL(t, &Options{Redirects: tc.policy, TLSConfig: tlsConfig})
+		_, err := d.Get(t.Context(), tc.url, filepath.Join(t.TempDir(), "file.bin"))
+		re, ok := errors.AsType[*RedirectError](err)
+		if !ok || !strings.Contains(re.Reason, tc.reason) {
+			t.Errorf("%s: err = %v, want a *RedirectError (%s)", tc.name, err, tc.reason)
+			continue
+		}
+		if !strings.HasSuffix(re.URL, "?REDACTED") && tc.name != "downgrade" {
+			t.Errorf("%s: RedirectError.URL = %q, want it redacted", tc.name, re.URL)
+		}
+	}
+	if n := len(st.rangeHeaders()); n != 0 {
+		t.Errorf("target served %d requests through refused redirects", n)
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("origin saw %d requests, want one per case (no retries)", n)
+	}
+
+	d := newDL(t, &Options{Redirects: RedirectPolicy{AllowHosts: []string{"localhost", "127.0.0.1"}, NoDowngrade: true}})
+	mustGet(t, d, source, filepath.Join(t.TempDir(), "file.bin"))
+}
+
+// TestRedirectStayOnOriginal: every part goes through the origin's
+// redirect instead of straight to the final URL.
+func TestRedirectStayOnOriginal(t *testing.T) {
+	t.Parallel()
+	data := testData(256 << 10)
+	var st stats
+	target := httptest.NewServer(rangeHandler(data, `"v1"`, &st))
+	t.Cleanup(target.Close)
+	var hits atomic.Int32
+	origin := redirectOrigin(t, target.URL+"/file.bin", &hits)
+
+	d := newDL(t, &Options{
+		Parts: 4, MinParts: 4, MinPartSize: 16 << 10,
+		Redirects: RedirectPolicy{StayOnOriginal: true},
+	})
+	res, got := mustGet(t, d, origin.URL+"/hop/0", filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	if n, parts := int(hits.Load()), len(st.rangeHeaders()); n != parts {
+		t.Errorf("origin saw %d requests for %d target requests, want every part redirected", n, parts)
+	}
+	if len(res.Redirects) != 1 {
+		t.Errorf("Redirects = %q, want the initial request's single hop", res.Redirects)
+	}
+}
+
+func TestHostWithin(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		host, domain string
+		want         bool
+	}{
+		{"example.com", "example.com", true},
+		{"cdn.example.com", "Example.COM.", true},
+		{"badexample.com", "example.com", false},
+		{"example.com", "cdn.example.com", false},
+	} {
+		if got := hostWithin(tc.host, tc.domain); got != tc.want {
+			t.Errorf("hostWithin(%q, %q) = %v, want %v", tc.host, tc.domain, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package download
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink is Linux-only (FICLONE); elsewhere materialization falls back to
+// a hard link or a copy.
+func reflink(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -29,7 +29,8 @@ type Info struct {
 // those transitions are silent, never re-announced through ChunkStart.
 type Reporter interface {
 	// Start fires once, after the first server response resolves the
-	// download's name and size.
+	// download's name and size — again only when a failed Options.Caches
+	// copy hands over to the next source.
 	Start(info Info)
 	// ChunkStart announces a new chunk covering length bytes at absolute
 	// file offset off, of which written bytes are already on disk from a
@@ -45,11 +45,11 @@ func newRetireHarness(t *testing.T, d *Downloader, srvURL string, total int64) *
 	}
 	sched := newScheduler(1 << 10)
 	sched.addPending(0, total, 0)
-	r := &run{
+	r := defaultRun(t, &run{
 		d: d, rep: NopReporter{}, url: srvURL + "/file.bin", sourceURL: u,
 		destPath: part[:len(part)-5], partPath: part,
 		total: total, etag: `"v1"`,
-	}
+	})
 	return &retireHarness{
 		t: t, r: r, sched: sched, file: file,
 		cancels: make(map[int]context.CancelCauseFunc),
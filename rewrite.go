@@ -0,0 +1,110 @@
+package download
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule rewrites matching request URLs before they are sent, e.g. to
+// route downloads through an internal cache:
+//
+//	RewriteRule{Prefix: "https://updates.cdn-apple.com/", Replace: "http://artifact-cache.lan/apple/"}
+//
+// Rules apply to the source URL and to every redirect target; the first
+// matching rule wins. Resume state stays bound to the original source.
+type RewriteRule struct {
+	// Prefix matches URLs starting with it; Replace substitutes the prefix.
+	Prefix string
+	// Pattern, used when Prefix is empty, is a regular expression matched
+	// against the whole URL; Replace may refer to its submatches ($1,
+	// ${name}) as in regexp.Regexp.Expand.
+	Pattern string
+	// Replace is the rewritten prefix or the expansion template. The
+	// result must be an http or https URL.
+	Replace string
+	// Fallback retries the original source URL when the initial request to
+	// the rewritten one fails. It does not apply to redirect targets.
+	Fallback bool
+}
+
+// rewriter holds the compiled Options.Rewrite rules.
+type rewriter struct {
+	rules []RewriteRule
+	res   []*regexp.Regexp // per rule; nil for prefix rules
+}
+
+// newRewriter validates and compiles the rules; nil means none.
+func newRewriter(rules []RewriteRule) (*rewriter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	rw := &rewriter{rules: rules, res: make([]*regexp.Regexp, len(rules))}
+	for i, rule := range rules {
+		switch {
+		case rule.Prefix != "" && rule.Pattern != "":
+			return nil, fmt.Errorf("invalid Rewrite[%d]: set Prefix or Pattern, not both", i)
+		case rule.Prefix == "" && rule.Pattern == "":
+			return nil, fmt.Errorf("invalid Rewrite[%d]: no Prefix or Pattern", i)
+		case rule.Pattern != "":
+			re, err := regexp.Compile(`^(?:` + rule.Pattern + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Rewrite[%d] Pattern: %w", i, err)
+			}
+			rw.res[i] = re
+		}
+	}
+	return rw, nil
+}
+
+// rewrite returns rawURL rewritten by the first matching rule, and that
+// rule; nil when none matches.
+func (rw *rewriter) rewrite(rawURL string) (string, *RewriteRule, error) {
+	if rw == nil {
+		return rawURL, nil, nil
+	}
+	for i := range rw.rules {
+		rule := &rw.rules[i]
+		var out string
+		if re := rw.res[i]; re != nil {
+			m := re.FindStringSubmatchIndex(rawURL)
+			if m == nil {
+				continue
+			}
+			out = string(re.ExpandString(nil, rule.Replace, rawURL, m))
+		} else if rest, ok := strings.CutPrefix(rawURL, rule.Prefix); ok {
+			out = rule.Replace + rest
+		} else {
+			continue
+		}
+		u, err := url.Parse(out)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", nil, fmt.Errorf("rewrite %s: result %s is not an http(s) URL", redactURL(rawURL), redactURL(out))
+		}
+		return out, rule, nil
+	}
+	return rawURL, nil, nil
+}
+
+// checkRedirect is the http.Client CheckRedirect: the redirect policy
+// judges the target the server chose, then the rewrite rules apply to it.
+// Synthetic unix:// hosts are never a redirect target.
+func (d *Downloader) checkRedirect(req *http.Request, via []*http.Request) error {
+	if err := d.opt.Redirects.checkRedirect(req, via); err != nil {
+		return err
+	}
+	out, rule, err := d.rewrite.rewrite(req.URL.String())
+	if err != nil {
+		return &RedirectError{URL: redactURL(req.URL.String()), Reason: err.Error()}
+	}
+	if rule != nil {
+		u, _ := url.Parse(out) // validated by rewrite
+		req.URL, req.Host = u, ""
+	}
+	if strings.HasSuffix(strings.ToLower(req.URL.Hostname()), unixHostSuffix) {
+		return &RedirectError{URL: redactURL(req.URL.String()), Reason: "unix socket host"}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package download
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// TestRewriteToCache: a rewritten source downloads in parts from the cache
+// alone, is named after the source, and resumes state bound to the source.
+func TestRewriteToCache(t *testing.T) {
+	t.Parallel()
+	data := testData(256 << 10)
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(origin.Close)
+	var st stats
+	cache := httptest.NewServer(http.StripPrefix("/apple", rangeHandler(data, `"shared"`, &st)))
+	t.Cleanup(cache.Close)
+
+	d := newDL(t, &Options{
+		Parts: 4, MinParts: 4, MinPartSize: 16 << 10,
+		Rewrite: []RewriteRule{{Prefix: origin.URL + "/", Replace: cache.URL + "/apple/"}},
+	})
+	dir := t.TempDir()
+	res, got := mustGet(t, d, origin.URL+"/file.bin", dir)
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	if want := filepath.Join(dir, "file.bin"); res.Path != want {
+		t.Errorf("Path = %q, want %q", res.Path, want)
+	}
+	if n := len(st.rangeHeaders()); n < 4 {
+		t.Errorf("cache served %d requests, want every part", n)
+	}
+
+	dest := filepath.Join(t.TempDir(), "file.bin")
+	writePartialState(t, dest, origin.URL+"/file.bin", data)
+	res, got = mustGet(t, d, origin.URL+"/file.bin", dest)
+	if !res.Resumed || !bytes.Equal(got, data) {
+		t.Errorf("Resumed = %v, want the source's state resumed from the cache", res.Resumed)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("origin saw %d requests, want none", n)
+	}
+}
+
+// TestRewriteRedirectTarget: a Pattern rule rewrites where a redirect leads.
+func TestRewriteRedirectTarget(t *testing.T) {
+	t.Parallel()
+	data := testData(128 << 10)
+	var st stats
+	cache := httptest.NewServer(http.StripPrefix("/mirror", rangeHandler(data, `"v1"`, &st)))
+	t.Cleanup(cache.Close)
+	origin := httptest.NewServer(http.RedirectHandler("http://upstream.invalid/pkg/file.bin", http.StatusFound))
+	t.Cleanup(origin.Close)
+
+	d := newDL(t, &Options{
+		Parts: 2, MinPartSize: 16 << 10,
+		Rewrite: []RewriteRule{{Pattern: `http://upstream\.invalid/pkg/(.+)`, Replace: cache.URL + "/mirror/$1"}},
+	})
+	res, got := mustGet(t, d, origin.URL+"/latest", filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	if want := []string{cache.URL + "/mirror/file.bin"}; !slices.Equal(res.Redirects, want) {
+		t.Errorf("Redirects = %q, want %q", res.Redirects, want)
+	}
+}
+
+// TestRewriteWithholdsCredentials: credentials configured for the source
+// are not sent to a rewrite target on an unrelated host.
+func TestRewriteWithholdsCredentials(t *testing.T) {
+	t.Parallel()
+	data := testData(128 << 10)
+	var st stats
+	var leaked atomic.Int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			leaked.Add(1)
+		}
+		rangeHandler(data, `"v1"`, &st).ServeHTTP(w, r)
+	}))
+	t.Cleanup(mirror.Close)
+	// The origin is "localhost", the mirror 127.0.0.1: unrelated hosts.
+	source := "http://localhost:1/file.bin"
+
+	d := newDL(t, &Options{
+		Parts: 2, MinPartSize: 16 << 10,
+		Headers: http.Header{"Authorization": {"Bearer origin-token"}},
+		Rewrite: []RewriteRule{{Prefix: "http://localhost:1/", Replace: mirror.URL + "/"}},
+	})
+	_, got := mustGet(t, d, source, filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	if n := leaked.Load(); n != 0 {
+		t.Fatalf("mirror received the origin's Authorization on %d requests", n)
+	}
+}
+
+func TestRewriteFallback(t *testing.T) {
+	t.Parallel()
+	data := testData(64 << 10)
+	var st stats
+	origin := httptest.NewServer(rangeHandler(data, `"v1"`, &st))
+	t.Cleanup(origin.Close)
+	cache := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(cache.Close)
+	rule := RewriteRule{Prefix: origin.URL, Replace: cache.URL}
+
+	d := newDL(t, &Options{Rewrite: []RewriteRule{rule}})
+	if _, err := d.Get(t.Context(), origin.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin")); err == nil {
+		t.Fatal("download succeeded through a failing cache without Fallback")
+	}
+	if n := len(st.rangeHeaders()); n != 0 {
+		t.Fatalf("origin served %d requests without Fallback", n)
+	}
+
+	rule.Fallback = true
+	d = newDL(t, &Options{Rewrite: []RewriteRule{rule}})
+	_, got := mustGet(t, d, origin.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+}
+
+func TestRewriteRules(t *testing.T) {
+	t.Parallel()
+	for _, bad := range [][]RewriteRule{
+		{{}},
+		{{Prefix: "https://a/", Pattern: "https://a/.*", Replace: "https://b/"}},
+		{{Pattern: "https://a/(", Replace: "https://b/"}},
+	} {
+		if _, err := New(&Options{Rewrite: bad}); err == nil || !strings.Contains(err.Error(), "invalid Rewrite[0]") {
+			t.Errorf("New(Rewrite: %+v) err = %v, want an invalid Rewrite error", bad, err)
+		}
+	}
+
+	rw, err := newRewriter([]RewriteRule{
+		{Prefix: "https://updates.cdn-apple.com/", Replace: "http://artifact-cache.lan/apple/"},
+		{Pattern: `https://(\w+)\.example\.com/(.*)`, Replace: "http://cache.lan/${1}/$2"},
+		{Prefix: "https://bad.example.org/", Replace: "file:///tmp/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ in, want string }{
+		{"https://updates.cdn-apple.com/2024/ipsw.zip", "http://artifact-cache.lan/apple/2024/ipsw.zip"},
+		{"https://dl.example.com/a/b.tgz", "http://cache.lan/dl/a/b.tgz"},
+		{"https://example.net/x", "https://example.net/x"},
+	} {
+		if got, _, err := rw.rewrite(tc.in); err != nil || got != tc.want {
+			t.Errorf("rewrite(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+	if _, _, err := rw.rewrite("https://bad.example.org/f"); err == nil {
+		t.Error("rewrite to a file URL accepted")
+	}
+}
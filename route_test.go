@@ -0,0 +1,117 @@
+package download
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRouterTargets(t *testing.T) {
+	t.Parallel()
+	rt, err := newRouter(
+		map[string][]string{
+			"cdn.example:443":   {"192.0.2.1", "[2001:db8::1]"},
+			"edge.example:8443": {"192.0.2.9"},
+		},
+		map[string]string{
+			"Origin.Example:443": "edge.example:8443",
+			"any-port.example:":  ":9000",
+			":80":                "127.0.0.1:",
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		addr string
+		want []string
+	}{
+		{"cdn.example:443", []string{"192.0.2.1:443", "[2001:db8::1]:443"}},
+		{"CDN.example:443", []string{"192.0.2.1:443", "[2001:db8::1]:443"}},
+		{"cdn.example:80", []string{"127.0.0.1:80"}}, // wildcard host rule wins over no Resolve
+		{"origin.example:443", []string{"192.0.2.9:8443"}},
+		{"any-port.example:1234", []string{"any-port.example:9000"}},
+		{"other.example:443", []string{"other.example:443"}},
+	} {
+		if got := rt.targets(tc.addr); !slices.Equal(got, tc.want) {
+			t.Errorf("targets(%q) = %v, want %v", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestRouterValidation(t *testing.T) {
+	t.Parallel()
+	for name, tc := range map[string]struct {
+		resolve   map[string][]string
+		connectTo map[string]string
+	}{
+		"resolve without port":  {resolve: map[string][]string{"cdn.example": {"192.0.2.1"}}},
+		"resolve wildcard host": {resolve: map[string][]string{":443": {"192.0.2.1"}}},
+		"resolve to hostname":   {resolve: map[string][]string{"cdn.example:443": {"edge.example"}}},
+		"resolve no addresses":  {resolve: map[string][]string{"cdn.example:443": nil}},
+		"connect-to bad port":   {connectTo: map[string]string{"cdn.example:https": "edge:443"}},
+		"connect-to bad target": {connectTo: map[string]string{"cdn.example:443": "edge"}},
+		"connect-to port zero":  {connectTo: map[string]string{"cdn.example:443": "edge:0"}},
+	} {
+		if _, err := New(&Options{Resolve: tc.resolve, ConnectTo: tc.connectTo}); err == nil {
+			t.Errorf("%s: New accepted invalid rules", name)
+		}
+	}
+}
+
+// TestResolveKeepsHostAndServerName dials a TLS test server through a
+// Resolve pin: the request must carry the URL's Host, and the certificate
+// (issued for example.com) must verify against the original server name.
+func TestResolveKeepsHostAndServerName(t *testing.T) {
+	t.Parallel()
+	data := testData(64 << 10)
+	var st stats
+	h := rangeHandler(data, `"v1"`, &st)
+	hosts := make(chan string, 16)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	origin := net.JoinHostPort("example.com", port)
+
+	d := newDL(t, &Options{
+		Parts: 2, MinParts: 2, MinPartSize: 8 << 10,
+		TLSConfig: &tls.Config{RootCAs: srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs},
+		// The test server listens on 127.0.0.1 only: ::1 is refused (or
+		// unreachable) at once, exercising the in-order fallback.
+		Resolve: map[string][]string{origin: {"::1", "127.0.0.1"}},
+	})
+	_, got := mustGet(t, d, "https://"+origin+"/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	close(hosts)
+	for host := range hosts {
+		if host != origin {
+			t.Fatalf("request Host = %q, want %q", host, origin)
+		}
+	}
+}
+
+func TestConnectToRedirectsDial(t *testing.T) {
+	t.Parallel()
+	data := testData(32 << 10)
+	var st stats
+	srv := httptest.NewServer(rangeHandler(data, `"v1"`, &st))
+	t.Cleanup(srv.Close)
+
+	d := newDL(t, &Options{
+		ConnectTo: map[string]string{"origin.invalid:80": srv.Listener.Addr().String()},
+	})
+	_, got := mustGet(t, d, "http://origin.invalid/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+}
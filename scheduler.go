@@ -28,7 +28,9 @@ type chunk struct {
 // remainder. Resumed downloads seed pending with the
 // incomplete chunks from the sidecar. The ramp can retire excess workers via
 // demote: their unclaimed remainders move to pending and the flow limit
-// refuses them on their next visit.
+// refuses them on their next visit. Workers may be partitioned into flow
+// pools (one per source path); limits and retirement are per pool, while
+// pending work is shared by all of them.
 //
 // Locking: mu is a leaf lock, with one sanctioned exception — the onGrant and
 // onResize Reporter callbacks execute under it so grant/resize events reach
@@ -43,9 +45,11 @@ type scheduler struct {
 	// critical section — liveness is never split across calls.
 	live     map[int]struct{}
 	retiring map[int]struct{}
-	// limit caps concurrently granted (non-retiring) workers. 0 means
-	// unlimited; it is only ever lowered, and never below 1.
-	limit   int
+	// pools partitions workers by id modulo pools (see partition); limits
+	// caps each pool's concurrently granted (non-retiring) workers. 0 means
+	// unlimited; a limit is only ever lowered, and never below 1.
+	pools   int
+	limits  []int
 	minSize int64
 	nextID  int
 	// onGrant and onResize, when set, are called under mu as chunks are
@@ -53,6 +57,13 @@ type scheduler struct {
 	// a chunk's ChunkStart always precedes any ChunkResize touching it.
 	onGrant  func(id int, off, length, written int64)
 	onResize func(id int, length int64)
+	// horizon, when set, bounds how far ahead work is granted: pending
+	// chunks starting at or past horizon() are held back, lowest offset
+	// granted first, and workers finding only those wait (see wait) for
+	// advance instead of exiting. It is called under mu.
+	horizon func() int64
+	held    map[int]struct{} // workers next turned away for the horizon
+	moved   chan struct{}    // closed by advance; nil without waiters
 }
 
 func newScheduler(minSize int64) *scheduler {
@@ -60,10 +71,24 @@ func newScheduler(minSize int64) *scheduler {
 		active:   make(map[int]*chunk),
 		live:     make(map[int]struct{}),
 		retiring: make(map[int]struct{}),
+		held:     make(map[int]struct{}),
+		pools:    1,
+		limits:   make([]int, 1),
 		minSize:  minSize,
 	}
 }
 
+// partition splits workers into n flow pools by id modulo n. It must be
+// called before any worker registers.
+func (s *scheduler) partition(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pools = max(n, 1)
+	s.limits = make([]int, s.pools)
+}
+
+func (s *scheduler) poolOf(workerID int) int { return workerID % s.pools }
+
 // addPending registers a not-yet-owned chunk. done bytes at the front of the
 // range are already on disk (resume path).
 func (s *scheduler) addPending(off, end, done int64) {
@@ -122,14 +147,14 @@ func (s *scheduler) next(workerID int) *chunk {
 		s.deregisterLocked(workerID)
 		return nil
 	}
-	if s.limit > 0 && s.nonRetiringLiveLocked() > s.limit {
-		// Refusing this caller leaves at least limit >= 1 live workers.
+	if limit := s.limits[s.poolOf(workerID)]; limit > 0 &&
+		s.nonRetiringLiveLocked(s.poolOf(workerID)) > limit {
+		// Refusing this caller leaves at least limit >= 1 live workers in
+		// its pool.
 		s.deregisterLocked(workerID)
 		return nil
 	}
-	if len(s.pending) > 0 {
-		c := s.pending[0]
-		s.pending = s.pending[1:]
+	if c := s.takePendingLocked(); c != nil {
 		c.owner = workerID
 		s.active[c.id] = c
 		s.grantLocked(c)
@@ -153,10 +178,77 @@ func (s *scheduler) next(workerID int) *chunk {
 			return c
 		}
 	}
+	if len(s.pending) > 0 {
+		s.held[workerID] = struct{}{}
+	}
 	s.deregisterLocked(workerID)
 	return nil
 }
 
+// takePendingLocked removes and returns the pending chunk to grant next, if
+// any is within the horizon.
+func (s *scheduler) takePendingLocked() *chunk {
+	i := s.lowestPendingLocked()
+	if i < 0 {
+		return nil
+	}
+	c := s.pending[i]
+	s.pending = slices.Delete(s.pending, i, i+1)
+	return c
+}
+
+// lowestPendingLocked returns the index of the pending chunk to grant
+// next: the first one, or with a horizon the lowest one if it is within
+// it; -1 for none.
+func (s *scheduler) lowestPendingLocked() int {
+	if len(s.pending) == 0 {
+		return -1
+	}
+	if s.horizon == nil {
+		return 0
+	}
+	i := 0
+	for j, c := range s.pending {
+		if c.off < s.pending[i].off {
+			i = j
+		}
+	}
+	if s.pending[i].off >= s.horizon() {
+		return -1
+	}
+	return i
+}
+
+// wait returns what workerID waits on before calling next again when next
+// turned it away only for the horizon; nil when the worker should exit.
+func (s *scheduler) wait(workerID int) <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.held[workerID]; !ok {
+		return nil
+	}
+	delete(s.held, workerID)
+	if s.lowestPendingLocked() >= 0 {
+		moved := make(chan struct{}) // the horizon moved since next
+		close(moved)
+		return moved
+	}
+	if s.moved == nil {
+		s.moved = make(chan struct{})
+	}
+	return s.moved
+}
+
+// advance wakes the workers waiting for the horizon to move.
+func (s *scheduler) advance() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.moved != nil {
+		close(s.moved)
+		s.moved = nil
+	}
+}
+
 // exit deregisters workerID; idempotent. Only for abnormal unwinds (error or
 // context cancellation) — normal exits deregister inside next.
 func (s *scheduler) exit(workerID int) {
@@ -170,31 +262,37 @@ func (s *scheduler) deregisterLocked(workerID int) {
 	delete(s.retiring, workerID)
 }
 
-func (s *scheduler) nonRetiringLiveLocked() int {
-	n := len(s.live)
-	for id := range s.retiring {
-		if _, ok := s.live[id]; ok {
-			n--
+// nonRetiringLiveLocked counts pool's live workers not selected for
+// retirement.
+func (s *scheduler) nonRetiringLiveLocked(pool int) int {
+	n := 0
+	for id := range s.live {
+		if _, ok := s.retiring[id]; !ok && s.poolOf(id) == pool {
+			n++
 		}
 	}
 	return n
 }
 
-// demote caps concurrent flows at keep and selects exactly the excess
-// non-retiring live workers as retirement victims (preferring higher ids,
-// never the last keep survivors). Each victim's unclaimed remainder moves to
-// a fresh pending chunk and its active chunk shrinks to the claim cursor, so
-// the remainder is re-granted to a survivor while the victim finishes within
-// one buffer. Returns the victim ids for wakeup cancellation; assignment
-// coverage (remainingBytes) is conserved exactly.
-func (s *scheduler) demote(keep int) []int {
+// demote is demotePool for an unpartitioned scheduler.
+func (s *scheduler) demote(keep int) []int { return s.demotePool(0, keep) }
+
+// demotePool caps pool's concurrent flows at keep and selects exactly the
+// excess non-retiring live workers of that pool as retirement victims
+// (preferring higher ids, never the last keep survivors). Each victim's
+// unclaimed remainder moves to a fresh pending chunk and its active chunk
+// shrinks to the claim cursor, so the remainder is re-granted to a survivor
+// (of any pool) while the victim finishes within one buffer. Returns the
+// victim ids for wakeup cancellation; assignment coverage (remainingBytes)
+// is conserved exactly.
+func (s *scheduler) demotePool(pool, keep int) []int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	keep = max(keep, 1)
-	if s.limit == 0 || keep < s.limit {
-		s.limit = keep
+	if s.limits[pool] == 0 || keep < s.limits[pool] {
+		s.limits[pool] = keep
 	}
-	excess := s.nonRetiringLiveLocked() - keep
+	excess := s.nonRetiringLiveLocked(pool) - keep
 	if excess <= 0 {
 		return nil
 	}
@@ -202,7 +300,7 @@ func (s *scheduler) demote(keep int) []int {
 	for len(victims) < excess {
 		best := -1
 		for id := range s.live {
-			if _, ok := s.retiring[id]; ok {
+			if _, ok := s.retiring[id]; ok || s.poolOf(id) != pool {
 				continue
 			}
 			if !slices.Contains(victims, id) && id > best {
@@ -279,6 +377,21 @@ func (s *scheduler) remainingBytes() int64 {
 	return n
 }
 
+// writtenPrefix returns how many leading bytes of the total-byte file are
+// written: up to the first unwritten byte of any incomplete chunk.
+func (s *scheduler) writtenPrefix(total int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefix := total
+	for _, c := range s.pending {
+		prefix = min(prefix, c.off+c.written.Load())
+	}
+	for _, c := range s.active {
+		prefix = min(prefix, c.off+c.written.Load())
+	}
+	return prefix
+}
+
 // idle reports whether no work remains anywhere.
 func (s *scheduler) idle() bool {
 	s.mu.Lock()
@@ -212,16 +212,16 @@ func TestUnlimitedLimitCanBeLowered(t *testing.T) {
 	t.Parallel()
 	s := newScheduler(1)
 	s.demote(3)
-	if s.limit != 3 {
-		t.Fatalf("limit = %d after demote(3) from unlimited, want 3", s.limit)
+	if s.limits[0] != 3 {
+		t.Fatalf("limit = %d after demote(3) from unlimited, want 3", s.limits[0])
 	}
 	s.demote(5)
-	if s.limit != 3 {
-		t.Fatalf("limit = %d after demote(5), must never raise", s.limit)
+	if s.limits[0] != 3 {
+		t.Fatalf("limit = %d after demote(5), must never raise", s.limits[0])
 	}
 	s.demote(0)
-	if s.limit != 1 {
-		t.Fatalf("limit = %d after demote(0), want floor 1", s.limit)
+	if s.limits[0] != 1 {
+		t.Fatalf("limit = %d after demote(0), want floor 1", s.limits[0])
 	}
 }
 
@@ -391,3 +391,33 @@ func TestDemoteRaceTwoSurvivors(t *testing.T) {
 		t.Fatal("work stranded after single-survivor drain")
 	}
 }
+
+// TestDemotePoolIsolatesPools: with workers partitioned per source path,
+// demoting one pool selects victims and caps admission only in that pool;
+// the moved remainder is still shared work any pool may take.
+func TestDemotePoolIsolatesPools(t *testing.T) {
+	t.Parallel()
+	s := newScheduler(1)
+	s.partition(2)
+	for i := range 4 {
+		s.addPending(int64(i*100), int64(i*100+100), 0)
+	}
+	for id := range 4 { // pool 0: {0, 2}; pool 1: {1, 3}
+		if c := s.next(id); c == nil {
+			t.Fatalf("setup: worker %d refused", id)
+		}
+	}
+	victims := s.demotePool(1, 1)
+	if len(victims) != 1 || victims[0] != 3 {
+		t.Fatalf("demotePool(1, 1) victims = %v, want {3}", victims)
+	}
+	if s.limits[0] != 0 || s.limits[1] != 1 {
+		t.Fatalf("limits = %v, want [0 1]", s.limits)
+	}
+	if c := s.next(5); c != nil {
+		t.Fatal("pool 1 granted above its limit")
+	}
+	if c := s.next(4); c == nil {
+		t.Fatal("pool 0 refused: another pool's demotion leaked")
+	}
+}
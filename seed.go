@@ -0,0 +1,153 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+)
+
+// seedSampleSize is the length of each range compared against a partial
+// seed: its first, middle, and last seedSampleSize bytes.
+const seedSampleSize = 4 << 10
+
+// seedPrefix copies the leading bytes r.seedPath shares with the resource
+// into part (preallocated to r.total) and schedules the rest, returning the
+// bytes copied. A seed that cannot be checked, or fails the check, is
+// ignored.
+func (r *run) seedPrefix(ctx context.Context, part *os.File, sched *scheduler) (int64, error) {
+	seed, err := os.Open(r.seedPath)
+	if err != nil {
+		r.log.Debug("seed unavailable, fetching everything", "seed", r.seedPath, "err", err)
+		sched.addPending(0, r.total, 0)
+		return 0, nil
+	}
+	defer seed.Close()
+	size, err := r.checkSeed(ctx, seed)
+	if err != nil {
+		return 0, err
+	}
+	if size == 0 {
+		sched.addPending(0, r.total, 0)
+		return 0, nil
+	}
+	// The byte-zero stream would refetch what the seed holds.
+	r.closeInitial()
+	bp := r.d.bufs.Get().(*[]byte)
+	defer r.d.bufs.Put(bp)
+	if err := cloneSeed(part, seed, size, r.total, *bp); err != nil {
+		return 0, fmt.Errorf("copy seed %s: %w", r.seedPath, err)
+	}
+	if size < r.total {
+		sched.addPending(size, r.total, 0)
+	}
+	r.log.Debug("seeded", "seed", r.seedPath, "bytes", size, "total", r.total)
+	return size, nil
+}
+
+// checkSeed returns how many leading bytes of seed can be trusted to match
+// the resource: all of them when a seed of the resource's size has the
+// expected checksum, or when sample ranges fetched under the validator
+// match; 0 otherwise.
+func (r *run) checkSeed(ctx context.Context, seed *os.File) (int64, error) {
+	fi, err := seed.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		r.log.Debug("seed is not a regular file", "seed", r.seedPath)
+		return 0, nil
+	}
+	size := fi.Size()
+	switch {
+	case size == 0 || size > r.total:
+		r.log.Debug("seed size does not fit", "seed", r.seedPath, "size", size, "total", r.total)
+		return 0, nil
+	case size == r.total && r.checksumConfigured():
+		bp := r.d.bufs.Get().(*[]byte)
+		sum256, sum1, err := hashFile(seed, r.sha256 != "", r.sha1 != "", *bp)
+		r.d.bufs.Put(bp)
+		if err != nil {
+			return 0, err
+		}
+		if sum256 != r.sha256 || sum1 != r.sha1 {
+			r.log.Debug("seed checksum mismatch", "seed", r.seedPath)
+			return 0, nil
+		}
+		return size, nil
+	case r.validator() == "":
+		r.log.Debug("seed cannot be checked without a validator", "seed", r.seedPath)
+		return 0, nil
+	}
+	n := min(seedSampleSize, size)
+	offs := slices.Compact([]int64{0, (size - n) / 2, size - n})
+	want, got := make([]byte, n), make([]byte, n)
+	for _, off := range offs {
+		if _, err := seed.ReadAt(want, off); err != nil {
+			return 0, fmt.Errorf("read seed: %w", err)
+		}
+		if err := r.fetchSample(ctx, got, off); err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			r.log.Debug("seed sample failed", "seed", r.seedPath, "off", off, "err", err)
+			return 0, nil
+		}
+		if !bytes.Equal(got, want) {
+			r.log.Debug("seed sample mismatch", "seed", r.seedPath, "off", off)
+			return 0, nil
+		}
+	}
+	return size, nil
+}
+
+// fetchSample reads len(buf) bytes at off from r.url, bound to the
+// validator by If-Range.
+func (r *run) fetchSample(ctx context.Context, buf []byte, off int64) error {
+	req, err := r.newRequest(ctx)
+	if err != nil {
+		return err
+	}
+	r.applyHeaders(req)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(buf))-1))
+	req.Header.Set("If-Range", r.validator())
+	if err := r.d.prepare(req); err != nil {
+		return err
+	}
+	resp, err := r.d.newClient(r.d.roundTripper(), r.sourceURL).Do(req)
+	if err != nil {
+		fillPinHost(err)
+		return redactErr(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return StatusError(resp.StatusCode)
+	}
+	if start, _, _, err := parseContentRange(resp.Header.Get("Content-Range")); err != nil || start != off {
+		return errors.New("unexpected Content-Range")
+	}
+	_, err = io.ReadFull(resp.Body, buf)
+	return err
+}
+
+// cloneSeed puts the first size bytes of seed at the start of part, keeping
+// part total bytes long: a reflink of the whole seed when the filesystem
+// supports it, else a copy.
+func cloneSeed(part, seed *os.File, size, total int64, buf []byte) error {
+	if err := reflink(part, seed); err == nil {
+		return part.Truncate(total)
+	}
+	_, err := io.CopyBuffer(io.NewOffsetWriter(part, 0), io.NewSectionReader(seed, 0, size), buf)
+	return err
+}
+
+// sameFile reports whether paths a and b name the same existing file.
+func sameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	return err == nil && os.SameFile(fa, fb)
+}
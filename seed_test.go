@@ -0,0 +1,153 @@
+package download
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// TestSeedPartial: a seed holding the start of the resource is checked by
+// sample ranges and only the rest is fetched.
+func TestSeedPartial(t *testing.T) {
+	t.Parallel()
+	data := testData(512 << 10)
+	var served atomic.Int64
+	srv := httptest.NewServer(countingRanges(data, &served))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{Parts: 4, MinPartSize: 16 << 10})
+	dir := t.TempDir()
+	seed := filepath.Join(dir, "other-name.bin")
+	if err := os.WriteFile(seed, data[:300<<10], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: filepath.Join(dir, "file.bin"), Seed: seed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, res.Path, data)
+	assertClean(t, res.Path)
+	if res.Seeded != 300<<10 {
+		t.Errorf("Seeded = %d, want %d", res.Seeded, 300<<10)
+	}
+	if n, rest := served.Load(), int64(len(data)-300<<10); n > rest+3*seedSampleSize {
+		t.Errorf("served %d bytes, want the %d the seed lacks plus samples", n, rest)
+	}
+}
+
+// TestSeedIsDest: a half file left at the destination by another tool is
+// continued and replaced, without Overwrite.
+func TestSeedIsDest(t *testing.T) {
+	t.Parallel()
+	data := testData(256 << 10)
+	var served atomic.Int64
+	srv := httptest.NewServer(countingRanges(data, &served))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{Parts: 2, MinPartSize: 16 << 10})
+	dest := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(dest, data[:100<<10], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: dest, Seed: dest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, dest, data)
+	assertClean(t, dest)
+	if res.Seeded != 100<<10 {
+		t.Errorf("Seeded = %d, want %d", res.Seeded, 100<<10)
+	}
+}
+
+// TestSeedRejected: a seed whose samples disagree, one that cannot be
+// checked, and one too large are ignored for a full download.
+func TestSeedRejected(t *testing.T) {
+	t.Parallel()
+	data := testData(128 << 10)
+	dir := t.TempDir()
+	corrupt := bytes.Clone(data[:64<<10])
+	corrupt[len(corrupt)-1] ^= 0xFF
+	seeds := map[string][]byte{
+		"corrupt": corrupt,
+		"large":   append(bytes.Clone(data), 'x'),
+	}
+	for name, b := range seeds {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var served atomic.Int64
+	mux := http.NewServeMux()
+	mux.Handle("/v/", countingRanges(data, &served))
+	mux.HandleFunc("/bare/", func(w http.ResponseWriter, r *http.Request) {
+		writeBareRange(w, r, data, "") // no validator
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{Parts: 2, MinPartSize: 16 << 10})
+
+	for _, tc := range []struct{ path, seed string }{
+		{"/v/corrupt", "corrupt"},
+		{"/v/large", "large"},
+		{"/v/missing", "missing"},
+		{"/bare/unchecked", "corrupt"},
+	} {
+		res, err := d.Do(t.Context(), &Request{URL: srv.URL + tc.path, Dest: filepath.Join(dir, "out-"+path.Base(tc.path)),
+			Seed: filepath.Join(dir, tc.seed)})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.path, err)
+		}
+		assertFile(t, res.Path, data)
+		if res.Seeded != 0 {
+			t.Errorf("%s: Seeded = %d, want 0", tc.path, res.Seeded)
+		}
+	}
+
+	_, err := d.Do(t.Context(), &Request{URL: srv.URL + "/v/x", Dest: filepath.Join(dir, "x"),
+		Seed: filepath.Join(dir, "large"), Delta: &Delta{Control: "c", Seed: "s"}})
+	if err == nil || !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Errorf("Seed with Delta: err = %v", err)
+	}
+}
+
+// TestSeedComplete: a complete copy with the expected checksum needs no
+// ranges, even from a server without a validator.
+func TestSeedComplete(t *testing.T) {
+	t.Parallel()
+	data := testData(192 << 10)
+	sum := strings.TrimPrefix(sha256Digest(data), "sha256:")
+	var ranged atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rng := r.Header.Get("Range"); rng != "" && !strings.HasSuffix(rng, "-") {
+			ranged.Add(1)
+		}
+		writeBareRange(w, r, data, "")
+	}))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{Parts: 4, MinPartSize: 16 << 10})
+	dir := t.TempDir()
+	seed := filepath.Join(dir, "copy.bin")
+	if err := os.WriteFile(seed, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: filepath.Join(dir, "file.bin"),
+		Seed: seed, ExpectedSHA256: sum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, res.Path, data)
+	if res.Seeded != int64(len(data)) || res.SHA256 != sum {
+		t.Errorf("Seeded, SHA256 = %d, %q; want the whole verified seed", res.Seeded, res.SHA256)
+	}
+	if n := ranged.Load(); n != 0 {
+		t.Errorf("server saw %d part requests, want none", n)
+	}
+}
@@ -0,0 +1,85 @@
+package download
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// stagePoll is how often a stage waiting for the written prefix looks
+// again.
+const stagePoll = 20 * time.Millisecond
+
+// stage runs a sequential consumer of a multipart download (unpacking or
+// decompressing it) over the file's written prefix while parts are still
+// arriving. The consumer sees the bytes before they are verified: whatever
+// it produces must stay staged until they are.
+type stage struct {
+	done     chan struct{} // closed when fn has returned, with err
+	stop     chan struct{} // stops fn waiting for bytes
+	stopOnce sync.Once
+	err      error
+}
+
+// start runs fn over f as it is written: avail reports the length of its
+// written prefix, which reaches total when the download completes.
+func (s *stage) start(f *os.File, avail func() int64, total int64, fn func(*bufio.Reader) error) {
+	s.done, s.stop = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(s.done)
+		s.err = fn(bufio.NewReaderSize(&prefixReader{f: f, avail: avail, total: total, stop: s.stop}, 64<<10))
+	}()
+}
+
+func (s *stage) started() bool { return s.done != nil }
+
+// wait returns fn's result once the download is complete.
+func (s *stage) wait() error {
+	<-s.done
+	return s.err
+}
+
+// cancel stops a started fn and waits for it to return.
+func (s *stage) cancel() {
+	if s.done == nil {
+		return
+	}
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+// prefixReader reads a file that is still being written, as far as its
+// written prefix reaches.
+type prefixReader struct {
+	f     *os.File
+	off   int64
+	avail func() int64
+	total int64
+	stop  <-chan struct{}
+}
+
+func (p *prefixReader) Read(b []byte) (int, error) {
+	if p.off >= p.total {
+		return 0, io.EOF
+	}
+	var n int64
+	for {
+		if n = p.avail() - p.off; n > 0 {
+			break
+		}
+		select {
+		case <-p.stop:
+			return 0, errors.New("stage stopped")
+		case <-time.After(stagePoll):
+		}
+	}
+	k, err := p.f.ReadAt(b[:min(int64(len(b)), n)], p.off)
+	p.off += int64(k)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return k, err
+}
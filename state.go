@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"slices"
@@ -47,6 +48,18 @@ func sourceIdentity(source *url.URL) string {
 	return hex.EncodeToString(sum[:])
 }
 
+// requestIdentity extends sourceIdentity to requests other than a bodiless
+// GET, so resume data is only reused for the same method and body (bodySum
+// is its hex SHA-256). A plain GET keeps its source identity.
+func requestIdentity(source *url.URL, method, bodySum string) string {
+	id := sourceIdentity(source)
+	if id == "" || (method == http.MethodGet && bodySum == "") {
+		return id
+	}
+	sum := sha256.Sum256([]byte(id + "\n" + method + "\n" + bodySum))
+	return hex.EncodeToString(sum[:])
+}
+
 func statePath(partPath string) string { return partPath + ".json" }
 
 // save writes the sidecar atomically (tmp file + rename).
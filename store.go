@@ -0,0 +1,437 @@
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A store is the Options.CacheDir content-addressed download cache:
+//
+//	sha256/<hex>  objects, read-only; their mtime records the last use
+//	index/<key>   the hex digest last downloaded for a source and
+//	              validator (key = indexKey)
+//	tmp/          inserts in progress
+//
+// Objects are trusted once stored: they are verified (or hashed) on the way
+// in, not on every use. Several processes may share a store; every entry is
+// written to a temporary name and renamed into place.
+type store struct {
+	dir string
+	max int64      // bytes; 0 means no cap
+	mu  sync.Mutex // serializes this process's evictions
+}
+
+// newStore opens (creating) the store at dir; nil when dir is "".
+func newStore(dir string, maxBytes int64) (*store, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if maxBytes < 0 {
+		return nil, fmt.Errorf("invalid CacheMaxBytes %d: must be >= 0", maxBytes)
+	}
+	for _, sub := range []string{"sha256", "index", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("create cache dir: %w", err)
+		}
+	}
+	return &store{dir: dir, max: maxBytes}, nil
+}
+
+// indexKey names the index entry for a request identity (see
+// requestIdentity) and validator.
+func indexKey(identity, validator string) string {
+	sum := sha256.Sum256([]byte(identity + "\n" + validator))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *store) object(sum string) string { return filepath.Join(s.dir, "sha256", sum) }
+
+// lookup returns the path of the object with digest sum, marking it used;
+// "" when absent.
+func (s *store) lookup(sum string) string {
+	path := s.object(sum)
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		return ""
+	}
+	return path
+}
+
+// lookupIndex returns the digest and object path recorded under key; ""
+// when absent or evicted.
+func (s *store) lookupIndex(key string) (sum, path string) {
+	b, err := os.ReadFile(filepath.Join(s.dir, "index", key))
+	if err != nil {
+		return "", ""
+	}
+	sum, err = normalizeChecksum(strings.TrimSpace(string(b)), sha256HexLen, "index entry")
+	if err != nil || sum == "" {
+		return "", ""
+	}
+	if path = s.lookup(sum); path == "" {
+		return "", ""
+	}
+	return sum, path
+}
+
+// insert stores the installed file at path (hashing it when sum is ""),
+// records it under key unless key is "", and evicts beyond the cap. The
+// store gets its own extents (reflink or copy), never a hard link to path:
+// the caller may modify the file afterwards.
+func (s *store) insert(path, sum, key string, buf []byte) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if sum == "" {
+		if sum, _, err = hashFile(src, true, false, buf); err != nil {
+			return err
+		}
+	}
+	if s.lookup(sum) == "" {
+		fi, err := src.Stat()
+		if err != nil {
+			return err
+		}
+		if s.max > 0 && fi.Size() > s.max {
+			return nil // would evict everything, itself included
+		}
+		if err := s.writeObject(src, sum, buf); err != nil {
+			return err
+		}
+	}
+	if key != "" {
+		if err := s.writeFile(filepath.Join(s.dir, "index", key), []byte(sum+"\n"), 0o644); err != nil {
+			return err
+		}
+	}
+	return s.evict()
+}
+
+func (s *store) writeObject(src *os.File, sum string, buf []byte) error {
+	tmp, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), sum+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := reflink(tmp, src); err != nil {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err := io.CopyBuffer(tmp, src, buf); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Chmod(0o444); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.object(sum))
+}
+
+func (s *store) writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// evict removes the least recently used objects until the store fits its
+// cap, then the index entries left pointing at them.
+func (s *store) evict() error {
+	if s.max <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := os.ReadDir(filepath.Join(s.dir, "sha256"))
+	if err != nil {
+		return err
+	}
+	type object struct {
+		sum  string
+		size int64
+		used time.Time
+	}
+	var objects []object
+	var total int64
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue // evicted concurrently, or not ours
+		}
+		objects = append(objects, object{e.Name(), fi.Size(), fi.ModTime()})
+		total += fi.Size()
+	}
+	if total <= s.max {
+		return nil
+	}
+	slices.SortFunc(objects, func(a, b object) int { return a.used.Compare(b.used) })
+	evicted := make(map[string]bool)
+	for _, o := range objects {
+		if total <= s.max {
+			break
+		}
+		if err := os.Remove(s.object(o.sum)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		evicted[o.sum] = true
+		total -= o.size
+	}
+	index, err := os.ReadDir(filepath.Join(s.dir, "index"))
+	if err != nil {
+		return err
+	}
+	for _, e := range index {
+		path := filepath.Join(s.dir, "index", e.Name())
+		if b, err := os.ReadFile(path); err == nil && evicted[strings.TrimSpace(string(b))] {
+			_ = os.Remove(path)
+		}
+	}
+	return nil
+}
+
+// materialize installs a copy of the stored object obj at destPath: a
+// reflink where the filesystem supports it, else a hard link (sharing the
+// object's read-only inode) if link allows it, else a byte copy. It returns
+// which one. Without overwrite an existing destination is left alone
+// (ErrDestExists).
+func materialize(obj, destPath string, overwrite, link bool, buf []byte) (string, error) {
+	tmp, how, err := cloneObject(obj, destPath, link, buf)
+	if err != nil {
+		return "", fmt.Errorf("materialize %s: %w", destPath, err)
+	}
+	if overwrite {
+		if err := os.Rename(tmp, destPath); err != nil {
+			os.Remove(tmp)
+			return "", fmt.Errorf("rename %s -> %s: %w", tmp, destPath, err)
+		}
+		return how, nil
+	}
+	defer os.Remove(tmp) // the second name left by a no-replace install
+	return how, installNoReplace(tmp, destPath, os.Link)
+}
+
+// cloneObject copies obj to a new name beside destPath and returns it. The
+// name is created exclusively, so removing it never touches a file this
+// run did not create.
+func cloneObject(obj, destPath string, link bool, buf []byte) (tmp, how string, err error) {
+	src, err := os.Open(obj)
+	if err != nil {
+		return "", "", err
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp(filepath.Dir(destPath), filepath.Base(destPath)+".*.cache")
+	if err != nil {
+		return "", "", err
+	}
+	tmp = dst.Name()
+	switch {
+	case reflink(dst, src) == nil:
+		how = "reflink"
+	case link && os.Link(obj, tmp+".link") == nil: // os.Link never replaces
+		dst.Close()
+		os.Remove(tmp)
+		return tmp + ".link", "hardlink", nil
+	default:
+		how = "copy"
+		_, err = io.CopyBuffer(dst, src, buf)
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0o644) // CreateTemp's 0600 is for secrets
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", "", err
+	}
+	return tmp, how, nil
+}
+
+// serveStored installs the stored object obj (digest sum) at destPath for
+// rq, whose destination lock the caller holds. It returns nil when rq also
+// expects a SHA-1 the object does not have.
+func (d *Downloader) serveStored(rq *resolvedRequest, obj, sum, destPath string) (*Result, error) {
+	bp := d.bufs.Get().(*[]byte)
+	defer d.bufs.Put(bp)
+	res := &Result{Path: destPath}
+	if rq.sha256 != "" {
+		res.SHA256 = sum
+	}
+	if rq.sha1 != "" {
+		f, err := os.Open(obj)
+		if err != nil {
+			return nil, nil
+		}
+		_, sum1, err := hashFile(f, false, true, *bp)
+		f.Close()
+		if err != nil || sum1 != rq.sha1 {
+			return nil, nil
+		}
+		res.SHA1 = sum1
+	}
+	fi, err := os.Stat(obj)
+	if err != nil {
+		return nil, nil // evicted meanwhile
+	}
+	res.Size = fi.Size()
+	rq.rep.Start(Info{Name: filepath.Base(destPath), Total: res.Size})
+	if rq.extract != nil {
+		if err := unpackStored(rq, obj); err != nil {
+			return nil, err
+		}
+		res.Extracted = rq.extract.Dir
+		if !rq.extract.Keep {
+			res.Path = ""
+			return res, nil
+		}
+	}
+	// A file whose mode or metadata is set afterwards needs its own inode.
+	link := d.opt.FileMode == 0 && !d.opt.PreserveMetadata
+	if res.Materialized, err = materialize(obj, destPath, rq.overwrite, link, *bp); err != nil {
+		return nil, err
+	}
+	rq.log.Debug("materialized from cache dir", "path", destPath, "how", res.Materialized, "sha256", sum)
+	return res, nil
+}
+
+// unpackStored carries out rq's Extract from the stored object obj.
+func unpackStored(rq *resolvedRequest, obj string) error {
+	f, err := os.Open(obj)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	e, err := newExtraction(rq.extract, rq.log)
+	if err != nil {
+		return err
+	}
+	defer e.abort()
+	return e.finish(f, rq.overwrite)
+}
+
+// fromStore serves rq from the store by its ExpectedSHA256, without a
+// request; nil on a miss. nameURL names the file when rq.dest is a
+// directory.
+func (d *Downloader) fromStore(ctx context.Context, rq *resolvedRequest, nameURL string) (*Result, error) {
+	obj := d.store.lookup(rq.sha256)
+	if obj == "" {
+		return nil, nil
+	}
+	destPath, err := resolveDest(rq.dest, nameURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := acquireDestination(ctx, destPath)
+	if err != nil {
+		return nil, fmt.Errorf("lock destination %s: %w", destPath, err)
+	}
+	defer func() { unlock() }()
+	if d.opt.SkipValid && rq.extract == nil && !(rq.validChecked && destPath == rq.dest) {
+		if res := d.validExisting(destPath, rq.sha256, rq.sha1, -1, fileMeta{}, rq.log); res != nil {
+			return res, nil
+		}
+	}
+	srq := *rq
+	if err := rq.checkDest(destPath, rq.overwrite); err != nil {
+		switch rq.existsPolicy(destPath, err) {
+		case "overwrite":
+			srq.overwrite = true
+		case "skip":
+			return skipExisting(destPath)
+		case "rename":
+			unlock()
+			if destPath, unlock, err = claimNumbered(ctx, destPath); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, err
+		}
+	}
+	res, err := d.serveStored(&srq, obj, rq.sha256, destPath)
+	if res == nil || err != nil {
+		return res, err
+	}
+	// No request was made: the source URL is all there is to record.
+	return res, d.preserveStored(res, fileMeta{origin: redactURL(rq.url)}, rq.log)
+}
+
+// fromStore serves r from the store when its source and validator match a
+// stored download; nil on a miss.
+func (r *run) fromStore(rq *resolvedRequest) (*Result, error) {
+	v := r.validator()
+	if v == "" {
+		return nil, nil
+	}
+	sum, obj := r.d.store.lookupIndex(r.storeKey(v))
+	if obj == "" || (r.sha256 != "" && sum != r.sha256) {
+		return nil, nil
+	}
+	if fi, err := os.Stat(obj); err != nil || (r.total >= 0 && fi.Size() != r.total) {
+		return nil, nil
+	}
+	srq := *rq
+	srq.overwrite = r.overwrite // as fetch settled it
+	res, err := r.d.serveStored(&srq, obj, sum, r.destPath)
+	if res == nil || err != nil {
+		return res, err
+	}
+	res.ETag, res.LastModified, res.ContentType, res.Redirects = r.etag, r.lastMod, r.contentType, r.redirects
+	return res, r.d.preserveStored(res, r.meta(), rq.log)
+}
+
+// preserveStored applies preserve to a materialized file; serveStored
+// never hard-links one that preserve changes.
+func (d *Downloader) preserveStored(res *Result, m fileMeta, log *slog.Logger) error {
+	if res.Path == "" || (d.opt.FileMode == 0 && !d.opt.PreserveMetadata) {
+		return nil
+	}
+	return d.preserve(res.Path, m, log)
+}
+
+func (r *run) storeKey(validator string) string {
+	return indexKey(requestIdentity(r.sourceURL, r.sourceMethod, r.bodySum), validator)
+}
+
+// store inserts a finished download; failures only cost a future hit.
+func (r *run) store(res *Result) {
+	key := ""
+	if v := r.validator(); v != "" {
+		key = r.storeKey(v)
+	}
+	bp := r.d.bufs.Get().(*[]byte)
+	defer r.d.bufs.Put(bp)
+	if err := r.d.store.insert(res.Path, res.SHA256, key, *bp); err != nil {
+		r.log.Debug("cache dir insert failed", "path", res.Path, "err", err)
+	}
+}
@@ -0,0 +1,150 @@
+package download
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var materializations = []string{"reflink", "hardlink", "copy"}
+
+// TestCacheDirByDigest: a stored digest is materialized without a request,
+// into another directory and under the origin's name.
+func TestCacheDirByDigest(t *testing.T) {
+	t.Parallel()
+	data := testData(128 << 10)
+	sum := strings.TrimPrefix(sha256Digest(data), "sha256:")
+	var st stats
+	srv := httptest.NewServer(rangeHandler(data, `"v1"`, &st))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{Parts: 2, MinPartSize: 16 << 10, CacheDir: t.TempDir()})
+
+	first, err := d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: t.TempDir(), ExpectedSHA256: sum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Materialized != "" {
+		t.Errorf("first download Materialized = %q, want a fetch", first.Materialized)
+	}
+	served := len(st.rangeHeaders())
+
+	dir := t.TempDir()
+	mine := filepath.Join(dir, "file.bin.cache") // a user's file, not a temporary
+	if err := os.WriteFile(mine, []byte("mine"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: dir, ExpectedSHA256: sum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(materializations, res.Materialized) || res.SHA256 != sum {
+		t.Errorf("Materialized, SHA256 = %q, %q; want a verified store hit", res.Materialized, res.SHA256)
+	}
+	if want := filepath.Join(dir, "file.bin"); res.Path != want {
+		t.Errorf("Path = %q, want %q", res.Path, want)
+	}
+	assertFile(t, res.Path, data)
+	assertClean(t, res.Path)
+	if n := len(st.rangeHeaders()); n != served {
+		t.Errorf("server saw %d more requests, want none", n-served)
+	}
+
+	_, err = d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Dest: res.Path, ExpectedSHA256: sum})
+	if err == nil || !strings.Contains(err.Error(), ErrDestExists.Error()) {
+		t.Errorf("err = %v, want ErrDestExists", err)
+	}
+	assertFile(t, mine, []byte("mine"))
+	assertOnly(t, dir, "file.bin", "file.bin.cache")
+}
+
+// TestCacheDirByValidator: without a digest, the initial response's
+// validator finds the stored download; a new version is fetched.
+func TestCacheDirByValidator(t *testing.T) {
+	t.Parallel()
+	v1, v2 := testData(128<<10), bytes.Repeat([]byte{0x5A}, 96<<10)
+	var st stats
+	var current atomic.Pointer[http.Handler]
+	h := rangeHandler(v1, `"v1"`, &st)
+	current.Store(&h)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		(*current.Load()).ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{Parts: 2, MinPartSize: 16 << 10, CacheDir: t.TempDir()})
+
+	mustGet(t, d, srv.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	served := len(st.rangeHeaders())
+	res, got := mustGet(t, d, srv.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	if !slices.Contains(materializations, res.Materialized) || res.ETag != `"v1"` {
+		t.Errorf("Materialized, ETag = %q, %q; want a store hit for v1", res.Materialized, res.ETag)
+	}
+	if !bytes.Equal(got, v1) {
+		t.Fatal("materialized bytes differ from source")
+	}
+	if n := len(st.rangeHeaders()) - served; n != 1 {
+		t.Errorf("server saw %d requests, want only the initial one", n)
+	}
+
+	h = rangeHandler(v2, `"v2"`, &st)
+	current.Store(&h)
+	res, got = mustGet(t, d, srv.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	if res.Materialized != "" || !bytes.Equal(got, v2) {
+		t.Errorf("Materialized = %q; want v2 fetched", res.Materialized)
+	}
+}
+
+// TestCacheDirEvictsLeastRecentlyUsed: beyond CacheMaxBytes the object
+// used longest ago goes, with its index entry.
+func TestCacheDirEvictsLeastRecentlyUsed(t *testing.T) {
+	t.Parallel()
+	files := map[string][]byte{
+		"/a":    bytes.Repeat([]byte{'a'}, 64<<10),
+		"/b":    bytes.Repeat([]byte{'b'}, 64<<10),
+		"/c":    bytes.Repeat([]byte{'c'}, 64<<10),
+		"/huge": bytes.Repeat([]byte{'h'}, 256<<10),
+	}
+	var st stats
+	mux := http.NewServeMux()
+	for path, data := range files {
+		mux.Handle(path, rangeHandler(data, `"`+path[1:]+`"`, &st))
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	cacheDir := t.TempDir()
+	d := newDL(t, &Options{CacheDir: cacheDir, CacheMaxBytes: 150 << 10})
+
+	for _, path := range []string{"/a", "/b", "/a", "/c", "/huge"} {
+		time.Sleep(10 * time.Millisecond) // distinct use times
+		mustGet(t, d, srv.URL+path, filepath.Join(t.TempDir(), "out"))
+	}
+	objects, err := os.ReadDir(filepath.Join(cacheDir, "sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, o := range objects {
+		have = append(have, o.Name())
+	}
+	want := []string{
+		strings.TrimPrefix(sha256Digest(files["/a"]), "sha256:"),
+		strings.TrimPrefix(sha256Digest(files["/c"]), "sha256:"),
+	}
+	slices.Sort(want)
+	if !slices.Equal(have, want) {
+		t.Errorf("stored objects = %q, want a and c (b least recently used, huge over the cap)", have)
+	}
+	if index, _ := os.ReadDir(filepath.Join(cacheDir, "index")); len(index) != 2 {
+		t.Errorf("index has %d entries, want 2", len(index))
+	}
+
+	if _, err := New(&Options{CacheDir: t.TempDir(), CacheMaxBytes: -1}); err == nil {
+		t.Error("New accepted a negative CacheMaxBytes")
+	}
+}
@@ -0,0 +1,227 @@
+package download
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// streamWindow bounds the out-of-order bytes a Request.Writer download
+// holds in memory. Parts starting further ahead of the writer are not
+// fetched until it catches up; the tail of one that straddles the window
+// is spilled to a temporary file until its turn comes.
+const streamWindow = 32 << 20
+
+// reorderWriter is the sink of a Request.Writer download: parts write at
+// their offsets in any order, and bytes reach dst strictly in order.
+type reorderWriter struct {
+	mu      sync.Mutex
+	w       io.Writer // dst and the running hashes
+	sum256  hash.Hash // nil unless a SHA-256 is expected
+	sum1    hash.Hash // nil unless a SHA-1 is expected
+	base    int64     // bytes written to dst
+	mem     map[int64][]byte
+	memLen  int64
+	window  int64    // streamWindow
+	spill   *os.File // created on first use
+	spilled map[int64]int64
+	buf     []byte
+	err     error // sticky: dst failed
+
+	written atomic.Int64 // base, readable without mu
+	moved   func()       // called under mu as base advances; may be nil
+}
+
+func newReorderWriter(dst io.Writer, want256, want1 bool, buf []byte) *reorderWriter {
+	rw := &reorderWriter{mem: make(map[int64][]byte), spilled: make(map[int64]int64),
+		window: streamWindow, buf: buf}
+	ws := []io.Writer{dst}
+	if want256 {
+		rw.sum256 = sha256.New()
+		ws = append(ws, rw.sum256)
+	}
+	if want1 {
+		rw.sum1 = sha1.New()
+		ws = append(ws, rw.sum1)
+	}
+	rw.w = io.MultiWriter(ws...)
+	return rw
+}
+
+// WriteAt writes p to dst when it continues the stream, followed by any
+// held bytes it makes contiguous; otherwise it holds a copy of p.
+func (rw *reorderWriter) WriteAt(p []byte, off int64) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.err != nil {
+		return 0, rw.err
+	}
+	switch {
+	case off < rw.base:
+		return 0, fmt.Errorf("internal: offset %d already streamed (at %d)", off, rw.base)
+	case off > rw.base:
+		return len(p), rw.hold(p, off)
+	}
+	if err := rw.emit(p); err != nil {
+		return 0, err
+	}
+	return len(p), rw.drain()
+}
+
+// hold keeps p until the stream reaches off: in memory within the window,
+// in the spill file beyond it.
+func (rw *reorderWriter) hold(p []byte, off int64) error {
+	if rw.memLen+int64(len(p)) <= rw.window {
+		rw.mem[off] = append([]byte(nil), p...)
+		rw.memLen += int64(len(p))
+		return nil
+	}
+	if rw.spill == nil {
+		f, err := os.CreateTemp("", "dl-stream-*")
+		if err != nil {
+			return fmt.Errorf("stream spill: %w", err)
+		}
+		rw.spill = f
+	}
+	if _, err := rw.spill.WriteAt(p, off); err != nil {
+		return fmt.Errorf("stream spill: %w", err)
+	}
+	rw.spilled[off] = int64(len(p))
+	return nil
+}
+
+func (rw *reorderWriter) emit(p []byte) error {
+	n, err := rw.w.Write(p)
+	rw.base += int64(n)
+	rw.written.Store(rw.base)
+	if n > 0 && rw.moved != nil {
+		rw.moved()
+	}
+	if err != nil {
+		rw.err = fmt.Errorf("write stream: %w", err)
+	}
+	return rw.err
+}
+
+// drain writes held bytes while they continue the stream.
+func (rw *reorderWriter) drain() error {
+	for {
+		if p, ok := rw.mem[rw.base]; ok {
+			delete(rw.mem, rw.base)
+			rw.memLen -= int64(len(p))
+			if err := rw.emit(p); err != nil {
+				return err
+			}
+			continue
+		}
+		n, ok := rw.spilled[rw.base]
+		if !ok {
+			return nil
+		}
+		delete(rw.spilled, rw.base)
+		off := rw.base
+		if _, err := io.CopyBuffer(writerFunc(rw.emit), io.NewSectionReader(rw.spill, off, n), rw.buf); err != nil {
+			if rw.err == nil {
+				rw.err = fmt.Errorf("stream spill: %w", err)
+			}
+			return rw.err
+		}
+	}
+}
+
+// writerFunc adapts emit to io.Writer for CopyBuffer.
+type writerFunc func([]byte) error
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	if err := f(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Truncate restarts the stream, which is only possible before any byte
+// reached dst: a single-stream retry after that fails the download.
+func (rw *reorderWriter) Truncate(size int64) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if size != 0 || rw.base != 0 || len(rw.mem) > 0 || len(rw.spilled) > 0 {
+		return fmt.Errorf("cannot restart a stream after %d bytes were written", rw.base)
+	}
+	return nil
+}
+
+func (rw *reorderWriter) Name() string { return "stream" }
+
+func (rw *reorderWriter) close() {
+	if rw.spill != nil {
+		_ = rw.spill.Close()
+		_ = os.Remove(rw.spill.Name())
+	}
+}
+
+// stream downloads r.url to dst: in parts when multipart, reordered through
+// a reorderWriter, otherwise as one sequential stream. The length and
+// checksums are verified once the last byte is written; dst has received
+// every byte by then, so a mismatch can only be reported.
+func (r *run) stream(ctx context.Context, dst io.Writer, multipart bool) (*Result, error) {
+	bp := r.d.bufs.Get().(*[]byte)
+	defer r.d.bufs.Put(bp)
+	window := cmp.Or(r.d.streamWindow, streamWindow)
+	out := newReorderWriter(dst, r.sha256 != "", r.sha1 != "", *bp)
+	out.window = window
+	defer out.close()
+
+	r.rep.Start(Info{Name: r.name(), Total: r.total})
+	if multipart {
+		// Parts granted in order, each a fraction of the window, keep every
+		// connection busy; none starts past the window, so a stalled part
+		// holds the others back rather than spilling the file to disk.
+		sched := newScheduler(r.d.opt.MinPartSize)
+		sched.horizon = func() int64 { return out.written.Load() + window }
+		out.moved = sched.advance
+		seg := max(r.d.opt.MinPartSize, window/int64(2*r.parts))
+		for off := int64(0); off < r.total; off += seg {
+			sched.addPending(off, min(off+seg, r.total), 0)
+		}
+		if err := r.runWorkers(ctx, sched, out, nil); err != nil {
+			return nil, err
+		}
+	} else if err := newWorker(0, r, nil, out).singleStream(ctx); err != nil {
+		return nil, err
+	}
+
+	if r.total >= 0 && out.base != r.total {
+		return nil, &SizeError{Expected: r.total, Actual: out.base}
+	}
+	if len(out.mem) > 0 || len(out.spilled) > 0 {
+		return nil, errors.New("internal: stream ended with bytes out of order")
+	}
+	res := &Result{
+		Size:         out.base,
+		ETag:         r.etag,
+		LastModified: r.lastMod,
+		ContentType:  r.contentType,
+		WarmConns:    r.warmUsed,
+		Redirects:    r.redirects,
+	}
+	if out.sum256 != nil {
+		if res.SHA256 = hex.EncodeToString(out.sum256.Sum(nil)); res.SHA256 != r.sha256 {
+			return nil, &ChecksumError{Algo: "sha256", Expected: r.sha256, Actual: res.SHA256}
+		}
+	}
+	if out.sum1 != nil {
+		if res.SHA1 = hex.EncodeToString(out.sum1.Sum(nil)); res.SHA1 != r.sha1 {
+			return nil, &ChecksumError{Algo: "sha1", Expected: r.sha1, Actual: res.SHA1}
+		}
+	}
+	return res, nil
+}
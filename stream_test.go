@@ -0,0 +1,150 @@
+package download
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStreamParts: a multipart download to a Writer arrives in order and
+// verified, from parts and from a server ignoring Range.
+func TestStreamParts(t *testing.T) {
+	t.Parallel()
+	data := testData(1 << 20)
+	sum := strings.TrimPrefix(sha256Digest(data), "sha256:")
+	var st, plain stats
+	parts := httptest.NewServer(rangeHandler(data, `"v1"`, &st))
+	t.Cleanup(parts.Close)
+	single := httptest.NewServer(plainHandler(data, &plain))
+	t.Cleanup(single.Close)
+	d := newDL(t, &Options{Parts: 4, MinPartSize: 16 << 10})
+
+	for _, url := range []string{parts.URL + "/file.bin", single.URL + "/file.bin"} {
+		var buf bytes.Buffer
+		res, err := d.Do(t.Context(), &Request{URL: url, Writer: &buf, ExpectedSHA256: sum})
+		if err != nil {
+			t.Fatalf("%s: %v", url, err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("%s: streamed %d bytes, not the resource", url, buf.Len())
+		}
+		if res.Path != "" || res.Size != int64(len(data)) || res.SHA256 != sum {
+			t.Errorf("%s: Path, Size, SHA256 = %q, %d, %q", url, res.Path, res.Size, res.SHA256)
+		}
+	}
+}
+
+// TestStreamChecksumMismatch: the stream is written, then fails.
+func TestStreamChecksumMismatch(t *testing.T) {
+	t.Parallel()
+	data := testData(256 << 10)
+	var st stats
+	srv := httptest.NewServer(rangeHandler(data, `"v1"`, &st))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{Parts: 2, MinPartSize: 16 << 10})
+
+	var buf bytes.Buffer
+	_, err := d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Writer: &buf,
+		ExpectedSHA256: strings.Repeat("0", 64)})
+	ce, ok := errors.AsType[*ChecksumError](err)
+	if !ok {
+		t.Fatalf("err = %v, want a ChecksumError", err)
+	}
+	if ce.Path != "" || buf.Len() != len(data) {
+		t.Errorf("Path = %q, streamed %d bytes; want no file and the whole stream", ce.Path, buf.Len())
+	}
+
+	for _, req := range []*Request{
+		{URL: srv.URL, Writer: &buf, Dest: "x"},
+		{URL: srv.URL, Writer: &buf, Seed: "x"},
+		{URL: srv.URL, Writer: &buf, Decompress: "gzip"},
+	} {
+		if _, err := d.Do(t.Context(), req); err == nil || !strings.Contains(err.Error(), "Writer") {
+			t.Errorf("%+v: err = %v", req, err)
+		}
+	}
+}
+
+// TestReorderWriterSpill: parts beyond the window wait in the spill file
+// and are written in order.
+func TestReorderWriterSpill(t *testing.T) {
+	t.Parallel()
+	data := testData(64 << 10)
+	var buf bytes.Buffer
+	rw := newReorderWriter(&buf, false, false, make([]byte, 1<<10))
+	rw.window = 8 << 10
+	t.Cleanup(rw.close)
+	const piece = 4 << 10
+	for off := len(data) - piece; off >= 0; off -= piece {
+		if _, err := rw.WriteAt(data[off:off+piece], int64(off)); err != nil {
+			t.Fatal(err)
+		}
+		if off == piece && rw.spill == nil {
+			t.Fatal("nothing spilled past the window")
+		}
+	}
+	if !bytes.Equal(buf.Bytes(), data) || len(rw.mem) > 0 || len(rw.spilled) > 0 {
+		t.Fatalf("wrote %d bytes in order, %d held", buf.Len(), len(rw.mem)+len(rw.spilled))
+	}
+	if err := rw.Truncate(0); err == nil {
+		t.Error("restarted a written stream")
+	}
+	if _, err := rw.WriteAt(data[:1], 0); err == nil {
+		t.Error("rewrote a streamed offset")
+	}
+}
+
+// TestStreamStalledPartBoundsLookahead: while the first part stalls, no
+// part starting past the window is fetched, so at most the tail of one
+// part straddling it is held on disk.
+func TestStreamStalledPartBoundsLookahead(t *testing.T) {
+	t.Parallel()
+	data := testData(512 << 10)
+	const window = 64 << 10
+	var st stats
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if start, ok := parseRangeStart(r.Header.Get("Range")); ok && start == 0 {
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(data)-1, len(data)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(data[:1<<10])
+			w.(http.Flusher).Flush()
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+			_, _ = w.Write(data[1<<10:])
+			return
+		}
+		rangeHandler(data, `"v1"`, &st).ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{Parts: 4, MinParts: 4, MinPartSize: 8 << 10})
+	d.streamWindow = window
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		for _, start := range st.rangeStarts() {
+			if start >= window {
+				t.Errorf("fetched from %d while the first part stalled, past the %d-byte window", start, window)
+			}
+		}
+		close(release)
+	}()
+	var buf bytes.Buffer
+	if _, err := d.Do(t.Context(), &Request{URL: srv.URL + "/file.bin", Writer: &buf}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("streamed bytes differ from source")
+	}
+}
@@ -369,3 +369,15 @@ func (f *flowLog) firstAtLeast(n int) time.Time {
 func (f *flowLog) longestAt(n int) time.Duration {
 	return f.longestSpan(func(c int) bool { return c >= n }, time.Time{})
 }
+
+// defaultRun fills r's per-request settings from its Downloader's Options,
+// as Do does for a Request without overrides.
+func defaultRun(t *testing.T, r *run) *run {
+	t.Helper()
+	var rq resolvedRequest
+	if err := r.d.resolveOverrides(&Request{}, &rq); err != nil {
+		t.Fatal(err)
+	}
+	r.useSettings(&rq)
+	return r
+}
@@ -0,0 +1,337 @@
+package download
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// newPathTransports builds the internal transports, one per source path:
+// a single system-routed path without Options.LocalAddrs, otherwise one per
+// address. Separate transports keep separate idle pools, so a connection
+// dialed from one address is never reused by a worker bound to another.
+// The path dialers are kept for per-flow transports (see flowTransport).
+func (d *Downloader) newPathTransports() []*http.Transport {
+	if len(d.opt.LocalAddrs) == 0 {
+		d.pathDials = []dialFunc{d.unixOr(d.routed(d.dialContext))}
+	} else {
+		d.pathDials = make([]dialFunc, len(d.opt.LocalAddrs))
+		for i, local := range d.opt.LocalAddrs {
+			d.pathDials[i] = d.unixOr(d.routed(localDialer(local)))
+		}
+	}
+	paths := make([]*http.Transport, len(d.pathDials))
+	for i, dial := range d.pathDials {
+		paths[i] = newTransport(d.opt, observed(dial))
+	}
+	return paths
+}
+
+// dialHookKey keys a func(net.Conn) in a dial's context that is shown the
+// connection the dial produced. Warm-up uses it to learn the connection
+// behind an http.ClientConn, which does not expose it.
+type dialHookKey struct{}
+
+// observed runs dial and passes a successful connection to the context's
+// dial hook, if any.
+func observed(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if hook, ok := ctx.Value(dialHookKey{}).(func(net.Conn)); ok && err == nil {
+			hook(conn)
+		}
+		return conn, err
+	}
+}
+
+// flowTransport returns the transport a worker on source path p uses for
+// its own requests, and whether the worker owns it. With Options.HTTP2 every
+// worker gets a private transport: h2 would otherwise multiplex all of them
+// onto the path's one pooled connection, while a private pool keeps one
+// TCP flow per worker as the ramp assumes. The owner must close its idle
+// connections when it exits.
+func (d *Downloader) flowTransport(p int) (http.RoundTripper, *http.Transport) {
+	if d.opt.Transport != nil {
+		return d.opt.Transport, nil
+	}
+	if !d.opt.HTTP2 {
+		return d.paths[p], nil
+	}
+	tr := newTransport(d.opt, d.pathDials[p])
+	return tr, tr
+}
+
+// unixHostSuffix ends the synthetic host a unix:// URL's requests are sent
+// to. The labels before it hex-encode the socket path, so the dialer can
+// recover it without shared state and each socket gets its own idle pool.
+const unixHostSuffix = ".unix.invalid"
+
+// unixSocketKey keys, in a unix:// download's context, the socket path its
+// synthetic host stands for. Only requests made under that context are
+// routed to the socket: an http URL, rewrite or redirect that merely names
+// a synthetic host must not reach a local socket.
+type unixSocketKey struct{}
+
+// unixRoute returns the socket a request to host under ctx is sent to, if
+// any. A synthetic unix host other than the one ctx's download was started
+// for is an error.
+func unixRoute(ctx context.Context, host string) (string, bool, error) {
+	if !strings.HasSuffix(strings.ToLower(host), unixHostSuffix) {
+		return "", false, nil
+	}
+	socket, ok := unixSocketOf(host)
+	if want, _ := ctx.Value(unixSocketKey{}).(string); !ok || want == "" || socket != want {
+		return "", false, fmt.Errorf("host %s is reserved for unix:// URLs", host)
+	}
+	return socket, true, nil
+}
+
+// unixOr dials Options.UnixSocket, or the socket named by a unix:// URL's
+// synthetic host, instead of TCP; any other target goes to dial.
+func (d *Downloader) unixOr(dial dialFunc) dialFunc {
+	unixDial := (&net.Dialer{Timeout: 30 * time.Second}).DialContext
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if d.opt.UnixSocket != "" {
+			return unixDial(ctx, "unix", d.opt.UnixSocket)
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil {
+			socket, ok, err := unixRoute(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return unixDial(ctx, "unix", socket)
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// proxyFor returns the internal transport's proxy selector: Options.Proxy
+// (default: the environment), except that socket connections never go
+// through a proxy. It also refuses synthetic unix hosts outside their
+// unix:// download, which keeps them off pooled socket connections.
+func proxyFor(o Options) func(*http.Request) (*url.URL, error) {
+	if o.UnixSocket != "" {
+		return nil
+	}
+	proxy := o.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if _, ok, err := unixRoute(req.Context(), req.URL.Hostname()); ok || err != nil {
+			return nil, err
+		}
+		return proxy(req)
+	}
+}
+
+// unixRequestURL maps unix:///path/to.sock:/request/path?query to the
+// plain-HTTP URL the transport actually requests: the socket path moves
+// into a synthetic host and the remainder becomes the request path.
+func unixRequestURL(u *url.URL) (*url.URL, error) {
+	socket, reqPath, ok := strings.Cut(u.Path, ":")
+	if !ok || u.Host != "" || !path.IsAbs(socket) || !strings.HasPrefix(reqPath, "/") {
+		return nil, errors.New("invalid unix URL: want unix:///path/to.sock:/request/path")
+	}
+	enc := hex.EncodeToString([]byte(socket))
+	var labels []string
+	for len(enc) > 0 {
+		n := min(len(enc), 62) // DNS labels are at most 63 bytes
+		labels = append(labels, "x"+enc[:n])
+		enc = enc[n:]
+	}
+	return &url.URL{
+		Scheme:   "http",
+		Host:     strings.Join(labels, ".") + unixHostSuffix,
+		Path:     reqPath,
+		RawQuery: u.RawQuery,
+	}, nil
+}
+
+// unixSocketOf decodes a synthetic unix host back to its socket path.
+func unixSocketOf(host string) (string, bool) {
+	encoded, ok := strings.CutSuffix(strings.ToLower(host), unixHostSuffix)
+	if !ok {
+		return "", false
+	}
+	var enc strings.Builder
+	for label := range strings.SplitSeq(encoded, ".") {
+		hexPart, ok := strings.CutPrefix(label, "x")
+		if !ok {
+			return "", false
+		}
+		enc.WriteString(hexPart)
+	}
+	socket, err := hex.DecodeString(enc.String())
+	if err != nil {
+		return "", false
+	}
+	return string(socket), true
+}
+
+// dialFunc is the shape of http.Transport.DialContext.
+type dialFunc = func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// routed applies the dial-target rules (Options.ConnectTo, then
+// Options.Resolve) in front of dial. Each candidate is tried in order and
+// the first error is reported when all fail, as curl does. The request URL
+// is untouched, so the Host header and TLS server name stay the original.
+func (d *Downloader) routed(dial dialFunc) dialFunc {
+	if d.route == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var firstErr error
+		for _, target := range d.route.targets(addr) {
+			conn, err := dial(ctx, network, target)
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, firstErr
+	}
+}
+
+// router holds the normalized Options.ConnectTo and Options.Resolve rules.
+// Keys are lower-case "host:port" (IPv6 hosts bracketed); a ConnectTo key
+// may leave either part empty to match any host or port.
+type router struct {
+	connectTo map[string]string
+	resolve   map[string][]string
+}
+
+// newRouter validates and normalizes the routing options; nil means no
+// rules.
+func newRouter(resolve map[string][]string, connectTo map[string]string) (*router, error) {
+	if len(resolve) == 0 && len(connectTo) == 0 {
+		return nil, nil
+	}
+	rt := &router{
+		connectTo: make(map[string]string, len(connectTo)),
+		resolve:   make(map[string][]string, len(resolve)),
+	}
+	for key, addrs := range resolve {
+		host, port, err := splitRouteAddr(key, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Resolve key %q: %w", key, err)
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("invalid Resolve %q: no addresses", key)
+		}
+		ips := make([]string, len(addrs))
+		for i, a := range addrs {
+			ip, err := netip.ParseAddr(strings.Trim(a, "[]"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid Resolve %q address %q: want an IP address", key, a)
+			}
+			ips[i] = ip.String()
+		}
+		rt.resolve[net.JoinHostPort(host, port)] = ips
+	}
+	for key, target := range connectTo {
+		host, port, err := splitRouteAddr(key, true)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ConnectTo key %q: %w", key, err)
+		}
+		toHost, toPort, err := splitRouteAddr(target, true)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ConnectTo %q target %q: %w", key, target, err)
+		}
+		rt.connectTo[net.JoinHostPort(host, port)] = net.JoinHostPort(toHost, toPort)
+	}
+	return rt, nil
+}
+
+// splitRouteAddr splits and normalizes "host:port". With wildcard, either
+// part may be empty.
+func splitRouteAddr(s string, wildcard bool) (host, port string, err error) {
+	host, port, err = net.SplitHostPort(s)
+	if err != nil {
+		return "", "", err
+	}
+	if !wildcard && (host == "" || port == "") {
+		return "", "", errors.New("want host:port")
+	}
+	if port != "" {
+		if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+			return "", "", fmt.Errorf("invalid port %q", port)
+		}
+	}
+	return strings.ToLower(host), port, nil
+}
+
+// targets returns the addresses to dial, in order, for a transport dial to
+// addr: the ConnectTo rule (most specific match first) rewrites the host
+// and/or port, then a Resolve entry for the result replaces DNS.
+func (rt *router) targets(addr string) []string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return []string{addr}
+	}
+	host = strings.ToLower(host)
+	for _, key := range []string{
+		net.JoinHostPort(host, port), net.JoinHostPort(host, ""),
+		net.JoinHostPort("", port), net.JoinHostPort("", ""),
+	} {
+		to, ok := rt.connectTo[key]
+		if !ok {
+			continue
+		}
+		toHost, toPort, _ := net.SplitHostPort(to)
+		if toHost != "" {
+			host = toHost
+		}
+		if toPort != "" {
+			port = toPort
+		}
+		break
+	}
+	ips, ok := rt.resolve[net.JoinHostPort(host, port)]
+	if !ok {
+		return []string{net.JoinHostPort(host, port)}
+	}
+	out := make([]string, len(ips))
+	for i, ip := range ips {
+		out[i] = net.JoinHostPort(ip, port)
+	}
+	return out
+}
+
+// localDialer returns a TCP dialer bound to source address local. The
+// kernel selects the outgoing interface from the bound address; a target
+// of the other address family is skipped by net.Dialer's address filter.
+func localDialer(local netip.Addr) dialFunc {
+	return (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: net.TCPAddrFromAddrPort(netip.AddrPortFrom(local, 0)),
+	}).DialContext
+}
+
+// pools returns the number of source paths workers are spread across. A
+// user-supplied Transport is a single opaque path.
+func (d *Downloader) pools() int {
+	return max(len(d.paths), 1)
+}
+
+// pathFor returns the source path serving worker id: workers are assigned
+// round-robin, the same partition the scheduler and the per-path ramps use.
+func (d *Downloader) pathFor(id int) int { return id % d.pools() }
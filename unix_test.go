@@ -0,0 +1,160 @@
+package download
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// newUnixServer serves h on a Unix socket. The socket lives in a short
+// os.MkdirTemp directory: t.TempDir paths can exceed the 104-byte sun_path
+// limit on macOS.
+func newUnixServer(t *testing.T, h http.Handler) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "dl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "s.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(h)
+	srv.Listener = ln
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return socket
+}
+
+// hostRecorder wraps h and records every request's Host header.
+type hostRecorder struct {
+	h     http.Handler
+	mu    sync.Mutex
+	hosts []string
+}
+
+func (hr *hostRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hr.mu.Lock()
+	hr.hosts = append(hr.hosts, r.Host)
+	hr.mu.Unlock()
+	hr.h.ServeHTTP(w, r)
+}
+
+func TestUnixSocketOption(t *testing.T) {
+	t.Parallel()
+	data := testData(256 << 10)
+	var st stats
+	hr := &hostRecorder{h: rangeHandler(data, `"v1"`, &st)}
+	socket := newUnixServer(t, hr)
+
+	d := newDL(t, &Options{Parts: 4, MinParts: 4, MinPartSize: 16 << 10, UnixSocket: socket})
+	_, got := mustGet(t, d, "http://artifacts.internal/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	if n := len(st.rangeHeaders()); n < 2 {
+		t.Fatalf("server saw %d requests, want per-part requests over the socket", n)
+	}
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	for _, h := range hr.hosts {
+		if h != "artifacts.internal" {
+			t.Fatalf("Host = %q, want the URL host", h)
+		}
+	}
+}
+
+func TestUnixURL(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("unix:// URLs name sockets by absolute slash-separated paths")
+	}
+	data := testData(256 << 10)
+	var st stats
+	hr := &hostRecorder{h: rangeHandler(data, `"v1"`, &st)}
+	socket := newUnixServer(t, hr)
+
+	d := newDL(t, &Options{Parts: 4, MinParts: 4, MinPartSize: 16 << 10})
+	dir := t.TempDir()
+	res, got := mustGet(t, d, "unix://"+filepath.ToSlash(socket)+":/blobs/file.bin?v=1", dir)
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	if filepath.Base(res.Path) != "file.bin" {
+		t.Fatalf("derived name %q, want file.bin", filepath.Base(res.Path))
+	}
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	for _, h := range hr.hosts {
+		if h != "localhost" {
+			t.Fatalf("Host = %q, want localhost", h)
+		}
+	}
+}
+
+func TestUnixRequestURLRoundTrip(t *testing.T) {
+	t.Parallel()
+	long := "/" + string(bytes.Repeat([]byte("d"), 90)) + "/daemon.sock"
+	for _, socket := range []string{"/run/cache.sock", long} {
+		u, err := unixRequestURL(&url.URL{Scheme: "unix", Path: socket + ":/v2/blob"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Path != "/v2/blob" {
+			t.Errorf("request path = %q, want /v2/blob", u.Path)
+		}
+		if got, ok := unixSocketOf(u.Hostname()); !ok || got != socket {
+			t.Errorf("unixSocketOf(%q) = %q, %t; want %q", u.Hostname(), got, ok, socket)
+		}
+		if _, err := url.Parse(u.String()); err != nil {
+			t.Errorf("synthetic URL does not parse: %v", err)
+		}
+	}
+	for _, bad := range []string{"unix://host/s.sock:/x", "unix:///s.sock", "unix://relative.sock:/x", "unix:///s.sock:x"} {
+		u, _ := url.Parse(bad)
+		if _, err := unixRequestURL(u); err == nil {
+			t.Errorf("unixRequestURL(%q) accepted a malformed unix URL", bad)
+		}
+	}
+	if _, ok := unixSocketOf("cdn.example"); ok {
+		t.Error("ordinary host decoded as a socket")
+	}
+}
+
+func TestUnixHostOutsideUnixURL(t *testing.T) {
+	t.Parallel()
+	var st stats
+	hr := &hostRecorder{h: rangeHandler(testData(1<<10), `"v1"`, &st)}
+	socket := newUnixServer(t, hr)
+	u, err := unixRequestURL(&url.URL{Scheme: "unix", Path: filepath.ToSlash(socket) + ":/secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.RedirectHandler(u.String(), http.StatusFound))
+	t.Cleanup(srv.Close)
+
+	d := newDL(t, &Options{})
+	dir := t.TempDir()
+	for _, src := range []string{srv.URL + "/file.bin", u.String()} {
+		if _, err := d.Do(t.Context(), &Request{URL: src, Dest: filepath.Join(dir, "file.bin")}); err == nil {
+			t.Errorf("%s: download reached the socket", src)
+		}
+	}
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	if n := len(hr.hosts); n != 0 {
+		t.Fatalf("socket server saw %d requests, want none", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "file.bin")); !os.IsNotExist(err) {
+		t.Fatalf("destination installed: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package download
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// warmPool holds connections pre-established while the election body
+// streams: the eagerly started flows and the ramp's first batch. An admitted
+// worker then starts delivering on its first round trip instead of paying
+// the dial and TLS handshake that settleFloorFor budgets for. Slots are
+// claimed in dial order per source path; a worker that claims a slot still
+// dialing waits for it rather than racing it with a dial of its own.
+type warmPool struct {
+	scheme, addr string // the origin every slot is connected to
+	cancel       context.CancelFunc
+	mu           sync.Mutex
+	slots        [][]*warmSlot // unclaimed, per source path
+	all          []*warmSlot
+	used         atomic.Int64 // slots a request completed a round trip on
+}
+
+// warmSlot is one pre-established connection. ready is closed once the dial
+// finished; cc is nil when it failed.
+type warmSlot struct {
+	ready  chan struct{}
+	cc     *http.ClientConn
+	conn   net.Conn // the dialed connection behind cc, for Reporter.Connected
+	inUse  bool     // handed to a worker, which then owns cc
+	reused bool
+	served bool // a round trip on cc succeeded (counted in used)
+}
+
+// startWarm dials counts[p] connections to the run's origin on each source
+// path p. It returns nil when there is nothing to warm or the connections
+// are not the internal transport's to make.
+func (r *run) startWarm(ctx context.Context, counts []int) *warmPool {
+	if r.d.opt.Transport != nil {
+		return nil
+	}
+	u, err := url.Parse(r.url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	wp := &warmPool{
+		scheme: u.Scheme,
+		addr:   canonicalAddr(u),
+		cancel: cancel,
+		slots:  make([][]*warmSlot, len(counts)),
+	}
+	for p, n := range counts {
+		for range n {
+			s := &warmSlot{ready: make(chan struct{})}
+			wp.slots[p] = append(wp.slots[p], s)
+			wp.all = append(wp.all, s)
+			go wp.dial(ctx, r.d.paths[p], s)
+		}
+	}
+	if len(wp.all) == 0 {
+		cancel()
+		return nil
+	}
+	return wp
+}
+
+func (wp *warmPool) dial(ctx context.Context, tr *http.Transport, s *warmSlot) {
+	defer close(s.ready)
+	ctx = context.WithValue(ctx, dialHookKey{}, func(c net.Conn) { s.conn = c })
+	cc, err := tr.NewClientConn(ctx, wp.scheme, wp.addr)
+	if err != nil {
+		return
+	}
+	s.cc = cc
+}
+
+// claim hands the next live connection on source path p to the caller, who
+// must close it; nil when the path has none left (or ctx ends first).
+func (wp *warmPool) claim(ctx context.Context, p int) *warmSlot {
+	if wp == nil {
+		return nil
+	}
+	for {
+		wp.mu.Lock()
+		if len(wp.slots[p]) == 0 {
+			wp.mu.Unlock()
+			return nil
+		}
+		s := wp.slots[p][0]
+		wp.slots[p] = wp.slots[p][1:]
+		wp.mu.Unlock()
+		select {
+		case <-s.ready:
+		case <-ctx.Done():
+			return nil // close releases the slot
+		}
+		if s.cc == nil || s.cc.Err() != nil {
+			continue // failed, or the server dropped it while idle
+		}
+		wp.mu.Lock()
+		s.inUse = true
+		wp.mu.Unlock()
+		return s
+	}
+}
+
+// close aborts outstanding dials and closes every connection no worker
+// claimed. Call only after the workers exited.
+func (wp *warmPool) close() (dialed, used int) {
+	if wp == nil {
+		return 0, 0
+	}
+	wp.cancel()
+	for _, s := range wp.all {
+		<-s.ready
+		if s.cc == nil {
+			continue
+		}
+		dialed++
+		wp.mu.Lock()
+		inUse := s.inUse
+		wp.mu.Unlock()
+		if !inUse {
+			_ = s.cc.Close()
+		}
+	}
+	return dialed, int(wp.used.Load())
+}
+
+// transport returns the RoundTripper a worker uses with a claimed slot:
+// requests to the warmed origin ride the slot's connection while it lasts;
+// anything else (a redirect elsewhere, or after the connection died) goes
+// to next.
+func (wp *warmPool) transport(s *warmSlot, next http.RoundTripper) http.RoundTripper {
+	return &warmTransport{wp: wp, slot: s, next: next}
+}
+
+type warmTransport struct {
+	wp   *warmPool
+	slot *warmSlot
+	next http.RoundTripper
+}
+
+func (t *warmTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cc := t.slot.cc
+	if cc.Err() != nil || req.URL.Scheme != t.wp.scheme || canonicalAddr(req.URL) != t.wp.addr {
+		return t.next.RoundTrip(req)
+	}
+	// A ClientConn bypasses the transport's connection lookup, which is
+	// what reports GotConn.
+	if trace := httptrace.ContextClientTrace(req.Context()); trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Conn: t.slot.conn, Reused: t.slot.reused})
+	}
+	t.slot.reused = true
+	resp, err := cc.RoundTrip(req)
+	if err == nil && !t.slot.served {
+		t.slot.served = true
+		t.wp.used.Add(1)
+	}
+	if err != nil && cc.Err() != nil && req.Body == nil && req.Context().Err() == nil {
+		// The connection died under a bodiless request: replay it on a
+		// fresh one, as the transport does for a stale pooled connection.
+		return t.next.RoundTrip(req)
+	}
+	return resp, err
+}
+
+// canonicalAddr returns u's host:port, with the scheme's default port.
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,171 @@
+package download
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// connCounter counts the connections a test server accepted and the
+// requests each one served.
+type connCounter struct {
+	accepted atomic.Int32
+	mu       sync.Mutex
+	requests map[string]int // by client address
+}
+
+func newConnCounter(t *testing.T, h http.Handler, useTLS bool) (*httptest.Server, *connCounter) {
+	t.Helper()
+	cc := &connCounter{requests: make(map[string]int)}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc.mu.Lock()
+		cc.requests[r.RemoteAddr]++
+		cc.mu.Unlock()
+		h.ServeHTTP(w, r)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			cc.accepted.Add(1)
+		}
+	}
+	if useTLS {
+		srv.StartTLS()
+	} else {
+		srv.Start()
+	}
+	t.Cleanup(srv.Close)
+	return srv, cc
+}
+
+func (cc *connCounter) serving() int {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return len(cc.requests)
+}
+
+// TestWarmConnectionsServeEagerFlows: the MinParts siblings of the election
+// request start on pre-established TLS connections, and a worker claiming
+// one never races it with a dial of its own.
+func TestWarmConnectionsServeEagerFlows(t *testing.T) {
+	t.Parallel()
+	data := testData(256 << 10)
+	var st stats
+	srv, cc := newConnCounter(t, throttledRangeHandler(data, `"v1"`, &st,
+		2*time.Millisecond, 16, func(*http.Request) bool { return true }), true)
+
+	rep := &initialReporter{}
+	d := newDL(t, &Options{
+		Parts: 4, MinParts: 4, MinPartSize: 16 << 10, Reporter: rep,
+		TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig,
+	})
+	res, got := mustGet(t, d, srv.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	if res.WarmConns != 3 {
+		t.Errorf("WarmConns = %d, want the 3 siblings of the election request", res.WarmConns)
+	}
+	// Beyond the election's and the warm ones, only the flow that read the
+	// initial response may dial: its pre-split body was abandoned.
+	if n := cc.accepted.Load(); n > 5 {
+		t.Errorf("server accepted %d connections, want at most 5", n)
+	}
+	if n := rep.connected.Load(); int(n) < len(st.rangeHeaders()) {
+		t.Errorf("Connected reported %d times for %d requests", n, len(st.rangeHeaders()))
+	}
+}
+
+// TestWarmConnectionServesRampBatch: while the initial response streams,
+// the ramp's next batch is dialed ahead, so the admitted flow starts on a
+// warm connection instead of dialing its own.
+func TestWarmConnectionServesRampBatch(t *testing.T) {
+	t.Parallel()
+	data := testData(1 << 20)
+	var st stats
+	// Per-connection pacing: a second flow doubles throughput, so the ramp
+	// admits it.
+	srv, cc := newConnCounter(t, throttledRangeHandler(data, `"v1"`, &st,
+		2*time.Millisecond, 16, func(*http.Request) bool { return true }), false)
+
+	d := newDL(t, &Options{Parts: 2, MinPartSize: 16 << 10})
+	res, got := mustGet(t, d, srv.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded bytes differ from source")
+	}
+	if cc.serving() < 2 {
+		t.Skip("ramp never admitted a second flow; scenario not exercised")
+	}
+	if res.WarmConns != 1 {
+		t.Errorf("WarmConns = %d, want the admitted flow on the warm connection", res.WarmConns)
+	}
+	if n := cc.accepted.Load(); n > 3 {
+		t.Errorf("server accepted %d connections, want at most 3", n)
+	}
+}
+
+// TestWarmPoolSingleFlowDialsNothing: a lone flow finishing on the initial
+// response must not cost the server an extra connection.
+func TestWarmPoolSingleFlowDialsNothing(t *testing.T) {
+	t.Parallel()
+	data := testData(64 << 10)
+	var st stats
+	srv, cc := newConnCounter(t, rangeHandler(data, `"v1"`, &st), false)
+	d := newDL(t, &Options{Parts: 1, MinPartSize: 16 << 10})
+	res, _ := mustGet(t, d, srv.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin"))
+	if n := cc.accepted.Load(); n != 1 || res.WarmConns != 0 {
+		t.Fatalf("accepted %d connections, WarmConns %d; want 1, 0", n, res.WarmConns)
+	}
+}
+
+func TestWarmPoolSkipsDeadConnections(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+	r := &run{d: newDL(t, nil), url: srv.URL + "/file.bin"}
+
+	wp := r.startWarm(t.Context(), []int{3})
+	first := wp.claim(t.Context(), 0)
+	if first == nil {
+		t.Fatal("no warm connection claimed")
+	}
+	defer first.cc.Close()
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, r.url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := wp.transport(first, http.DefaultTransport).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// The second connection drops while idle in the pool.
+	second := wp.slots[0][0]
+	<-second.ready
+	if second.cc == nil {
+		t.Fatal("second warm dial failed")
+	}
+	_ = second.cc.Close()
+	third := wp.claim(t.Context(), 0)
+	if third == nil || third == second {
+		t.Fatal("claimed a dead connection")
+	}
+	defer third.cc.Close()
+	// The third is claimed but never carries a request: not used.
+	if dialed, used := wp.close(); dialed != 3 || used != 1 {
+		t.Fatalf("close() = dialed %d, used %d; want 3, 1", dialed, used)
+	}
+}
+
+func TestWarmPoolNeedsInternalTransport(t *testing.T) {
+	t.Parallel()
+	r := &run{d: newDL(t, &Options{Transport: http.DefaultTransport}), url: "http://example.com/file.bin"}
+	if wp := r.startWarm(t.Context(), []int{2}); wp != nil {
+		t.Fatal("warmed connections for a caller-supplied Transport")
+	}
+}
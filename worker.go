@@ -7,7 +7,6 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptrace"
-	"os"
 	"time"
 )
 
@@ -40,13 +39,21 @@ type permanentError struct{ err error }
 func (e *permanentError) Error() string { return e.err.Error() }
 func (e *permanentError) Unwrap() error { return e.err }
 
+// sink receives a worker's bytes: the staging file, or a reorderWriter
+// for a Request.Writer download.
+type sink interface {
+	WriteAt(p []byte, off int64) (int, error)
+	Truncate(size int64) error
+	Name() string
+}
+
 // worker owns one connection slot: it pulls chunks from the scheduler and
 // downloads each with retry and stall detection.
 type worker struct {
 	id      int
 	r       *run
 	sched   *scheduler
-	file    *os.File
+	file    sink
 	client  *http.Client
 	timeout time.Duration
 	dtt     int // full buffers until the next timeout decay step
@@ -59,20 +66,29 @@ type worker struct {
 	// sawBody tracks the worker's first received body byte so the ramp cannot
 	// judge a newly admitted batch before that worker contributes.
 	sawBody bool
+	// transport is the worker's private connection pool (HTTP/2 mode);
+	// nil when it shares its path's transport.
+	transport *http.Transport
+	// warm is the pre-established connection the worker claimed, if any;
+	// the worker owns it and closes it on exit. A worker that consumed the
+	// initial response claims none: the election's connection returns to
+	// its path's pool when that body was read to the end.
+	warm        *warmSlot
+	tookInitial bool
 	// sleep is the retry/backoff sleeper; tests replace it with a
 	// channel-coordinated fake to prove cancellation without wall-clock
 	// assertions. Internal seam only.
 	sleep func(ctx context.Context, d time.Duration) error
 }
 
-func newWorker(id int, r *run, sched *scheduler, file *os.File) *worker {
+func newWorker(id int, r *run, sched *scheduler, file sink) *worker {
 	bp := r.d.bufs.Get().(*[]byte)
 	w := &worker{
 		id:      id,
 		r:       r,
 		sched:   sched,
 		file:    file,
-		timeout: r.d.opt.Timeout,
+		timeout: r.timeout,
 		buf:     *bp,
 		bufp:    bp,
 		sleep:   sleepCtx,
@@ -94,9 +110,21 @@ func (w *worker) releaseBuf() {
 	w.bufp = nil
 }
 
+// closeTransport drops the worker's private connection pool and warm
+// connection, if any.
+func (w *worker) closeTransport() {
+	if w.transport != nil {
+		w.transport.CloseIdleConnections()
+	}
+	if w.warm != nil {
+		_ = w.warm.cc.Close()
+	}
+}
+
 // run pulls chunks until the scheduler has nothing left for this worker.
 func (w *worker) run(ctx context.Context) error {
 	defer w.releaseBuf()
+	defer w.closeTransport()
 	defer w.sched.exit(w.id)
 	for {
 		if ctx.Err() != nil {
@@ -104,7 +132,16 @@ func (w *worker) run(ctx context.Context) error {
 		}
 		c := w.sched.next(w.id)
 		if c == nil {
-			return nil
+			moved := w.sched.wait(w.id)
+			if moved == nil {
+				return nil
+			}
+			select {
+			case <-moved:
+				continue
+			case <-ctx.Done():
+				return nil
+			}
 		}
 		if err := w.downloadChunk(ctx, c); err != nil {
 			if context.Cause(ctx) == errWorkerRetired { //nolint:errorlint // exact internal sentinel
@@ -176,7 +213,7 @@ func (w *worker) downloadChunk(ctx context.Context, c *chunk) error {
 		if errors.Is(err, errRangeCapped) {
 			// A complete server-declared subrange advanced the cursor. Continue
 			// immediately without charging progress against the retry budget.
-			w.r.d.log.Debug("continuing capped range", "worker", w.id, "chunk", c.id)
+			w.r.log.Debug("continuing capped range", "worker", w.id, "chunk", c.id)
 			continue
 		}
 		throttled := errors.Is(err, StatusError(http.StatusTooManyRequests))
@@ -188,7 +225,7 @@ func (w *worker) downloadChunk(ctx context.Context, c *chunk) error {
 			// advanced since this chunk's last charged attempt.
 			if cur := w.r.progress.Load(); cur > chargedAt {
 				chargedAt = cur
-				w.r.d.log.Debug("waiting out server throttle", "worker", w.id, "chunk", c.id)
+				w.r.log.Debug("waiting out server throttle", "worker", w.id, "chunk", c.id)
 				if serr := w.sleep(ctx, time.Second); serr != nil {
 					return err
 				}
@@ -197,11 +234,11 @@ func (w *worker) downloadChunk(ctx context.Context, c *chunk) error {
 		}
 		chargedAt = w.r.progress.Load()
 		attempt++
-		if attempt >= w.r.d.opt.MaxRetries {
+		if attempt >= w.r.maxRetries {
 			return fmt.Errorf("chunk %d: %w: %w", c.id, ErrMaxRetry, err)
 		}
 		w.r.rep.ChunkRetry(c.id, attempt, err)
-		w.r.d.log.Debug("retrying chunk", "worker", w.id, "chunk", c.id,
+		w.r.log.Debug("retrying chunk", "worker", w.id, "chunk", c.id,
 			"attempt", attempt, "err", err)
 		// 429s always sleep the flat politeness pause and never touch
 		// bo.next(), so throttle waits — free or charged — cannot escalate
@@ -226,10 +263,11 @@ func (w *worker) attempt(ctx context.Context, c *chunk) error {
 		// The election body starts at byte zero: whichever worker is granted
 		// that chunk consumes it instead of issuing a duplicate request.
 		if resp, addr, ecancel := w.r.takeInitial(); resp != nil {
+			w.tookInitial = true
 			return w.initialRangeAttempt(ctx, c, end, resp, addr, ecancel)
 		}
 	}
-	w.ensureClient()
+	w.ensureClient(ctx)
 
 	actx, cancel := context.WithCancelCause(ctx)
 	defer cancel(nil)
@@ -240,8 +278,7 @@ func (w *worker) attempt(ctx context.Context, c *chunk) error {
 		w.r.rep.Connected(c.id, ci.Conn.RemoteAddr().String())
 	}}
 	reqCtx := httptrace.WithClientTrace(actx, trace)
-	req, err := http.NewRequestWithContext(reqCtx,
-		http.MethodGet, w.r.url, nil)
+	req, err := w.r.newRequest(reqCtx)
 	if err != nil {
 		return &permanentError{err}
 	}
@@ -250,6 +287,9 @@ func (w *worker) attempt(ctx context.Context, c *chunk) error {
 	if v := w.r.validator(); v != "" {
 		req.Header.Set("If-Range", v)
 	}
+	if err := w.r.d.prepare(req); err != nil {
+		return &permanentError{err}
+	}
 
 	resp, err := w.client.Do(req)
 	if err != nil {
@@ -269,8 +309,8 @@ func (w *worker) attempt(ctx context.Context, c *chunk) error {
 		// The server just told us the flow count is too high; retaining it
 		// would only create retry traffic. Shed flows, eager ones included.
 		_ = resp.Body.Close()
-		if w.r.ramp != nil {
-			w.r.ramp.rejectThrottled(w.id)
+		if rs, local := w.r.rampFor(w.id); rs != nil {
+			rs.rejectThrottled(local)
 		}
 		return StatusError(resp.StatusCode)
 	case isRetryableStatus(resp.StatusCode):
@@ -393,15 +433,15 @@ type observedReader struct {
 func (o *observedReader) Read(p []byte) (int, error) {
 	n, err := o.r.Read(p)
 	if n > 0 {
-		total := o.w.r.progress.Add(int64(n))
-		if o.w.r.ramp != nil {
+		o.w.r.progress.Add(int64(n))
+		if rs, local := o.w.r.rampFor(o.w.id); rs != nil {
 			if !o.w.sawBody {
 				// First body byte this worker ever received: it can now
 				// participate in the aggregate-rate judgment.
 				o.w.sawBody = true
-				o.w.r.ramp.noteWorkerReady(o.w.id)
+				rs.noteWorkerReady(local)
 			}
-			o.w.r.ramp.note(total)
+			rs.note(rs.delivered.Add(int64(n)))
 		}
 	}
 	return n, err
@@ -463,10 +503,14 @@ func (w *worker) pump(timer *time.Timer,
 // single funnel for transport errors, so URL redaction lives here rather than
 // at each client.Do call site.
 func (w *worker) classify(err error, actx context.Context) error {
+	fillPinHost(err)
 	err = redactErr(err)
 	if _, ok := errors.AsType[*permanentError](err); ok {
 		return err
 	}
+	if isPolicyError(err) {
+		return &permanentError{err}
+	}
 	if context.Cause(actx) == errStall { //nolint:errorlint // exact sentinel set by our AfterFunc
 		w.bumpTimeout()
 		return errStall
@@ -478,7 +522,7 @@ func (w *worker) classify(err error, actx context.Context) error {
 }
 
 func (w *worker) bumpTimeout() {
-	base := w.r.d.opt.Timeout
+	base := w.r.timeout
 	if w.timeout < base {
 		w.timeout = base
 	}
@@ -492,7 +536,7 @@ func (w *worker) bumpTimeout() {
 }
 
 func (w *worker) decayTimeout() {
-	base := w.r.d.opt.Timeout
+	base := w.r.timeout
 	if w.timeout <= base {
 		w.timeout = base
 		return
@@ -509,18 +553,31 @@ func (w *worker) decayTimeout() {
 	}
 }
 
-// ensureClient lazily builds the worker's HTTP client.
-func (w *worker) ensureClient() {
+// ensureClient lazily builds the worker's HTTP client, on a warm connection
+// when its source path has one.
+func (w *worker) ensureClient(ctx context.Context) {
 	if w.client != nil {
 		return
 	}
-	w.client = w.r.d.newClient(w.r.d.roundTripper())
+	p := w.r.d.pathFor(w.id)
+	rt, own := w.r.d.flowTransport(p)
+	w.transport = own
+	if w.tookInitial {
+		w.client = w.r.d.newClient(rt, w.r.sourceURL)
+		return
+	}
+	if s := w.r.warm.claim(ctx, p); s != nil {
+		w.warm = s
+		rt = w.r.warm.transport(s, rt)
+	}
+	w.client = w.r.d.newClient(rt, w.r.sourceURL)
 }
 
 // singleStream downloads the whole body sequentially (no Range support or
 // unknown size). A retry restarts from byte zero.
 func (w *worker) singleStream(ctx context.Context) error {
 	defer w.releaseBuf()
+	defer w.closeTransport()
 	for attempt := 0; ; attempt++ {
 		err := w.singleAttempt(ctx)
 		if err == nil {
@@ -532,7 +589,7 @@ func (w *worker) singleStream(ctx context.Context) error {
 		if perm, ok := errors.AsType[*permanentError](err); ok {
 			return perm.err
 		}
-		if attempt+1 >= w.r.d.opt.MaxRetries {
+		if attempt+1 >= w.r.maxRetries {
 			return fmt.Errorf("%w: %w", ErrMaxRetry, err)
 		}
 		w.r.rep.ChunkRetry(0, attempt+1, err)
@@ -627,7 +684,7 @@ func (w *worker) singleAttempt(ctx context.Context) error {
 	initial := resp != nil
 	defer ecancel(nil)
 	if !initial {
-		w.ensureClient()
+		w.ensureClient(ctx)
 	}
 
 	actx, cancel := context.WithCancelCause(ctx)
@@ -648,11 +705,14 @@ func (w *worker) singleAttempt(ctx context.Context) error {
 	defer timer.Stop()
 
 	if !initial {
-		req, err := http.NewRequestWithContext(actx, http.MethodGet, w.r.url, nil)
+		req, err := w.r.newRequest(actx)
 		if err != nil {
 			return &permanentError{err}
 		}
 		w.r.applyHeaders(req)
+		if err := w.r.d.prepare(req); err != nil {
+			return &permanentError{err}
+		}
 		resp, err = w.client.Do(req)
 		if err != nil {
 			return w.classify(err, actx)
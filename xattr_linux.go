@@ -0,0 +1,22 @@
+package download
+
+import (
+	"os"
+	"syscall"
+)
+
+func setXattr(path, name, value string) error {
+	if err := syscall.Setxattr(path, name, []byte(value), 0); err != nil {
+		return &os.SyscallError{Syscall: "setxattr", Err: err}
+	}
+	return nil
+}
+
+func getXattr(path, name string) (string, error) {
+	buf := make([]byte, 1024)
+	n, err := syscall.Getxattr(path, name, buf)
+	if err != nil {
+		return "", &os.SyscallError{Syscall: "getxattr", Err: err}
+	}
+	return string(buf[:n]), nil
+}
@@ -0,0 +1,59 @@
+package download
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func readXattr(t *testing.T, path, name string) string {
+	t.Helper()
+	v, err := getXattr(path, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// TestPreserveXattrs: the redacted source URL, ETag, and Content-Type are
+// recorded in extended attributes, where SkipValid finds the ETag.
+func TestPreserveXattrs(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	probe := filepath.Join(dir, "probe")
+	if err := os.WriteFile(probe, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := setXattr(probe, xattrETag, "x"); errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EPERM) {
+		t.Skipf("no user extended attributes here: %v", err)
+	}
+	data := testData(32 << 10)
+	var st stats
+	srv := httptest.NewServer(rangeHandler(data, `"v1"`, &st))
+	t.Cleanup(srv.Close)
+	d := newDL(t, &Options{PreserveMetadata: true})
+
+	url := "http://user:secret@" + srv.Listener.Addr().String() + "/file.bin"
+	res, err := d.Do(t.Context(), &Request{URL: url, Dest: filepath.Join(dir, "file.bin")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readXattr(t, res.Path, xattrOriginURL), redactURL(url); got != want {
+		t.Errorf("%s = %q, want %q", xattrOriginURL, got, want)
+	}
+	if got := readXattr(t, res.Path, xattrETag); got != `"v1"` {
+		t.Errorf("%s = %q", xattrETag, got)
+	}
+	if got := readXattr(t, res.Path, xattrMimeType); got != res.ContentType || got == "" {
+		t.Errorf("%s = %q, want %q", xattrMimeType, got, res.ContentType)
+	}
+
+	// The recorded ETag lets SkipValid recognize the file.
+	d = newDL(t, &Options{SkipValid: true})
+	if res, err = d.Do(t.Context(), &Request{URL: url, Dest: res.Path}); err != nil || !res.Skipped {
+		t.Errorf("SkipValid by ETag: Skipped = %v, err = %v", res != nil && res.Skipped, err)
+	}
+}
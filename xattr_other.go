@@ -0,0 +1,15 @@
+//go:build !linux
+
+package download
+
+import "errors"
+
+// setXattr and getXattr are Linux-only; elsewhere PreserveMetadata records
+// the mtime alone.
+func setXattr(path, name, value string) error {
+	return errors.ErrUnsupported
+}
+
+func getXattr(path, name string) (string, error) {
+	return "", errors.ErrUnsupported
+}